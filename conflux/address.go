@@ -0,0 +1,103 @@
+package conflux
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// defaultHostPrefix is the prefix assumed when the anchor assigns a bare IP
+const defaultHostPrefix = 32
+
+// normalizeCIDR returns the CIDR assigned by the anchor as IP/prefix, treating a bare IP as a host address
+func normalizeCIDR(cidr string) (string, error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return "", fmt.Errorf("invalid CIDR format: %q", cidr)
+		}
+		if ip.To4() == nil {
+			return "", fmt.Errorf("the anchor assigned the IPv6 address %q, only IPv4 is supported", cidr)
+		}
+		return fmt.Sprintf("%s/%d", ip.To4(), defaultHostPrefix), nil
+	}
+
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("invalid CIDR format: %q", cidr)
+	}
+	if ip.To4() == nil {
+		return "", fmt.Errorf("the anchor assigned the IPv6 CIDR %q, only IPv4 is supported", cidr)
+	}
+
+	// An IPv4-mapped IPv6 CIDR such as ::ffff:10.0.0.1/120 carries a 16-byte mask covering the mapping prefix too
+	prefix, bits := ipNet.Mask.Size()
+	if bits == 8*net.IPv6len {
+		prefix -= 8 * (net.IPv6len - net.IPv4len)
+		if prefix < 0 {
+			return "", fmt.Errorf("invalid CIDR format: %q, the prefix is shorter than the IPv4-mapped address", cidr)
+		}
+	}
+	return fmt.Sprintf("%s/%d", ip.To4(), prefix), nil
+}
+
+// parseExtraAddresses parses the extra addresses to assign to the TUN interface
+// If primary is set the addresses are also checked against the primary CIDR, whose subnet they may not overlap
+func parseExtraAddresses(primary string, extras []string) ([]*net.IPNet, error) {
+	seen := make(map[string]bool)
+	var primaryNet *net.IPNet
+	if primary != "" {
+		primaryIP, ipNet, err := net.ParseCIDR(primary)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR format: %s", primary)
+		}
+		seen[primaryIP.String()] = true
+		primaryNet = ipNet
+	}
+
+	var addrs []*net.IPNet
+	for _, extra := range extras {
+		ip, ipNet, err := net.ParseCIDR(extra)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extra address %s, expected IP/prefix: %v", extra, err)
+		}
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("invalid extra address %s, only IPv4 is supported", extra)
+		}
+		if seen[ip.String()] {
+			return nil, fmt.Errorf("extra address %s conflicts with another address assigned to the interface", extra)
+		}
+		seen[ip.String()] = true
+
+		// Overlapping subnets would install two connected routes for the same addresses
+		if primaryNet != nil && (primaryNet.Contains(ipNet.IP) || ipNet.Contains(primaryNet.IP)) {
+			return nil, fmt.Errorf("extra address %s overlaps the assigned CIDR %s", extra, primary)
+		}
+
+		// Keep the host address rather than the network address
+		ipNet.IP = ip.To4()
+		addrs = append(addrs, ipNet)
+	}
+	return addrs, nil
+}
+
+// checkPeer checks the point-to-point peer address of the TUN against the CIDR assigned to the interface
+// The peer takes the prefix of the CIDR, so unless the CIDR is a host address it must lie inside it
+func checkPeer(cidr, peer string) error {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR format: %s", cidr)
+	}
+	peerIP := net.ParseIP(peer)
+	if peerIP == nil || peerIP.To4() == nil {
+		return fmt.Errorf("invalid peer address %s, must be an IPv4 address", peer)
+	}
+	if peerIP.Equal(ip) {
+		return fmt.Errorf("peer address %s is the address of the interface", peer)
+	}
+	if prefix, _ := ipNet.Mask.Size(); prefix < 32 && !ipNet.Contains(peerIP) {
+		return fmt.Errorf("peer address %s is outside the assigned CIDR %s", peer, cidr)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package conflux
+
+import "testing"
+
+func TestNormalizeCIDR(t *testing.T) {
+	tests := []struct {
+		cidr    string
+		want    string
+		wantErr bool
+	}{
+		{cidr: "10.0.0.5", want: "10.0.0.5/32"},
+		{cidr: "10.0.0.5/24", want: "10.0.0.5/24"},
+		{cidr: " 10.0.0.5/24\n", want: "10.0.0.5/24"},
+		{cidr: "::ffff:10.0.0.5", want: "10.0.0.5/32"},
+		{cidr: "::ffff:10.0.0.5/120", want: "10.0.0.5/24"},
+		{cidr: "::ffff:10.0.0.5/64", wantErr: true},
+		{cidr: "", wantErr: true},
+		{cidr: "10.0.0", wantErr: true},
+		{cidr: "10.0.0.5/", wantErr: true},
+		{cidr: "10.0.0.5/33", wantErr: true},
+		{cidr: "10.0.0.256/24", wantErr: true},
+		{cidr: "not-an-ip", wantErr: true},
+		{cidr: "fd00::5", wantErr: true},
+		{cidr: "fd00::5/64", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeCIDR(tt.cidr)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeCIDR(%q) = %q, want an error", tt.cidr, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeCIDR(%q) = %q, %v, want %q", tt.cidr, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseExtraAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		extras  []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "outside the CIDR", extras: []string{"192.168.7.1/24", "172.16.0.1/32"}, want: []string{"192.168.7.1/24", "172.16.0.1/32"}},
+		{name: "inside the CIDR", extras: []string{"10.128.9.9/32"}, wantErr: true},
+		{name: "covering the CIDR", extras: []string{"10.0.0.1/8"}, wantErr: true},
+		{name: "the assigned address", extras: []string{"10.128.0.5/24"}, wantErr: true},
+		{name: "duplicate", extras: []string{"192.168.7.1/24", "192.168.7.1/32"}, wantErr: true},
+		{name: "bare IP", extras: []string{"192.168.7.1"}, wantErr: true},
+		{name: "IPv6", extras: []string{"fd00::1/64"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs, err := parseExtraAddresses("10.128.0.5/16", tt.extras)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseExtraAddresses(%q) = %v, want an error", tt.extras, addrs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseExtraAddresses(%q): %v", tt.extras, err)
+			}
+			if len(addrs) != len(tt.want) {
+				t.Fatalf("parseExtraAddresses(%q) = %v, want %q", tt.extras, addrs, tt.want)
+			}
+			for i, addr := range addrs {
+				if addr.String() != tt.want[i] {
+					t.Errorf("address %d is %s, want %s", i, addr, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+import (
+	"runtime"
+
+	"github.com/veil-net/veilnet"
+	"golang.org/x/sys/unix"
+)
+
+// pinLoop locks the calling packet loop to its OS thread and pins the thread to the configured CPU
+// The first CPU is used by the ingress loop (index 0) and the second by the egress loop (index 1)
+func (c *conflux) pinLoop(name string, index int) {
+	cpus := c.opts.CPUAffinity
+	if len(cpus) == 0 {
+		return
+	}
+	cpu := cpus[min(index, len(cpus)-1)]
+
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	set.Set(cpu)
+	err := unix.SchedSetaffinity(0, &set)
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("failed to pin %s loop to CPU %d: %v", name, cpu, err)
+		return
+	}
+	veilnet.Logger.Sugar().Infof("Pinned %s loop to CPU %d", name, cpu)
+}
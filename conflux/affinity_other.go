@@ -0,0 +1,7 @@
+//go:build !linux
+// +build !linux
+
+package conflux
+
+// pinLoop is a no-op, CPU affinity is only supported on Linux
+func (c *conflux) pinLoop(name string, index int) {}
@@ -0,0 +1,141 @@
+package conflux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// anchorProgressInterval is how often progress is logged while the anchor is connecting
+const anchorProgressInterval = 5 * time.Second
+
+// Anchor is the connection to VeilNet the conflux moves packets through
+type Anchor interface {
+
+	// Start connects the anchor to VeilNet
+	Start(apiBaseURL, anchorToken string, portal bool) error
+
+	// Stop disconnects the anchor
+	Stop()
+
+	// Read reads up to batchSize packets from VeilNet into bufs, returning the number read
+	Read(bufs [][]byte, batchSize int) int
+
+	// Write writes the packets in bufs to VeilNet, returning the number written
+	Write(bufs [][]byte, sizes []int) int
+
+	// GetCIDR returns the CIDR assigned to the anchor
+	GetCIDR() (string, error)
+
+	// GetVeilHost returns the address of the Veil Master, if any
+	GetVeilHost() string
+
+	// IsAlive reports whether the anchor is still running
+	IsAlive() bool
+
+	// Context returns a context that is cancelled when the anchor stops
+	Context() context.Context
+}
+
+// newAnchor creates the anchor used by the conflux, it can be replaced to run the conflux without VeilNet
+var newAnchor = func() Anchor {
+	return &veilnetAnchor{Anchor: veilnet.NewAnchor()}
+}
+
+// veilnetAnchor adapts a veilnet.Anchor to the Anchor interface
+type veilnetAnchor struct {
+	*veilnet.Anchor
+}
+
+func (a *veilnetAnchor) IsAlive() bool {
+	return a.Ctx.Err() == nil
+}
+
+func (a *veilnetAnchor) Context() context.Context {
+	return a.Ctx
+}
+
+// StartAnchor starts the anchor, giving up when ctx is done or the anchor timeout expires
+func (c *conflux) StartAnchor(ctx context.Context, apiBaseURL, anchorToken string, portal bool) error {
+
+	// Bound the wait so an unreachable Guardian or relay does not hang the startup
+	if c.opts.AnchorTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.AnchorTimeout)
+		defer cancel()
+	}
+
+	// Start the anchor in the background so the startup can be aborted
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.anchor.Start(apiBaseURL, anchorToken, portal)
+	}()
+
+	veilnet.Logger.Sugar().Infof("Connecting to VeilNet via %s", apiBaseURL)
+	progress := time.NewTicker(anchorProgressInterval)
+	defer progress.Stop()
+	started := time.Now()
+
+	for {
+		select {
+		case err := <-errChan:
+			return err
+		case <-progress.C:
+			veilnet.Logger.Sugar().Infof("Still connecting to VeilNet, %s elapsed", time.Since(started).Round(time.Second))
+		case <-ctx.Done():
+			// Start cannot be interrupted, so stop the anchor if it still connects after being given up on
+			go stopLateAnchor(c.anchor, errChan)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("failed to connect to anchor within %s", c.opts.AnchorTimeout)
+			}
+			return fmt.Errorf("anchor startup aborted: %w", ctx.Err())
+		}
+	}
+}
+
+// stopLateAnchor waits for an abandoned Start to return and stops the anchor if it connected after all
+func stopLateAnchor(anchor Anchor, errChan <-chan error) {
+	if err := <-errChan; err == nil {
+		veilnet.Logger.Sugar().Infof("The anchor connected after the startup gave up on it, stopping it")
+		anchor.Stop()
+	}
+}
+
+// watchAnchor waits for the anchor to go down, then exits the process or closes Done depending on ExitOnAnchorLoss
+func (c *conflux) watchAnchor() {
+	<-c.anchor.Context().Done()
+
+	// The anchor going down is expected once the conflux is stopping
+	if c.stopped.Load() {
+		return
+	}
+
+	veilnet.Logger.Sugar().Info("Anchor stopped")
+	c.fail("anchor lost")
+}
+
+// fail handles the conflux no longer moving packets, exiting the process or closing Done depending on ExitOnAnchorLoss
+func (c *conflux) fail(reason string) {
+	c.failOnce.Do(func() {
+		c.session.disconnected()
+		if c.opts.ExitOnAnchorLoss {
+			if c.opts.NoCleanupOnExit {
+				veilnet.Logger.Sugar().Warnf("Conflux failed (%s), exiting without cleanup, the host configuration is left in place", reason)
+			} else {
+				c.Stop()
+			}
+			os.Exit(1)
+		}
+		veilnet.Logger.Sugar().Warnf("Conflux failed (%s), the host configuration is kept until the conflux is stopped", reason)
+		close(c.lost)
+	})
+}
+
+// Done returns a channel closed when the conflux failed, e.g. the anchor was lost, and the process was not exited
+func (c *conflux) Done() <-chan struct{} {
+	return c.lost
+}
@@ -0,0 +1,184 @@
+package conflux
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockAnchor is an Anchor that records its calls, hands out the packets sent to in and captures the packets written
+// to it on out
+type mockAnchor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	cidr     string
+	veilHost string
+	startErr error
+
+	// release blocks Start until it is closed, nil returns at once
+	release chan struct{}
+
+	// onStart is called when Start is, before it returns
+	onStart func()
+
+	in  chan []byte
+	out chan []byte
+
+	mu     sync.Mutex
+	calls  []string
+	writes []int
+}
+
+func newMockAnchor() *mockAnchor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &mockAnchor{
+		ctx:    ctx,
+		cancel: cancel,
+		cidr:   "10.128.0.5/16",
+		in:     make(chan []byte, 64),
+		out:    make(chan []byte, 64),
+	}
+}
+
+func (a *mockAnchor) record(call string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, call)
+}
+
+// called returns the calls made so far, in order
+func (a *mockAnchor) called() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.calls)
+}
+
+func (a *mockAnchor) Start(apiBaseURL, anchorToken string, portal bool) error {
+	a.record("Start")
+	if a.onStart != nil {
+		a.onStart()
+	}
+	if a.release != nil {
+		<-a.release
+	}
+	return a.startErr
+}
+
+func (a *mockAnchor) Stop() {
+	a.record("Stop")
+	a.cancel()
+}
+
+func (a *mockAnchor) Read(bufs [][]byte, batchSize int) int {
+	n := 0
+	for n < batchSize {
+		select {
+		case pkt := <-a.in:
+			bufs[n] = pkt
+			n++
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+func (a *mockAnchor) Write(bufs [][]byte, sizes []int) int {
+	a.mu.Lock()
+	a.writes = append(a.writes, len(bufs))
+	a.mu.Unlock()
+	for i, buf := range bufs {
+		a.out <- slices.Clone(buf[:sizes[i]])
+	}
+	return len(bufs)
+}
+
+// written returns the number of packets in each write so far
+func (a *mockAnchor) written() []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.writes)
+}
+
+func (a *mockAnchor) GetCIDR() (string, error) {
+	a.record("GetCIDR")
+	return a.cidr, nil
+}
+
+func (a *mockAnchor) GetVeilHost() string {
+	return a.veilHost
+}
+
+func (a *mockAnchor) IsAlive() bool {
+	return a.ctx.Err() == nil
+}
+
+func (a *mockAnchor) Context() context.Context {
+	return a.ctx
+}
+
+// useMockAnchor makes newAnchor return anchor for the rest of the test
+func useMockAnchor(t *testing.T, anchor *mockAnchor) {
+	t.Helper()
+	prev := newAnchor
+	newAnchor = func() Anchor { return anchor }
+	t.Cleanup(func() { newAnchor = prev })
+}
+
+func TestCheckTokenStartsAnchorBeforeCIDR(t *testing.T) {
+	anchor := newMockAnchor()
+	anchor.cidr = "10.128.0.5"
+	useMockAnchor(t, anchor)
+
+	cidr, err := CheckToken(context.Background(), Options{}, "https://guardian.example", "token", false)
+	if err != nil {
+		t.Fatalf("CheckToken: %v", err)
+	}
+	if cidr != "10.128.0.5/32" {
+		t.Errorf("CheckToken returned %s, want 10.128.0.5/32", cidr)
+	}
+	if got, want := anchor.called(), []string{"Start", "GetCIDR", "Stop"}; !slices.Equal(got, want) {
+		t.Errorf("anchor calls %v, want %v", got, want)
+	}
+}
+
+func TestCheckTokenRejected(t *testing.T) {
+	anchor := newMockAnchor()
+	anchor.startErr = errors.New("token rejected")
+	useMockAnchor(t, anchor)
+
+	_, err := CheckToken(context.Background(), Options{}, "https://guardian.example", "token", false)
+	if !errors.Is(err, anchor.startErr) {
+		t.Fatalf("CheckToken returned %v, want %v", err, anchor.startErr)
+	}
+	if got, want := anchor.called(), []string{"Start", "Stop"}; !slices.Equal(got, want) {
+		t.Errorf("anchor calls %v, want %v", got, want)
+	}
+}
+
+func TestStartAnchorStopsLateAnchor(t *testing.T) {
+	anchor := newMockAnchor()
+	anchor.release = make(chan struct{})
+	c := newConflux(Options{AnchorTimeout: 10 * time.Millisecond})
+	c.anchor = anchor
+
+	err := c.StartAnchor(context.Background(), "https://guardian.example", "token", false)
+	if err == nil {
+		t.Fatal("StartAnchor succeeded while Start was blocked")
+	}
+	if slices.Contains(anchor.called(), "Stop") {
+		t.Fatal("anchor stopped before Start returned")
+	}
+
+	// The anchor connects after the startup gave up on it
+	close(anchor.release)
+	select {
+	case <-anchor.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("anchor that connected late was not stopped")
+	}
+}
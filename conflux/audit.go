@@ -0,0 +1,24 @@
+package conflux
+
+import (
+	"strings"
+
+	"github.com/veil-net/veilnet"
+)
+
+// auditRoutes logs a snapshot of the host routing state if AuditRoutes is set, stage says when it was taken
+// It only runs read-only commands, a failing one is logged and the rest still run
+func (c *conflux) auditRoutes(stage string) {
+	if !c.opts.AuditRoutes {
+		return
+	}
+	for _, args := range c.auditCommands() {
+		command := strings.Join(args, " ")
+		out, err := runCommand(args[0], args[1:]...)
+		if err != nil {
+			veilnet.Logger.Sugar().Warnf("Route audit %s: %s failed: %v", stage, command, err)
+			continue
+		}
+		veilnet.Logger.Sugar().Infof("Route audit %s: %s\n%s", stage, command, out)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build darwin
+// +build darwin
+
+package conflux
+
+// auditCommands returns the commands whose output makes up a route audit snapshot
+func (c *conflux) auditCommands() [][]string {
+	return [][]string{
+		{"netstat", "-rn", "-f", "inet"},
+	}
+}
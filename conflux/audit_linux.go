@@ -0,0 +1,16 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+// auditCommands returns the commands whose output makes up a route audit snapshot
+func (c *conflux) auditCommands() [][]string {
+	commands := [][]string{
+		{"ip", "-4", "rule", "show"},
+		{"ip", "-4", "route", "show", "table", "all"},
+	}
+	if c.portal {
+		commands = append(commands, []string{"iptables-save"})
+	}
+	return commands
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package conflux
+
+// auditCommands returns the commands whose output makes up a route audit snapshot
+func (c *conflux) auditCommands() [][]string {
+	return [][]string{
+		{"route", "print", "-4"},
+	}
+}
@@ -0,0 +1,51 @@
+package conflux
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/veil-net/veilnet"
+)
+
+// autoIfaceLimit is how many numbered interface names AutoIface tries after the one asked for
+const autoIfaceLimit = 16
+
+// createTUNAuto runs create, which creates the TUN named by opts.Interface, and with AutoIface retries it with the
+// numbered names after it, e.g. veilnet1 and veilnet2, while the name is taken. A name is taken when a conflux answers
+// on its control interface or an interface by that name exists and create fails on it. The name used is left in
+// opts.Interface
+func (c *conflux) createTUNAuto(create func() error) error {
+	if !c.opts.AutoIface || c.opts.TUNFd != 0 {
+		return create()
+	}
+
+	base := c.opts.Interface
+	for i := 0; i <= autoIfaceLimit; i++ {
+		name := base
+		if i > 0 {
+			name = fmt.Sprintf("%s%d", base, i)
+		}
+		if _, err := SendControl(name, ControlRequest{Command: ControlStatus}); err == nil {
+			veilnet.Logger.Sugar().Infof("A conflux is already running on %s, trying the next name", name)
+			continue
+		}
+
+		c.opts.Interface = name
+		err := create()
+		if err == nil {
+			if name != base {
+				veilnet.Logger.Sugar().Warnf("Interface %s is taken, using %s instead", base, name)
+			}
+			return nil
+		}
+
+		// Only a failure on an existing interface means the name is taken
+		if _, lookupErr := net.InterfaceByName(name); lookupErr != nil {
+			c.opts.Interface = base
+			return err
+		}
+		veilnet.Logger.Sugar().Infof("Interface %s is taken (%v), trying the next name", name, err)
+	}
+	c.opts.Interface = base
+	return fmt.Errorf("no free interface name from %s to %s%d", base, base, autoIfaceLimit)
+}
@@ -0,0 +1,40 @@
+package conflux
+
+import "time"
+
+const (
+	// idleSpinReads is the number of consecutive empty reads before a packet loop starts sleeping
+	idleSpinReads = 64
+
+	// idleMinDelay is the first sleep of an idle packet loop
+	idleMinDelay = 50 * time.Microsecond
+
+	// idleMaxDelay caps the sleep of an idle packet loop so traffic is picked up again quickly
+	idleMaxDelay = 10 * time.Millisecond
+)
+
+// idleBackoff slows down a packet loop that keeps reading nothing, so spurious wakeups do not turn into a busy loop
+type idleBackoff struct {
+	idle  int
+	delay time.Duration
+}
+
+// wait records a read of n packets, sleeping with an increasing delay after repeated empty reads
+func (b *idleBackoff) wait(n int) {
+	if n > 0 {
+		b.idle = 0
+		b.delay = 0
+		return
+	}
+
+	b.idle++
+	if b.idle < idleSpinReads {
+		return
+	}
+	if b.delay == 0 {
+		b.delay = idleMinDelay
+	} else if b.delay < idleMaxDelay {
+		b.delay = min(b.delay*2, idleMaxDelay)
+	}
+	time.Sleep(b.delay)
+}
@@ -0,0 +1,25 @@
+package conflux
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// checkBinaries returns an error listing the required binaries that are not on the PATH
+// hints maps a binary to how to install it
+func checkBinaries(required []string, hints map[string]string) error {
+	var missing []string
+	for _, name := range required {
+		if _, err := exec.LookPath(name); err != nil {
+			if hint, ok := hints[name]; ok {
+				name = fmt.Sprintf("%s (%s)", name, hint)
+			}
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required commands not found in PATH: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
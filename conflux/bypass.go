@@ -0,0 +1,130 @@
+package conflux
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/veil-net/veilnet"
+)
+
+// bypassHosts are reached via the host gateway so the anchor can connect outside the tunnel
+var bypassHosts = []string{"stun.cloudflare.com", "turn.cloudflare.com", "guardian.veilnet.org", "turn.veilnet.org"}
+
+// errRouteExists is returned when adding a route that is already in the routing table
+var errRouteExists = errors.New("route already exists")
+
+// AddBypassRoutes pins the bypass hosts to the host gateway, it is safe to call repeatedly
+func (c *conflux) AddBypassRoutes() {
+	cache := loadResolveCache()
+	defer saveResolveCache(cache)
+
+	for _, host := range bypassHosts {
+		// Resolve IP addresses, falling back to the cached addresses
+		ips, err := resolveBypassHost(host, cache)
+		if err != nil {
+			veilnet.Logger.Sugar().Errorf("Failed to resolve %s: %v", host, err)
+			continue
+		}
+
+		for _, ip := range ips {
+			// Add route for IPv4 addresses
+			if ip4 := ip.To4(); ip4 != nil {
+				c.addBypassRoute(host, ip4.String())
+			}
+		}
+	}
+}
+
+// addBypassRoute pins dest to the host gateway unless a route to it is already installed
+func (c *conflux) addBypassRoute(host, dest string) {
+
+	// Skip routes this conflux already installed
+	if _, ok := c.bypassRoutes.Load(dest); ok {
+		return
+	}
+
+	// Take over a route an earlier run left behind, so it is removed on exit this time
+	if c.adoptHostRoute(dest) {
+		c.bypassRoutes.Store(dest, host)
+		veilnet.Logger.Sugar().Infof("Took over the bypass route for %s (%s) left by an earlier run", host, dest)
+		return
+	}
+
+	// Skip routes installed by someone else, they are not ours to remove
+	if c.hasHostRoute(dest) {
+		veilnet.Logger.Sugar().Infof("Bypass route for %s (%s) already exists, skipping", host, dest)
+		return
+	}
+
+	// Skip hosts reached through a more specific route than the default, such as the LAN, pinning them could break them
+	if route := c.specificRoute(dest); route != "" {
+		veilnet.Logger.Sugar().Infof("%s (%s) is reached through %s, skipping the bypass route", host, dest, route)
+		return
+	}
+
+	err := c.addHostRoute(dest)
+	if errors.Is(err, errRouteExists) {
+		veilnet.Logger.Sugar().Infof("Bypass route for %s (%s) already exists, skipping", host, dest)
+		return
+	}
+	if err != nil {
+		veilnet.Logger.Sugar().Errorf("Failed to add bypass route for %s (%s): %v", host, dest, err)
+		return
+	}
+
+	// Store the bypass route
+	c.bypassRoutes.Store(dest, host)
+	veilnet.Logger.Sugar().Infof("Pinned %s (%s) to the host gateway", host, dest)
+}
+
+// AddDNSBypassRoutes pins the public DNS servers outside cidr to the host gateway if DNSBypass is set
+// Servers inside the tunnel CIDR are only reachable through the tunnel, private ones are left to the host routes
+func (c *conflux) AddDNSBypassRoutes(cidr string) {
+	if !c.opts.DNSBypass {
+		return
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		veilnet.Logger.Sugar().Errorf("Failed to add DNS bypass routes: invalid CIDR format: %s", cidr)
+		return
+	}
+
+	for _, server := range c.opts.DNS {
+		addr, err := netip.ParseAddr(server)
+		if err != nil || !addr.Is4() {
+			continue
+		}
+		if prefix.Masked().Contains(addr) {
+			veilnet.Logger.Sugar().Infof("DNS server %s is inside the tunnel CIDR %s, skipping the bypass route", server, cidr)
+			continue
+		}
+		if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+			veilnet.Logger.Sugar().Infof("DNS server %s is not a public address, skipping the bypass route", server)
+			continue
+		}
+		c.addBypassRoute("DNS server", server)
+	}
+}
+
+// isSpecificRoute reports whether a route to prefix is more specific than the default route
+// The 0.0.0.0/1 and 128.0.0.0/1 halves other VPNs use to override the default route are not
+func isSpecificRoute(prefix netip.Prefix) bool {
+	return prefix.Bits() > 1
+}
+
+// RemoveBypassRoutes removes the bypass routes installed by this conflux, it is safe to call repeatedly
+func (c *conflux) RemoveBypassRoutes() error {
+	var errs cleanupErrors
+	c.bypassRoutes.Range(func(key, value interface{}) bool {
+		dest := key.(string)
+		err := c.delHostRoute(dest)
+		if err != nil {
+			errs.add(fmt.Sprintf("clear bypass route for %s (%s)", value, dest), err)
+			return true
+		}
+		c.bypassRoutes.Delete(dest)
+		return true
+	})
+	return errs.err()
+}
@@ -0,0 +1,25 @@
+package conflux
+
+import (
+	"context"
+	"fmt"
+)
+
+// CheckToken connects an anchor with the token far enough to be assigned a CIDR, then disconnects it, returning the
+// CIDR. Nothing is changed on the host: no TUN is created and no routes are added, so the anchor connects through
+// whatever route the host has
+func CheckToken(ctx context.Context, opts Options, apiBaseURL, anchorToken string, portal bool) (string, error) {
+	c := newConflux(opts)
+	c.anchor = newAnchor()
+	defer c.anchor.Stop()
+
+	err := c.StartAnchor(ctx, apiBaseURL, anchorToken, portal)
+	if err != nil {
+		return "", err
+	}
+	cidr, err := c.anchor.GetCIDR()
+	if err != nil {
+		return "", fmt.Errorf("the token was accepted but no CIDR was assigned: %v", err)
+	}
+	return normalizeCIDR(cidr)
+}
@@ -0,0 +1,71 @@
+package conflux
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/veil-net/veilnet"
+)
+
+// CleanupError lists the cleanup steps that failed when the conflux stopped, the host may need manual cleanup
+type CleanupError struct {
+	Steps []error
+}
+
+func (e *CleanupError) Error() string {
+	steps := make([]string, len(e.Steps))
+	for i, step := range e.Steps {
+		steps[i] = step.Error()
+	}
+	return fmt.Sprintf("host cleanup incomplete, %d steps failed: %s", len(e.Steps), strings.Join(steps, "; "))
+}
+
+// Unwrap returns the failed steps, for errors.Is and errors.As
+func (e *CleanupError) Unwrap() []error {
+	return e.Steps
+}
+
+// cleanupErrors collects the failed steps of a cleanup
+type cleanupErrors []error
+
+// add logs and records a failed cleanup step, a nil error is ignored
+func (e *cleanupErrors) add(step string, err error) {
+	if err == nil {
+		return
+	}
+	veilnet.Logger.Sugar().Warnf("failed to %s: %v", step, err)
+	*e = append(*e, fmt.Errorf("%s: %v", step, err))
+}
+
+// merge records the steps of a nested cleanup, which already logged them
+func (e *cleanupErrors) merge(err error) {
+	if cleanup, ok := err.(*CleanupError); ok {
+		*e = append(*e, cleanup.Steps...)
+	} else if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+// cleanupError returns the CleanupError if any step failed, nil otherwise
+func (e cleanupErrors) cleanupError() *CleanupError {
+	if len(e) == 0 {
+		return nil
+	}
+	return &CleanupError{Steps: e}
+}
+
+// err returns a CleanupError if any step failed
+func (e cleanupErrors) err() error {
+	if cleanup := e.cleanupError(); cleanup != nil {
+		return cleanup
+	}
+	return nil
+}
+
+// stopResult returns the CleanupError recorded by Stop, if any
+func (c *conflux) stopResult() error {
+	if cleanup := c.stopErr.Load(); cleanup != nil {
+		return cleanup
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/veil-net/veilnet"
+)
+
+// CleanupInterface removes what a conflux that did not stop cleanly left behind on one interface: the iptables and
+// firewalld rules tagged with its comment, the routes through its TUN and the TUN itself
+// The rules and routes of other interfaces are left alone, and so are the bypass routes through the host gateway,
+// which every conflux on the host shares
+func CleanupInterface(iface string) error {
+	var errs cleanupErrors
+	comment := interfaceRuleComment(iface)
+
+	// Firewalld direct rules, removed through firewalld so a reload does not bring them back
+	if firewalldRunning() {
+		out, err := runCommand("firewall-cmd", "--direct", "--get-all-rules")
+		errs.add("list firewalld direct rules", err)
+		for _, line := range strings.Split(out, "\n") {
+			if !hasRuleComment(line, comment) {
+				continue
+			}
+			_, err := runCommand("firewall-cmd", append([]string{"--direct", "--remove-rule"}, strings.Fields(line)...)...)
+			errs.add("remove firewalld direct rule "+line, err)
+			if err == nil {
+				veilnet.Logger.Sugar().Infof("Removed firewalld direct rule %s", line)
+			}
+		}
+	}
+
+	// Iptables rules, listed per table by iptables-save
+	if _, err := lookPath("iptables-save"); err == nil {
+		out, err := runCommand("iptables-save")
+		errs.add("list iptables rules", err)
+		table := ""
+		for _, line := range strings.Split(out, "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "*") {
+				table = strings.TrimPrefix(line, "*")
+				continue
+			}
+			if !strings.HasPrefix(line, "-A ") || !hasRuleComment(line, comment) {
+				continue
+			}
+			args := append([]string{"-t", table, "-D"}, ruleArgs(line)[1:]...)
+			_, err := runCommand("iptables", args...)
+			errs.add("remove iptables rule "+line, err)
+			if err == nil {
+				veilnet.Logger.Sugar().Infof("Removed iptables rule %s", line)
+			}
+		}
+	}
+
+	// Routes through the TUN, in any table
+	out, err := runCommand("ip", "-4", "route", "show", "table", "all", "proto", routeProto, "dev", iface)
+	if err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			_, err := runCommand("ip", append([]string{"route", "del"}, strings.Fields(line)...)...)
+			errs.add("remove route "+line, err)
+			if err == nil {
+				veilnet.Logger.Sugar().Infof("Removed route %s", line)
+			}
+		}
+	}
+
+	// The TUN itself, which takes any route left through it along
+	if _, err := runCommand("ip", "link", "show", iface); err == nil {
+		_, err := runCommand("ip", "link", "del", iface)
+		errs.add("remove interface "+iface, err)
+		if err == nil {
+			veilnet.Logger.Sugar().Infof("Removed interface %s", iface)
+		}
+	}
+	return errs.err()
+}
+
+// hasRuleComment reports whether a rule carries the comment, and not merely one starting with it
+func hasRuleComment(rule, comment string) bool {
+	fields := strings.Fields(rule)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "--comment" && strings.Trim(fields[i+1], `"`) == comment {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleArgs splits a rule listed by iptables-save into iptables arguments, dropping the quotes it prints around comments
+func ruleArgs(rule string) []string {
+	fields := strings.Fields(rule)
+	for i, field := range fields {
+		if unquoted, err := strconv.Unquote(field); err == nil {
+			fields[i] = unquoted
+		}
+	}
+	return fields
+}
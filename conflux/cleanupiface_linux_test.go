@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// iptablesSave is iptables-save output with the rules of two confluxes, comments quoted as iptables-save prints them
+const iptablesSave = `# Generated by iptables-save v1.8.7 on Mon Oct 12 09:14:02 2026
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD DROP [0:0]
+:OUTPUT ACCEPT [0:0]
+-A FORWARD -i veilnet -m comment --comment "veilnet:veilnet" -j ACCEPT
+-A FORWARD -i veilnet2 -m comment --comment "veilnet:veilnet2" -j ACCEPT
+-A FORWARD -o docker0 -j ACCEPT
+COMMIT
+# Completed on Mon Oct 12 09:14:02 2026
+*nat
+:POSTROUTING ACCEPT [0:0]
+-A POSTROUTING -s 10.128.0.0/16 -o eth0 -m comment --comment "veilnet:veilnet" -j MASQUERADE
+COMMIT`
+
+func TestCleanupInterfaceRemovesQuotedRules(t *testing.T) {
+	f := useFakeCommands(t)
+	prev := lookPath
+	lookPath = func(name string) (string, error) { return "/usr/sbin/" + name, nil }
+	t.Cleanup(func() { lookPath = prev })
+	f.set("firewall-cmd --state", "not running", nil)
+	f.set("iptables-save", iptablesSave, nil)
+	f.fail("ip link show veilnet", `Device "veilnet" does not exist.`)
+
+	if err := CleanupInterface("veilnet"); err != nil {
+		t.Fatalf("CleanupInterface: %v", err)
+	}
+	var removed []string
+	for _, line := range f.ran() {
+		if strings.HasPrefix(line, "iptables ") {
+			removed = append(removed, line)
+		}
+	}
+	want := []string{
+		"iptables -t filter -D FORWARD -i veilnet -m comment --comment veilnet:veilnet -j ACCEPT",
+		"iptables -t nat -D POSTROUTING -s 10.128.0.0/16 -o eth0 -m comment --comment veilnet:veilnet -j MASQUERADE",
+	}
+	if !slices.Equal(removed, want) {
+		t.Errorf("ran %q, want the rules of veilnet deleted without quotes as %q", removed, want)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package conflux
+
+import (
+	"fmt"
+)
+
+// CleanupInterface is only supported on Linux, where the rules and routes of the conflux are tagged by interface
+func CleanupInterface(iface string) error {
+	return fmt.Errorf("cleanup is only supported on Linux")
+}
@@ -2,17 +2,25 @@ package conflux
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
-	"github.com/veil-net/veilnet"
 	"github.com/alecthomas/kong"
+	"github.com/veil-net/veilnet"
 )
 
 func login(email string, password string) (string, error) {
@@ -28,7 +36,11 @@ func login(email string, password string) (string, error) {
 	}
 
 	// Create HTTP request
-	url := fmt.Sprintf("%s/auth/v1/token?grant_type=password", "https://supabase.veilnet.org")
+	base, err := normalizeURL("auth", authURL, false)
+	if err != nil {
+		return "", err
+	}
+	url := fmt.Sprintf("%s/auth/v1/token?grant_type=password", base)
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", fmt.Errorf("failed to create login request: %v", err)
@@ -70,60 +82,876 @@ func login(email string, password string) (string, error) {
 
 type CLI struct {
 	Version    kong.VersionFlag `short:"v" help:"Print the version and exit"`
+	EnvFile    []string         `name:"env-file" help:"A file of KEY=VALUE environment variables, e.g. VEILNET_TOKEN, loaded before the flags are resolved, can be repeated" type:"existingfile" env:"VEILNET_ENV_FILE"`
 	Register   Register         `cmd:"register" help:"Register a new conflux"`
 	Unregister UnRegister       `cmd:"unregister" help:"Unregister a conflux"`
+	Check      Check            `cmd:"check" help:"Check a conflux token is accepted without starting the tunnel"`
+	Cleanup    Cleanup          `cmd:"cleanup" help:"Remove the TUN, routes and firewall rules a conflux left behind on one interface"`
 	Up         Up               `cmd:"up" help:"Start the conflux"`
+	UpMulti    UpMulti          `cmd:"up-multi" help:"Start several confluxes, one per plane, from a config file, each with the up defaults"`
+	Status     Status           `cmd:"status" help:"Show the status of the running conflux"`
+	Down       Down             `cmd:"down" help:"Stop the running conflux"`
+	Reload     Reload           `cmd:"reload" help:"Refresh the bypass routes of the running conflux"`
+	Routes     Routes           `cmd:"routes" help:"List the routes the running conflux manages"`
+	Join       Join             `cmd:"join" help:"Start another plane in a running up-multi"`
+	Leave      Leave            `cmd:"leave" help:"Stop a plane of a running up-multi"`
 }
 
 type Up struct {
-	Token    string  `short:"t" help:"The conlfux token, please keep it secret" env:"VEILNET_TOKEN"`
-	Portal   bool    `short:"p" help:"Enable portal mode, default: false" default:"false" env:"VEILNET_PORTAL"`
-	Guardian string  `short:"g" help:"The Guardian URL (Authentication Server), default: https://guardian.veilnet.org" default:"https://guardian.veilnet.org" env:"VEILNET_GUARDIAN_URL"`
-	conflux  Conflux `kong:"-"`
+	Token              string        `short:"t" help:"The conlfux token, please keep it secret" env:"VEILNET_TOKEN"`
+	Portal             bool          `short:"p" help:"Enable portal mode, default: false" default:"false" env:"VEILNET_PORTAL"`
+	Guardian           string        `short:"g" help:"The Guardian URL (Authentication Server), default: https://guardian.veilnet.org" default:"https://guardian.veilnet.org" env:"VEILNET_GUARDIAN_URL"`
+	Insecure           bool          `help:"Allow a Guardian URL over plain http, for testing only, default: false" default:"false" env:"VEILNET_INSECURE"`
+	Iface              string        `help:"The name of the TUN interface, default: veilnet" default:"veilnet" env:"VEILNET_IFACE"`
+	AutoIface          bool          `name:"auto-iface" help:"Use the first free name of veilnet1, veilnet2, ... if the interface name is taken, and print it (Linux and Windows only), default: false" default:"false" env:"VEILNET_AUTO_IFACE"`
+	Fallback           bool          `help:"Keep the host default route as a lower priority fallback, default: true" default:"true" negatable:"" env:"VEILNET_FALLBACK"`
+	UpScript           string        `help:"A command to run once the tunnel is up" env:"VEILNET_UP_SCRIPT"`
+	DownScript         string        `help:"A command to run before the tunnel is torn down" env:"VEILNET_DOWN_SCRIPT"`
+	DNS                []string      `name:"dns" help:"The DNS servers to use through the tunnel, comma-separated in order of preference, default: 1.1.1.1" default:"1.1.1.1" env:"VEILNET_DNS"`
+	DNSSearch          []string      `name:"dns-search" help:"A DNS search domain to configure, can be repeated" env:"VEILNET_DNS_SEARCH"`
+	DNSBypass          bool          `name:"dns-bypass" help:"Route the public DNS servers outside the tunnel CIDR via the host gateway instead of the tunnel, default: false" default:"false" env:"VEILNET_DNS_BYPASS"`
+	ExtraAddress       []string      `help:"An extra IP/prefix to assign to the TUN interface, can be repeated" env:"VEILNET_EXTRA_ADDRESS"`
+	Peer               string        `help:"The point-to-point peer address of the TUN interface, used as the gateway of the VeilNet default route (Linux and macOS only)" env:"VEILNET_PEER"`
+	RequireNAT         bool          `name:"require-nat" help:"Fail to start in portal mode if NAT cannot be set up, default: false" default:"false" env:"VEILNET_REQUIRE_NAT"`
+	FirewallBackend    string        `name:"firewall-backend" help:"How the portal FORWARD and NAT rules are added: auto, iptables or firewalld (Linux only), auto uses firewalld if it is running, default: auto" default:"auto" enum:"auto,iptables,firewalld" env:"VEILNET_FIREWALL_BACKEND"`
+	TuneForwarding     bool          `name:"tune-forwarding" help:"Set loose reverse path filtering and turn off ICMP redirects while in portal mode (Linux only), default: true" default:"true" negatable:"" env:"VEILNET_TUNE_FORWARDING"`
+	DNSMode            string        `name:"dns-mode" help:"The transport for the tunnel resolver: udp, dot (DNS over TLS) or doh (DNS over HTTPS), default: udp" default:"udp" enum:"udp,dot,doh" env:"VEILNET_DNS_MODE"`
+	DNSMethod          string        `name:"dns-method" help:"How DNS is applied: auto, none, resolvconf, systemd-resolved or direct-file (Linux, none also on macOS), default: auto" default:"auto" enum:"auto,none,resolvconf,systemd-resolved,direct-file" env:"VEILNET_DNS_METHOD"`
+	WaitForNetwork     time.Duration `name:"wait-for-network" help:"How long to wait at startup for the host to get a default route, e.g. early in boot, 0 only retries for a few seconds, default: 0" default:"0" env:"VEILNET_WAIT_FOR_NETWORK"`
+	AnchorTimeout      time.Duration `name:"anchor-timeout" help:"How long to wait for the anchor to connect at startup, 0 waits forever, default: 30s" default:"30s" env:"VEILNET_ANCHOR_TIMEOUT"`
+	DSCP               string        `name:"dscp" help:"Mark the packets a portal forwards from the tunnel with this DSCP (Linux only): 0-63 or a class such as EF, AF41 or CS1" env:"VEILNET_DSCP"`
+	InterfaceUpTimeout time.Duration `name:"interface-up-timeout" help:"How long to wait for the TUN interface to come up before adding routes, default: 10s" default:"10s" env:"VEILNET_INTERFACE_UP_TIMEOUT"`
+	DisableIPv6        bool          `name:"disable-ipv6" help:"Disable IPv6 autoconfiguration on the IPv4-only TUN interface (Linux only), default: true" default:"true" negatable:"" env:"VEILNET_DISABLE_IPV6"`
+	Strict             bool          `help:"Fail to start when the assigned CIDR overlaps the host network or a bypass host, default: false" default:"false" env:"VEILNET_STRICT"`
+	RateLimit          string        `name:"rate-limit" help:"Cap the portal bandwidth in each direction, e.g. 50mbit or 1gbit, a bare number is in mbit/s (Linux portal mode only)" env:"VEILNET_RATE_LIMIT"`
+	Offload            string        `help:"TUN checksum and segmentation offloads: auto, on or off (Linux only), default: auto" default:"auto" enum:"auto,on,off" env:"VEILNET_OFFLOAD"`
+	GatewayIface       string        `name:"gateway-iface" help:"The host interface whose default route VeilNet is reached through, e.g. en0, a physical interface is preferred over other VPNs if not set (macOS only)" env:"VEILNET_GATEWAY_IFACE"`
+	KeepInterface      bool          `name:"keep-interface" help:"Leave the TUN interface in place, down, when the conflux stops, for debugging (Linux only), default: false" default:"false" env:"VEILNET_KEEP_INTERFACE"`
+	Drain              time.Duration `help:"How long to let established portal flows finish on shutdown before removing NAT, e.g. 30s (Linux portal mode only), default: 0" default:"0s" env:"VEILNET_DRAIN"`
+	Userspace          bool          `help:"Run on a userspace network stack behind a SOCKS5 proxy instead of a TUN, no privileges needed, default: false" default:"false" env:"VEILNET_USERSPACE"`
+	SOCKS              string        `name:"socks" help:"The address of the SOCKS5 proxy in userspace mode, default: 127.0.0.1:1080" default:"127.0.0.1:1080" env:"VEILNET_SOCKS"`
+	ExitOnAnchorLoss   bool          `name:"exit-on-anchor-loss" help:"Exit at once with status 1 when the anchor goes down, otherwise shut down through the normal path, default: true" default:"true" negatable:"" env:"VEILNET_EXIT_ON_ANCHOR_LOSS"`
+	CleanupOnExit      bool          `name:"cleanup-on-exit" help:"Clean up the host when the conflux exits because the anchor went down, default: true" default:"true" negatable:"" env:"VEILNET_CLEANUP_ON_EXIT"`
+	EgressStallTimeout time.Duration `name:"egress-stall-timeout" help:"Restart the conflux if no packet is read from the TUN for this long while the anchor is alive and packets are still written to it, an idle host does not trip it, 0 disables it, default: 0" default:"0s" env:"VEILNET_EGRESS_STALL_TIMEOUT"`
+	Priority           string        `help:"The priority of the VeilNet default route relative to other VPNs: high, low or metric:N, default: high" default:"high" env:"VEILNET_PRIORITY"`
+	RouteTable         int           `name:"route-table" help:"The routing table used for policy routing (Linux only), default: 8686" default:"8686" env:"VEILNET_ROUTE_TABLE"`
+	TUNFd              int           `name:"tun-fd" help:"Use an inherited TUN file descriptor instead of creating the TUN (Linux and macOS only)" env:"VEILNET_TUN_FD"`
+	TUNGUID            string        `name:"tun-guid" help:"The GUID of the wintun adapter, derived from the interface name if not set (Windows only)" env:"VEILNET_TUN_GUID"`
+	SystemWintun       bool          `name:"system-wintun" help:"Use the wintun.dll installed next to the executable or in System32 instead of extracting the embedded copy (Windows only), default: false" default:"false" env:"VEILNET_SYSTEM_WINTUN"`
+	InterfaceDesc      string        `name:"interface-description" help:"The description of the wintun adapter, for group policy and monitoring tools to match on (Windows only), default: veilnet" default:"veilnet" env:"VEILNET_INTERFACE_DESCRIPTION"`
+	TUNOffset          int           `name:"tun-offset" help:"The headroom in bytes left in front of each packet for the TUN device, 0 derives it from the device, default: 0" default:"0" env:"VEILNET_TUN_OFFSET"`
+	CPUAffinity        []int         `name:"cpu-affinity" help:"The CPUs to pin the ingress and egress loops to, e.g. 2,3 (Linux only)" env:"VEILNET_CPU_AFFINITY"`
+	Metrics            string        `help:"The address to serve Prometheus metrics on, e.g. :9090, disabled if empty" env:"VEILNET_METRICS"`
+	MaxPacketRate      int           `name:"max-packet-rate" help:"Cap the packets per second each of the ingress and egress loops processes, 0 does not limit, default: 0" default:"0" env:"VEILNET_MAX_PACKET_RATE"`
+	QueueDepth         int           `name:"queue-depth" help:"How many batches may wait between the reads and the writes of each packet loop, dropped when full, 0 does not queue, default: 0" default:"0" env:"VEILNET_QUEUE_DEPTH"`
+	StatsInterval      time.Duration `name:"stats-interval" help:"Log a traffic summary at this interval, e.g. 1m, disabled if 0, default: 0" default:"0s" env:"VEILNET_STATS_INTERVAL"`
+	Verbose            bool          `short:"V" help:"Log every host command run, with its exit status and output, default: false" default:"false" env:"VEILNET_VERBOSE"`
+	LogSampling        time.Duration `name:"log-sampling" help:"Coalesce an error the packet loops repeat into one line per interval, 0 logs every occurrence, default: 10s" default:"10s" env:"VEILNET_LOG_SAMPLING"`
+	ReadonlyRoutes     bool          `name:"readonly-routes" help:"Log the routing table, and the iptables rules in portal mode, before the host is configured and after it is cleaned, for bug reports, default: false" default:"false" env:"VEILNET_READONLY_ROUTES"`
+	VerifyCleanup      bool          `name:"verify-cleanup" help:"Check the routing table and firewall after the cleanup and log the routes and rules left behind, default: false" default:"false" env:"VEILNET_VERIFY_CLEANUP"`
+	StrictCleanup      bool          `name:"strict-cleanup" help:"Verify the cleanup and exit with an error if any route or rule was left behind, default: false" default:"false" env:"VEILNET_STRICT_CLEANUP"`
+	PrintConfig        bool          `name:"print-effective-config" help:"Print the configuration resolved from the flags, environment and defaults as JSON, with the token redacted, and exit"`
+	ProbeGuardian      bool          `name:"probe-guardian" help:"Check the Guardian is reachable before touching the host, naming the step that fails: DNS, TCP, TLS or HTTP, default: false" default:"false" env:"VEILNET_PROBE_GUARDIAN"`
+	StopOnStdinEOF     bool          `name:"stop-on-stdin-eof" help:"Shut down when stdin is closed, for hosts where signals are not delivered, default: false" default:"false" env:"VEILNET_STOP_ON_STDIN_EOF"`
+	ShutdownFile       string        `name:"shutdown-file" help:"Shut down when this file is created, it is removed at startup and once seen" env:"VEILNET_SHUTDOWN_FILE"`
+	Detach             bool          `help:"Run the conflux in the background once it is up and return to the shell (Linux and macOS only), default: false" default:"false" env:"VEILNET_DETACH"`
+	WriteIPFile        string        `name:"write-ip-file" help:"Write the tunnel IP and CIDR to this file once the tunnel is up, removed on exit" env:"VEILNET_WRITE_IP_FILE"`
+	PIDFile            string        `name:"pid-file" help:"Write the PID of the conflux to this file, removed on exit, default: /run/veilnet-<iface>.pid with --detach" env:"VEILNET_PID_FILE"`
+	LogOutput          string        `name:"log-output" help:"Where the logs go: stderr, syslog, journald (Linux only) or file, default: stderr" default:"stderr" enum:"stderr,syslog,journald,file" env:"VEILNET_LOG_OUTPUT"`
+	LogFile            string        `name:"log-file" help:"The file the logs are appended to with --log-output file or --detach, default: /var/log/veilnet-<iface>.log" env:"VEILNET_LOG_FILE"`
+	conflux            Conflux       `kong:"-"`
+	mu                 sync.Mutex    `kong:"-"`
 }
 
-func (cmd *Up) Run() error {
+func (cmd *Up) Run(kctx *kong.Context) error {
+
+	if cmd.PrintConfig {
+		return printEffectiveConfig(kctx)
+	}
+
+	// Send the logs to the chosen output, a conflux about to detach keeps reporting to the shell
+	if !cmd.Detach || os.Getenv(detachedEnv) != "" {
+		logFile := cmd.LogFile
+		if logFile == "" {
+			logFile = defaultLogFile(cmd.Iface)
+		}
+		if err := SetLogOutput(cmd.LogOutput, logFile); err != nil {
+			return err
+		}
+	}
 
-	if cmd.Guardian == "" {
-		return fmt.Errorf("guardian url is not set")
+	guardian, err := normalizeURL("guardian", cmd.Guardian, cmd.Insecure)
+	if err != nil {
+		return err
 	}
+	cmd.Guardian = guardian
 
 	if cmd.Token == "" {
 		return fmt.Errorf("conflux token is not set")
 	}
 
-	cmd.conflux = NewConflux()
+	_, err = parseExtraAddresses("", cmd.ExtraAddress)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Peer != "" {
+		if ip := net.ParseIP(cmd.Peer); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid peer address %s, must be an IPv4 address", cmd.Peer)
+		}
+		if runtime.GOOS == "windows" {
+			veilnet.Logger.Sugar().Warnf("A point-to-point peer is not supported on Windows, ignoring")
+		}
+		if cmd.Userspace {
+			veilnet.Logger.Sugar().Warnf("A point-to-point peer is not used in userspace mode, ignoring")
+		}
+	}
+
+	err = checkDNSMode(cmd.DNSMode)
+	if err != nil {
+		return err
+	}
+
+	err = checkDNSMethod(cmd.DNSMethod, cmd.DNSMode)
+	if err != nil {
+		return err
+	}
+	switch {
+	case runtime.GOOS == "windows" && cmd.DNSMethod != DNSMethodAuto:
+		veilnet.Logger.Sugar().Warnf("DNS methods are not supported on Windows, ignoring")
+	case runtime.GOOS == "darwin" && cmd.DNSMethod != DNSMethodAuto && cmd.DNSMethod != DNSMethodNone:
+		veilnet.Logger.Sugar().Warnf("Only the none DNS method is supported on macOS, ignoring")
+	}
 
-	err := cmd.conflux.Start(cmd.Guardian, cmd.Token, cmd.Portal)
+	err = checkDNSServers(cmd.DNS, cmd.DNSMode)
 	if err != nil {
 		return err
 	}
 
-	// Set up signal handling for graceful shutdown
+	if cmd.Userspace && cmd.Portal {
+		return fmt.Errorf("portal is not supported in userspace mode")
+	}
+
+	_, err = parsePriority(cmd.Priority)
+	if err != nil {
+		return err
+	}
+	if cmd.Priority != PriorityHigh && cmd.Portal {
+		veilnet.Logger.Sugar().Warnf("Portal mode does not set a default route, ignoring --priority")
+	}
+
+	err = checkRouteTableNumber(cmd.RouteTable)
+	if err != nil {
+		return err
+	}
+
+	if cmd.TUNFd != 0 && cmd.TUNFd < 3 {
+		return fmt.Errorf("invalid TUN file descriptor %d, 0 to 2 are the standard streams", cmd.TUNFd)
+	}
+	if cmd.TUNFd != 0 && runtime.GOOS == "windows" {
+		return fmt.Errorf("an inherited TUN file descriptor is not supported on Windows")
+	}
+
+	if cmd.TUNGUID != "" {
+		cmd.TUNGUID, err = checkTUNGUID(cmd.TUNGUID)
+		if err != nil {
+			return err
+		}
+		if runtime.GOOS != "windows" {
+			veilnet.Logger.Sugar().Warnf("The TUN GUID is only used on Windows, ignoring")
+		}
+	}
+	err = checkInterfaceDescription(cmd.InterfaceDesc)
+	if err != nil {
+		return err
+	}
+	if cmd.SystemWintun && runtime.GOOS != "windows" {
+		veilnet.Logger.Sugar().Warnf("Using an installed wintun.dll is only supported on Windows, ignoring")
+	}
+	if cmd.InterfaceDesc != defaultInterfaceDescription && runtime.GOOS != "windows" {
+		veilnet.Logger.Sugar().Warnf("The interface description is only used on Windows, ignoring")
+	}
+
+	if cmd.TUNOffset < 0 || cmd.TUNOffset > 64 {
+		return fmt.Errorf("invalid TUN offset %d, must be between 0 and 64", cmd.TUNOffset)
+	}
+
+	for _, cpu := range cmd.CPUAffinity {
+		if cpu < 0 || cpu >= runtime.NumCPU() {
+			return fmt.Errorf("invalid CPU %d, the host has %d CPUs", cpu, runtime.NumCPU())
+		}
+	}
+	if len(cmd.CPUAffinity) > 0 && runtime.GOOS != "linux" {
+		veilnet.Logger.Sugar().Warnf("CPU affinity is only supported on Linux, ignoring")
+	}
+	_, err = parseDSCP(cmd.DSCP)
+	if err != nil {
+		return err
+	}
+	if cmd.DSCP != "" && (runtime.GOOS != "linux" || !cmd.Portal) {
+		veilnet.Logger.Sugar().Warnf("DSCP marking is only supported in portal mode on Linux, ignoring")
+	}
+	if cmd.MaxPacketRate < 0 {
+		return fmt.Errorf("invalid max packet rate %d, it must not be negative", cmd.MaxPacketRate)
+	}
+	if cmd.WaitForNetwork < 0 {
+		return fmt.Errorf("invalid wait for network %s, it must not be negative", cmd.WaitForNetwork)
+	}
+	if cmd.QueueDepth < 0 {
+		return fmt.Errorf("invalid queue depth %d, it must not be negative", cmd.QueueDepth)
+	}
+	_, err = parseRate(cmd.RateLimit)
+	if err != nil {
+		return err
+	}
+	if cmd.RateLimit != "" && (runtime.GOOS != "linux" || !cmd.Portal) {
+		veilnet.Logger.Sugar().Warnf("Rate limiting is only supported in portal mode on Linux, ignoring")
+	}
+	if cmd.FirewallBackend != FirewallBackendAuto && runtime.GOOS != "linux" {
+		veilnet.Logger.Sugar().Warnf("Choosing the firewall backend is only supported on Linux, ignoring")
+	}
+	if cmd.Offload != OffloadAuto && runtime.GOOS != "linux" {
+		veilnet.Logger.Sugar().Warnf("TUN offload settings are only supported on Linux, ignoring")
+	}
+	if cmd.Drain > 0 && (runtime.GOOS != "linux" || !cmd.Portal) {
+		veilnet.Logger.Sugar().Warnf("Draining is only supported in portal mode on Linux, ignoring")
+	}
+	if cmd.GatewayIface != "" && runtime.GOOS != "darwin" {
+		veilnet.Logger.Sugar().Warnf("Choosing the gateway interface is only supported on macOS, ignoring")
+	}
+	if cmd.KeepInterface && runtime.GOOS != "linux" {
+		veilnet.Logger.Sugar().Warnf("Keeping the TUN interface is only supported on Linux, ignoring")
+	}
+
+	if cmd.Detach && runtime.GOOS == "windows" {
+		return fmt.Errorf("--detach is not supported on Windows, run the conflux as a service instead")
+	}
+	if cmd.AutoIface && runtime.GOOS == "darwin" {
+		veilnet.Logger.Sugar().Warnf("macOS names the utun interfaces itself, ignoring --auto-iface")
+	}
+	if cmd.Detach && cmd.AutoIface {
+		return fmt.Errorf("--auto-iface cannot be used with --detach, the shell would wait for the background conflux on the wrong name")
+	}
+	if cmd.Detach && cmd.StopOnStdinEOF {
+		return fmt.Errorf("--stop-on-stdin-eof cannot be used with --detach, the background conflux has no stdin")
+	}
+	if cmd.Detach && cmd.PIDFile == "" {
+		cmd.PIDFile = defaultPIDFile(cmd.Iface)
+	}
+	if cmd.LogFile == "" {
+		cmd.LogFile = defaultLogFile(cmd.Iface)
+	} else if !cmd.Detach && cmd.LogOutput != LogOutputFile {
+		veilnet.Logger.Sugar().Warnf("The log file is only used with --log-output file or --detach, ignoring")
+	}
+
+	// Check the Guardian is reachable before anything is changed on the host
+	if cmd.ProbeGuardian && os.Getenv(detachedEnv) == "" {
+		if err := probeGuardian(cmd.Guardian, cmd.AnchorTimeout); err != nil {
+			return err
+		}
+	}
+
+	// Start the conflux again in the background and return once it is up
+	if cmd.Detach && os.Getenv(detachedEnv) == "" {
+		return detach(cmd.Iface, cmd.LogFile)
+	}
+
+	// Record the PID for service scripts, removed once the conflux has stopped
+	if cmd.PIDFile != "" {
+		if err := writePIDFile(cmd.PIDFile); err != nil {
+			return err
+		}
+		defer removePIDFile(cmd.PIDFile)
+	}
+
+	SetVerbose(cmd.Verbose)
+	SetLogSampling(cmd.LogSampling)
+
+	if cmd.Metrics != "" {
+		ServeMetrics(cmd.Metrics)
+	}
+
+	opts := Options{
+		Interface:          cmd.Iface,
+		AutoIface:          cmd.AutoIface,
+		Fallback:           cmd.Fallback,
+		UpScript:           cmd.UpScript,
+		DownScript:         cmd.DownScript,
+		DNS:                cmd.DNS,
+		DNSSearch:          cmd.DNSSearch,
+		DNSBypass:          cmd.DNSBypass,
+		ExtraAddresses:     cmd.ExtraAddress,
+		Peer:               cmd.Peer,
+		RequireNAT:         cmd.RequireNAT,
+		TuneForwarding:     cmd.TuneForwarding,
+		DisableIPv6:        cmd.DisableIPv6,
+		Strict:             cmd.Strict,
+		RateLimit:          cmd.RateLimit,
+		Offload:            cmd.Offload,
+		FirewallBackend:    cmd.FirewallBackend,
+		KeepInterface:      cmd.KeepInterface,
+		GatewayIface:       cmd.GatewayIface,
+		Drain:              cmd.Drain,
+		DNSMode:            cmd.DNSMode,
+		DNSMethod:          cmd.DNSMethod,
+		AnchorTimeout:      cmd.AnchorTimeout,
+		WaitForNetwork:     cmd.WaitForNetwork,
+		DSCP:               cmd.DSCP,
+		InterfaceUpTimeout: cmd.InterfaceUpTimeout,
+		Userspace:          cmd.Userspace,
+		SOCKSAddress:       cmd.SOCKS,
+		ExitOnAnchorLoss:   cmd.ExitOnAnchorLoss,
+		NoCleanupOnExit:    !cmd.CleanupOnExit,
+		EgressStallTimeout: cmd.EgressStallTimeout,
+		Priority:           cmd.Priority,
+		RouteTable:         cmd.RouteTable,
+		IPFile:             cmd.WriteIPFile,
+		TUNFd:              cmd.TUNFd,
+		TUNGUID:            cmd.TUNGUID,
+		TUNDescription:     cmd.InterfaceDesc,
+		SystemWintun:       cmd.SystemWintun,
+		TUNOffset:          cmd.TUNOffset,
+		CPUAffinity:        cmd.CPUAffinity,
+		MaxPacketRate:      cmd.MaxPacketRate,
+		QueueDepth:         cmd.QueueDepth,
+		AuditRoutes:        cmd.ReadonlyRoutes,
+		VerifyCleanup:      cmd.VerifyCleanup,
+		StrictCleanup:      cmd.StrictCleanup,
+		StatsInterval:      cmd.StatsInterval,
+	}
+	cmd.conflux = NewConflux(opts)
+
+	// Set up signal handling for graceful shutdown, armed before Start so a hanging startup can be interrupted
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
 
-	// Give the rift time to clean up
-	veilnet.Logger.Sugar().Info("Received shutdown signal, shutting down...")
+	// Also shut down on stdin EOF or the shutdown file, if asked to, the same way as on SIGTERM
+	watchShutdown(sigChan, cmd.StopOnStdinEOF, cmd.ShutdownFile)
+
+	// Start the conflux
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- cmd.conflux.Start(ctx, cmd.Guardian, cmd.Token, cmd.Portal)
+	}()
+	failed := false
+	var stopReply chan error
+	var forced <-chan struct{}
+
+	select {
+	case err := <-startErr:
+		if err != nil {
+			return err
+		}
+
+		// Report the interface name picked by --auto-iface on stdout for scripts
+		iface := cmd.conflux.Status().Interface
+		if cmd.AutoIface {
+			fmt.Printf("VEILNET_IFACE=%s\n", iface)
+		}
+
+		// Serve the control interface
+		stopChan := make(chan chan error, 1)
+		closeControl, err := ServeControl(iface, controlHandler(cmd.running, stopChan))
+		if err != nil {
+			veilnet.Logger.Sugar().Warnf("Control interface unavailable: %v", err)
+		} else {
+			defer closeControl()
+		}
+
+		// Wait for a shutdown signal, a stop command or the anchor going down, restarting the conflux if egress stalls
+		for {
+			select {
+			case sig := <-sigChan:
+				logShutdownSignal(sig, "shutting down...")
+			case stopReply = <-stopChan:
+				veilnet.Logger.Sugar().Info("Received stop command, shutting down...")
+			case <-cmd.conflux.Done():
+				if !cmd.CleanupOnExit {
+					return fmt.Errorf("conflux failed, the cause is logged above, the host configuration is left in place")
+				}
+				veilnet.Logger.Sugar().Info("Conflux failed, shutting down...")
+				failed = true
+			case <-cmd.conflux.Stalled():
+				// Keep the interface, and with it the control socket, --auto-iface could pick another name
+				opts.Interface = iface
+				opts.AutoIface = false
+				if err := cmd.restart(ctx, opts); err != nil {
+					return err
+				}
+				continue
+			}
+			break
+		}
+	case sig := <-sigChan:
+		// Abort the startup, Start rolls back whatever it has already applied
+		logShutdownSignal(sig, "aborting the startup...")
+		cancel()
+		forced = interrupted(sigChan)
+		select {
+		case err := <-startErr:
+			if err != nil {
+				veilnet.Logger.Sugar().Infof("Startup aborted: %v", err)
+				return nil
+			}
+		case <-forced:
+			veilnet.Logger.Sugar().Warn("Received a second interrupt, exiting without waiting for the rollback")
+			return fmt.Errorf("startup abort interrupted, the host may need manual cleanup")
+		}
+		veilnet.Logger.Sugar().Info("Startup completed before it could be aborted, shutting down...")
+	}
 
 	// Create a channel to signal when cleanup is done
-	shutdownComplete := make(chan bool, 1)
+	shutdownComplete := make(chan error, 1)
 
 	// Stop the conflux
 	go func() {
-		cmd.conflux.Stop()
+		shutdownComplete <- cmd.conflux.Stop()
+	}()
+
+	// Wait for cleanup with timeout, a second interrupt exits without waiting
+	if forced == nil {
+		forced = interrupted(sigChan)
+	}
+	var stopErr error
+	select {
+	case stopErr = <-shutdownComplete:
+		if stopErr != nil {
+			veilnet.Logger.Sugar().Errorf("Shutdown completed with errors, the host may need manual cleanup")
+		} else {
+			veilnet.Logger.Sugar().Info("Shutdown completed successfully")
+		}
+	case <-time.After(10 * time.Second):
+		veilnet.Logger.Sugar().Warn("Shutdown timeout, forcing exit")
+		stopErr = fmt.Errorf("shutdown timed out, the host may need manual cleanup")
+	case <-forced:
+		veilnet.Logger.Sugar().Warn("Received a second interrupt, exiting without waiting for the cleanup")
+		stopErr = fmt.Errorf("shutdown interrupted, the host may need manual cleanup")
+	}
+
+	// Report the cleanup result to the down command that asked for the stop
+	if stopReply != nil {
+		stopReply <- stopErr
+	}
+
+	if stopErr != nil {
+		return stopErr
+	}
+	if failed {
+		return fmt.Errorf("conflux failed, the cause is logged above")
+	}
+	return nil
+}
+
+// restart replaces a conflux whose egress stalled with a new one, recreating the TUN and reconnecting the anchor
+func (cmd *Up) restart(ctx context.Context, opts Options) error {
+	veilnet.Logger.Sugar().Warn("Restarting the conflux to recover from the egress stall")
+	if err := cmd.conflux.Stop(); err != nil {
+		veilnet.Logger.Sugar().Warnf("Stopping the stalled conflux left part of the host configuration behind: %v", err)
+	}
+	c := NewConflux(opts)
+	if err := c.Start(ctx, cmd.Guardian, cmd.Token, cmd.Portal); err != nil {
+		return fmt.Errorf("failed to restart the conflux after the egress stall: %v", err)
+	}
+	cmd.mu.Lock()
+	cmd.conflux = c
+	cmd.mu.Unlock()
+	veilnet.Logger.Sugar().Info("Conflux restarted after the egress stall")
+	return nil
+}
+
+// running returns the conflux currently started, which a restart after an egress stall replaces
+func (cmd *Up) running() Conflux {
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	return cmd.conflux
+}
+
+// logShutdownSignal logs the signal that started a shutdown, an interrupt from a terminal can be repeated to skip the wait
+func logShutdownSignal(sig os.Signal, action string) {
+	if sig == syscall.SIGINT {
+		veilnet.Logger.Sugar().Infof("Received interrupt, %s press Ctrl+C again to exit without waiting", action)
+		return
+	}
+	veilnet.Logger.Sugar().Infof("Received %v, %s", sig, action)
+}
+
+// interrupted returns a channel closed on the next SIGINT from sigChan, other signals are ignored
+func interrupted(sigChan <-chan os.Signal) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for sig := range sigChan {
+			if sig == syscall.SIGINT {
+				close(done)
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// printEffectiveConfig prints the flags of the selected command as resolved by kong, secrets redacted
+func printEffectiveConfig(kctx *kong.Context) error {
+	config := make(map[string]any)
+	for _, flag := range kctx.Flags() {
+		if flag.Hidden || flag.Name == "help" || flag.Name == "print-effective-config" {
+			continue
+		}
+		value := flag.Target.Interface()
+		switch v := value.(type) {
+		case kong.VersionFlag:
+			continue
+		case time.Duration:
+			value = v.String()
+		case string:
+			if v != "" && (flag.Name == "token" || flag.Name == "password") {
+				value = "REDACTED"
+			}
+		}
+		config[flag.Name] = value
+	}
+	out, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal configuration: %v", err)
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// controlHandler returns the handler for control requests sent to the conflux current returns
+// A stop request hands a reply channel to the caller, which sends the cleanup result on it once stopped
+func controlHandler(current func() Conflux, stopChan chan<- chan error) ControlHandler {
+	return func(req ControlRequest) ControlResponse {
+		c := current()
+		switch req.Command {
+		case ControlStatus:
+			status := c.Status()
+			return ControlResponse{OK: true, Status: &status}
+		case ControlStop:
+			reply := make(chan error, 1)
+			select {
+			case stopChan <- reply:
+			default:
+				return ControlResponse{Error: "the conflux is already stopping"}
+			}
+			if err := <-reply; err != nil {
+				return ControlResponse{Error: err.Error()}
+			}
+			return ControlResponse{OK: true}
+		case ControlReload:
+			c.AddBypassRoutes()
+			return ControlResponse{OK: true}
+		case ControlRoutes:
+			return ControlResponse{OK: true, Routes: c.Routes()}
+		case ControlJoin, ControlLeave:
+			return ControlResponse{Error: "planes can only join and leave a conflux started with up-multi"}
+		default:
+			return ControlResponse{Error: fmt.Sprintf("unknown command %q", req.Command)}
+		}
+	}
+}
+
+// MultiInstance is a conflux started by up-multi
+type MultiInstance struct {
+	Iface    string `json:"iface"`
+	Token    string `json:"token"`
+	Portal   bool   `json:"portal"`
+	Guardian string `json:"guardian,omitempty"`
+	TUNGUID  string `json:"tun_guid,omitempty"`
+}
+
+type UpMulti struct {
+	Config         string        `short:"c" help:"A JSON file listing the confluxes to start, each with iface, token, portal and optionally guardian and tun_guid" required:"" env:"VEILNET_MULTI_CONFIG"`
+	Guardian       string        `short:"g" help:"The Guardian URL used by instances that do not set one, default: https://guardian.veilnet.org" default:"https://guardian.veilnet.org" env:"VEILNET_GUARDIAN_URL"`
+	Insecure       bool          `help:"Allow Guardian URLs over plain http, for testing only, default: false" default:"false" env:"VEILNET_INSECURE"`
+	Metrics        string        `help:"The address to serve Prometheus metrics on, e.g. :9090, disabled if empty" env:"VEILNET_METRICS"`
+	Verbose        bool          `short:"V" help:"Log every host command run, with its exit status and output, default: false" default:"false" env:"VEILNET_VERBOSE"`
+	LogSampling    time.Duration `name:"log-sampling" help:"Coalesce an error the packet loops repeat into one line per interval, 0 logs every occurrence, default: 10s" default:"10s" env:"VEILNET_LOG_SAMPLING"`
+	SystemWintun   bool          `name:"system-wintun" help:"Use the wintun.dll installed next to the executable or in System32 instead of extracting the embedded copy (Windows only), default: false" default:"false" env:"VEILNET_SYSTEM_WINTUN"`
+	WaitForNetwork time.Duration `name:"wait-for-network" help:"How long to wait at startup for the host to get a default route, e.g. early in boot, 0 only retries for a few seconds, default: 0" default:"0" env:"VEILNET_WAIT_FOR_NETWORK"`
+}
+
+func (cmd *UpMulti) Run() error {
+
+	instances, err := cmd.load()
+	if err != nil {
+		return err
+	}
+
+	SetVerbose(cmd.Verbose)
+	SetLogSampling(cmd.LogSampling)
+
+	if cmd.Metrics != "" {
+		ServeMetrics(cmd.Metrics)
+	}
+
+	// Set up signal handling for graceful shutdown, armed before Start so a hanging startup can be interrupted
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-sigChan:
+			veilnet.Logger.Sugar().Info("Received shutdown signal, shutting down...")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Start the confluxes one at a time, stopping the started ones if any fails
+	stopChan := make(chan chan error, 1)
+	planes := newPlanes(cmd, ctx, stopChan)
+	err = planes.startAll(instances)
+	if err != nil {
+		planes.stop()
+		if ctx.Err() != nil {
+			veilnet.Logger.Sugar().Infof("Startup aborted: %v", err)
+			return nil
+		}
+		return err
+	}
+
+	// Wait for a shutdown signal or a stop command to any instance
+	var stopReply chan error
+	select {
+	case <-ctx.Done():
+	case stopReply = <-stopChan:
+		veilnet.Logger.Sugar().Info("Received stop command, shutting down...")
+	}
+
+	err = planes.stop()
+	if stopReply != nil {
+		stopReply <- err
+	}
+	return err
+}
+
+// load reads and validates the instances of the config file
+func (cmd *UpMulti) load() ([]MultiInstance, error) {
+	data, err := os.ReadFile(cmd.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %v", cmd.Config, err)
+	}
+
+	var instances []MultiInstance
+	err = json.Unmarshal(data, &instances)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", cmd.Config, err)
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("config %s lists no confluxes", cmd.Config)
+	}
+
+	for i := range instances {
+		if instances[i].Iface == "" || instances[i].Token == "" {
+			return nil, fmt.Errorf("conflux %d in %s needs an iface and a token", i+1, cmd.Config)
+		}
+		err = cmd.checkInstance(&instances[i], instances[:i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return instances, nil
+}
+
+// checkInstance validates an instance against the instances running next to it, filling in the Guardian URL
+func (cmd *UpMulti) checkInstance(instance *MultiInstance, others []MultiInstance) error {
+	if instance.Iface == "" || instance.Token == "" {
+		return fmt.Errorf("a conflux needs an iface and a token")
+	}
+	var err error
+	if instance.TUNGUID != "" {
+		instance.TUNGUID, err = checkTUNGUID(instance.TUNGUID)
+		if err != nil {
+			return fmt.Errorf("conflux %s: %v", instance.Iface, err)
+		}
+	}
+	guid := instanceGUID(*instance)
+	for _, other := range others {
+		if other.Iface == instance.Iface {
+			return fmt.Errorf("interface %s is used by more than one conflux", instance.Iface)
+		}
+		if instanceGUID(other) == guid {
+			return fmt.Errorf("TUN GUID %s is used by more than one conflux", guid)
+		}
+
+		// Every rift takes over the default route, so only one can run at a time
+		if !instance.Portal && !other.Portal {
+			return fmt.Errorf("only one conflux can run without portal mode, %s already does", other.Iface)
+		}
+	}
+	if instance.Guardian == "" {
+		instance.Guardian = cmd.Guardian
+	}
+	instance.Guardian, err = normalizeURL("guardian", instance.Guardian, cmd.Insecure)
+	if err != nil {
+		return fmt.Errorf("conflux %s: %v", instance.Iface, err)
+	}
+	return nil
+}
+
+// instanceGUID returns the wintun adapter GUID an instance uses
+func instanceGUID(instance MultiInstance) string {
+	if instance.TUNGUID != "" {
+		return instance.TUNGUID
+	}
+	return deriveTUNGUID(instance.Iface)
+}
+
+// stopAll stops the confluxes concurrently, giving up after the shutdown timeout
+// It returns the cleanup errors of every conflux that did not stop cleanly
+func stopAll(confluxes []Conflux) error {
+	if len(confluxes) == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(confluxes))
+	for i, c := range confluxes {
+		wg.Add(1)
+		go func(i int, c Conflux) {
+			defer wg.Done()
+			if err := c.Stop(); err != nil {
+				errs[i] = fmt.Errorf("conflux on %s: %v", c.Status().Interface, err)
+			}
+		}(i, c)
+	}
+
+	shutdownComplete := make(chan bool, 1)
+	go func() {
+		wg.Wait()
 		shutdownComplete <- true
 	}()
 
-	// Wait for cleanup with timeout
 	select {
 	case <-shutdownComplete:
+		err := errors.Join(errs...)
+		if err != nil {
+			veilnet.Logger.Sugar().Errorf("Shutdown completed with errors, the host may need manual cleanup")
+			return err
+		}
 		veilnet.Logger.Sugar().Info("Shutdown completed successfully")
+		return nil
 	case <-time.After(10 * time.Second):
 		veilnet.Logger.Sugar().Warn("Shutdown timeout, forcing exit")
+		return fmt.Errorf("shutdown timed out, the host may need manual cleanup")
 	}
+}
+
+type Status struct {
+	Iface string `help:"The name of the TUN interface of the conflux, default: veilnet" default:"veilnet" env:"VEILNET_IFACE"`
+}
 
+func (cmd *Status) Run() error {
+	resp, err := SendControl(cmd.Iface, ControlRequest{Command: ControlStatus})
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(resp.Status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal status: %v", err)
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+type Down struct {
+	Iface string `help:"The name of the TUN interface of the conflux, default: veilnet" default:"veilnet" env:"VEILNET_IFACE"`
+}
+
+func (cmd *Down) Run() error {
+	_, err := SendControl(cmd.Iface, ControlRequest{Command: ControlStop})
+	if err != nil {
+		return err
+	}
+	veilnet.Logger.Sugar().Infof("Conflux stopped and the host cleaned up")
+	return nil
+}
+
+type Reload struct {
+	Iface string `help:"The name of the TUN interface of the conflux, default: veilnet" default:"veilnet" env:"VEILNET_IFACE"`
+}
+
+func (cmd *Reload) Run() error {
+	_, err := SendControl(cmd.Iface, ControlRequest{Command: ControlReload})
+	if err != nil {
+		return err
+	}
+	veilnet.Logger.Sugar().Infof("Bypass routes refreshed")
+	return nil
+}
+
+type Routes struct {
+	Iface string `help:"The name of the TUN interface of the conflux, default: veilnet" default:"veilnet" env:"VEILNET_IFACE"`
+	JSON  bool   `name:"json" help:"Print the routes as JSON, default: false" default:"false"`
+}
+
+func (cmd *Routes) Run() error {
+	resp, err := SendControl(cmd.Iface, ControlRequest{Command: ControlRoutes})
+	if err != nil {
+		return err
+	}
+	if cmd.JSON {
+		out, err := json.MarshalIndent(resp.Routes, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal routes: %v", err)
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	// One route per line, aligned in columns
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tDESTINATION\tHOST\tGATEWAY\tINTERFACE\tMETRIC\tCHANGE")
+	for _, route := range resp.Routes {
+		metric := "-"
+		if route.Metric != 0 {
+			metric = strconv.Itoa(route.Metric)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", route.Kind, route.Destination, orDash(route.Host), orDash(route.Gateway), orDash(route.Interface), metric, route.Change)
+	}
+	return w.Flush()
+}
+
+// orDash returns s, or - if it is empty, for the columns of a table
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+type Join struct {
+	Conflux  string `help:"The interface of a running plane of the up-multi to join, default: veilnet" default:"veilnet" env:"VEILNET_CONFLUX"`
+	Iface    string `help:"The name of the TUN interface of the new plane" required:"" env:"VEILNET_IFACE"`
+	Token    string `short:"t" help:"The conflux token of the new plane, please keep it secret" required:"" env:"VEILNET_TOKEN"`
+	Portal   bool   `short:"p" help:"Run the new plane in portal mode, default: false" default:"false" env:"VEILNET_PORTAL"`
+	Guardian string `short:"g" help:"The Guardian URL of the new plane, default: the Guardian of the up-multi" env:"VEILNET_GUARDIAN_URL"`
+	TUNGUID  string `name:"tun-guid" help:"The GUID of the wintun adapter of the new plane, derived from the interface name if not set (Windows only)" env:"VEILNET_TUN_GUID"`
+}
+
+func (cmd *Join) Run() error {
+	instance := MultiInstance{Iface: cmd.Iface, Token: cmd.Token, Portal: cmd.Portal, Guardian: cmd.Guardian, TUNGUID: cmd.TUNGUID}
+	_, err := SendControl(cmd.Conflux, ControlRequest{Command: ControlJoin, Instance: &instance})
+	if err != nil {
+		return err
+	}
+	veilnet.Logger.Sugar().Infof("Plane on %s joined", cmd.Iface)
+	return nil
+}
+
+type Leave struct {
+	Iface string `help:"The name of the TUN interface of the plane to stop" required:"" env:"VEILNET_IFACE"`
+}
+
+func (cmd *Leave) Run() error {
+	_, err := SendControl(cmd.Iface, ControlRequest{Command: ControlLeave, Iface: cmd.Iface})
+	if err != nil {
+		return err
+	}
+	veilnet.Logger.Sugar().Infof("Plane on %s left and the host cleaned up", cmd.Iface)
 	return nil
 }
 
@@ -146,11 +974,24 @@ type RegisterRequest struct {
 }
 
 type Register struct {
-	Email    string `help:"The email to login with VeilNet Guardian"`
-	Password string `help:"The password to login with VeilNet Guardian"`
-	Name     string `help:"The name of the conflux"`
-	Plane    string `help:"The plane to register on"`
-	Tag      string `help:"The tag for the conflux"`
+	Email     string `help:"The email to login with VeilNet Guardian"`
+	Password  string `help:"The password to login with VeilNet Guardian"`
+	Guardian  string `short:"g" help:"The Guardian URL (Authentication Server), default: https://guardian.veilnet.org" default:"https://guardian.veilnet.org" env:"VEILNET_GUARDIAN_URL"`
+	Insecure  bool   `help:"Allow a Guardian URL over plain http, for testing only, default: false" default:"false" env:"VEILNET_INSECURE"`
+	Name      string `help:"The name of the conflux"`
+	Plane     string `help:"The plane to register on"`
+	Tag       string `help:"The tag for the conflux"`
+	JSON      bool   `name:"json" help:"Print the registered conflux as JSON, default: false" default:"false"`
+	ShowToken bool   `name:"show-token" help:"Include the token in the JSON output, default: false" default:"false"`
+}
+
+// RegisteredConflux is a conflux as returned by the Guardian on registration
+type RegisteredConflux struct {
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"conflux_name"`
+	Plane string `json:"plane_name"`
+	Tag   string `json:"tag,omitempty"`
+	Token string `json:"token,omitempty"`
 }
 
 func (cmd *Register) Run() error {
@@ -173,7 +1014,11 @@ func (cmd *Register) register(accessToken string) error {
 
 	veilnet.Logger.Sugar().Infof("Registering conflux %s on plane %s with tag %s", cmd.Name, cmd.Plane, cmd.Tag)
 
-	url := fmt.Sprintf("%s/conflux?conflux_name=%s&plane_name=%s&tag=%s", "https://guardian.veilnet.org", cmd.Name, cmd.Plane, cmd.Tag)
+	guardian, err := normalizeURL("guardian", cmd.Guardian, cmd.Insecure)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/conflux?conflux_name=%s&plane_name=%s&tag=%s", guardian, cmd.Name, cmd.Plane, cmd.Tag)
 	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create register request: %v", err)
@@ -198,20 +1043,96 @@ func (cmd *Register) register(accessToken string) error {
 		return fmt.Errorf("register failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
-	veilnet.Logger.Sugar().Infof("Conflux registered successfully! Token: %s", string(body))
+	registered, err := cmd.parseResponse(body)
+	if err != nil {
+		return err
+	}
+
+	if !cmd.JSON {
+		if registered.ID != "" {
+			veilnet.Logger.Sugar().Infof("Conflux registered successfully! ID: %s, Token: %s", registered.ID, registered.Token)
+			return nil
+		}
+		veilnet.Logger.Sugar().Infof("Conflux registered successfully! Token: %s", registered.Token)
+		return nil
+	}
+
+	// Print the conflux for automation, the token only if asked for
+	veilnet.Logger.Sugar().Infof("Conflux registered successfully!")
+	if !cmd.ShowToken {
+		registered.Token = ""
+	}
+	out, err := json.MarshalIndent(registered, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal registered conflux: %v", err)
+	}
+	fmt.Println(string(out))
 
 	return nil
 }
 
+// parseResponse reads the register response, which is either a JSON conflux object or the bare token
+func (cmd *Register) parseResponse(body []byte) (RegisteredConflux, error) {
+	registered := RegisteredConflux{Name: cmd.Name, Plane: cmd.Plane, Tag: cmd.Tag}
+	body = bytes.TrimSpace(body)
+
+	switch {
+	case bytes.HasPrefix(body, []byte("{")):
+		var obj struct {
+			ID    any    `json:"id"`
+			Name  string `json:"conflux_name"`
+			Plane string `json:"plane_name"`
+			Tag   string `json:"tag"`
+			Token string `json:"token"`
+		}
+		err := json.Unmarshal(body, &obj)
+		if err != nil {
+			return registered, fmt.Errorf("failed to parse register response: %v", err)
+		}
+		if obj.ID != nil {
+			registered.ID = fmt.Sprint(obj.ID)
+		}
+		if obj.Name != "" {
+			registered.Name = obj.Name
+		}
+		if obj.Plane != "" {
+			registered.Plane = obj.Plane
+		}
+		if obj.Tag != "" {
+			registered.Tag = obj.Tag
+		}
+		registered.Token = obj.Token
+	case bytes.HasPrefix(body, []byte("\"")):
+		err := json.Unmarshal(body, &registered.Token)
+		if err != nil {
+			return registered, fmt.Errorf("failed to parse register response: %v", err)
+		}
+	default:
+		registered.Token = string(body)
+	}
+
+	if registered.Token == "" {
+		return registered, fmt.Errorf("register response has no token: %s", string(body))
+	}
+	return registered, nil
+}
+
 type UnRegister struct {
 	Email    string `help:"The email to login with VeilNet Guardian"`
 	Password string `help:"The password to login with VeilNet Guardian"`
+	Guardian string `short:"g" help:"The Guardian URL (Authentication Server), default: https://guardian.veilnet.org" default:"https://guardian.veilnet.org" env:"VEILNET_GUARDIAN_URL"`
+	Insecure bool   `help:"Allow a Guardian URL over plain http, for testing only, default: false" default:"false" env:"VEILNET_INSECURE"`
+	ID       string `help:"The id of the conflux, as printed by register, used instead of the name and plane"`
 	Name     string `help:"The name of the conflux"`
 	Plane    string `help:"The plane to register on"`
 }
 
 func (cmd *UnRegister) Run() error {
 
+	if cmd.ID == "" && (cmd.Name == "" || cmd.Plane == "") {
+		return fmt.Errorf("set --id, or --name and --plane, of the conflux to unregister")
+	}
+
 	accessToken, err := login(cmd.Email, cmd.Password)
 	if err != nil {
 		return err
@@ -228,9 +1149,21 @@ func (cmd *UnRegister) Run() error {
 
 func (cmd *UnRegister) unregister(accessToken string) error {
 
-	veilnet.Logger.Sugar().Infof("Unregistering conflux %s on plane %s", cmd.Name, cmd.Plane)
+	guardian, err := normalizeURL("guardian", cmd.Guardian, cmd.Insecure)
+	if err != nil {
+		return err
+	}
+
+	// Prefer the id, which is unambiguous, over the name and plane
+	var url string
+	if cmd.ID != "" {
+		veilnet.Logger.Sugar().Infof("Unregistering conflux %s", cmd.ID)
+		url = fmt.Sprintf("%s/conflux?conflux_id=%s", guardian, neturl.QueryEscape(cmd.ID))
+	} else {
+		veilnet.Logger.Sugar().Infof("Unregistering conflux %s on plane %s", cmd.Name, cmd.Plane)
+		url = fmt.Sprintf("%s/conflux?conflux_name=%s&plane_name=%s", guardian, cmd.Name, cmd.Plane)
+	}
 
-	url := fmt.Sprintf("%s/conflux?conflux_name=%s&plane_name=%s", "https://guardian.veilnet.org", cmd.Name, cmd.Plane)
 	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create register request: %v", err)
@@ -251,6 +1184,10 @@ func (cmd *UnRegister) unregister(accessToken string) error {
 		return fmt.Errorf("failed to read register response body: %v", err)
 	}
 
+	if cmd.ID != "" && (resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusMethodNotAllowed) {
+		return fmt.Errorf("the Guardian does not support unregistering by id, use --name and --plane instead")
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("register failed with status %d: %s", resp.StatusCode, string(body))
 	}
@@ -259,3 +1196,50 @@ func (cmd *UnRegister) unregister(accessToken string) error {
 
 	return nil
 }
+
+type Check struct {
+	Token         string        `short:"t" help:"The conflux token to check" env:"VEILNET_TOKEN"`
+	Portal        bool          `short:"p" help:"Check the token in portal mode, default: false" default:"false" env:"VEILNET_PORTAL"`
+	Guardian      string        `short:"g" help:"The Guardian URL (Authentication Server), default: https://guardian.veilnet.org" default:"https://guardian.veilnet.org" env:"VEILNET_GUARDIAN_URL"`
+	Insecure      bool          `help:"Allow a Guardian URL over plain http, for testing only, default: false" default:"false" env:"VEILNET_INSECURE"`
+	AnchorTimeout time.Duration `name:"anchor-timeout" help:"How long to wait for the anchor to connect, 0 waits forever, default: 30s" default:"30s" env:"VEILNET_ANCHOR_TIMEOUT"`
+}
+
+func (cmd *Check) Run() error {
+
+	guardian, err := normalizeURL("guardian", cmd.Guardian, cmd.Insecure)
+	if err != nil {
+		return err
+	}
+	if cmd.Token == "" {
+		return fmt.Errorf("conflux token is not set")
+	}
+
+	// Connect the anchor and disconnect it again, Ctrl+C aborts the check
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	cidr, err := CheckToken(ctx, Options{AnchorTimeout: cmd.AnchorTimeout}, guardian, cmd.Token, cmd.Portal)
+	if err != nil {
+		return fmt.Errorf("token check failed: %v", err)
+	}
+	fmt.Printf("Token accepted by %s, assigned CIDR %s\n", guardian, cidr)
+	return nil
+}
+
+type Cleanup struct {
+	Iface string `help:"The name of the TUN interface to clean up, default: veilnet" default:"veilnet" env:"VEILNET_IFACE"`
+}
+
+func (cmd *Cleanup) Run() error {
+
+	// Refuse to pull the interface from under a conflux that is still running
+	if _, err := SendControl(cmd.Iface, ControlRequest{Command: ControlStatus}); err == nil {
+		return fmt.Errorf("a conflux is running on %s, stop it with down instead", cmd.Iface)
+	}
+	err := CleanupInterface(cmd.Iface)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Cleaned up %s\n", cmd.Iface)
+	return nil
+}
@@ -0,0 +1,63 @@
+package conflux
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+
+	"github.com/veil-net/veilnet"
+)
+
+// verboseCommands logs every host command run by the conflux
+var verboseCommands atomic.Bool
+
+// SetVerbose sets whether every host command run by the conflux is logged with its exit status and output
+func SetVerbose(verbose bool) {
+	verboseCommands.Store(verbose)
+}
+
+// runCommand runs a host command and returns its trimmed combined output
+// On failure the returned error includes the output so the cause is visible in logs
+func runCommand(name string, args ...string) (string, error) {
+	return runCommandInput("", name, args...)
+}
+
+// lookPath finds a host command, it is replaced along with runCommandInput where a step checks the command exists
+var lookPath = exec.LookPath
+
+// runCommandInput runs a host command like runCommand, feeding input to its stdin
+// It can be replaced to run the conflux without touching the host
+var runCommandInput = func(input, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	if input != "" {
+		cmd.Stdin = strings.NewReader(input)
+	}
+	out, err := cmd.CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if verboseCommands.Load() {
+		logCommand(name, args, output, err)
+	}
+	if err != nil && output != "" {
+		return output, fmt.Errorf("%v: %s", err, output)
+	}
+	return output, err
+}
+
+// logCommand logs a host command, its exit status and output
+func logCommand(name string, args []string, output string, err error) {
+	status := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status = exitErr.ExitCode()
+	} else if err != nil {
+		veilnet.Logger.Sugar().Infof("exec: %s %s failed: %v", name, strings.Join(args, " "), err)
+		return
+	}
+	if output != "" {
+		veilnet.Logger.Sugar().Infof("exec: %s %s exited %d: %s", name, strings.Join(args, " "), status, output)
+		return
+	}
+	veilnet.Logger.Sugar().Infof("exec: %s %s exited %d", name, strings.Join(args, " "), status)
+}
@@ -0,0 +1,69 @@
+package conflux
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeResult is the output and error a fakeCommands run returns
+type fakeResult struct {
+	output string
+	err    error
+}
+
+// fakeCommands replaces the host commands, answering each command line with its result and recording the runs
+// A command line without a result succeeds with no output
+type fakeCommands struct {
+	results map[string]fakeResult
+
+	mu     sync.Mutex
+	runs   []string
+	inputs []string
+}
+
+// useFakeCommands makes runCommandInput run commands on a fakeCommands for the rest of the test
+func useFakeCommands(t *testing.T) *fakeCommands {
+	t.Helper()
+	f := &fakeCommands{results: make(map[string]fakeResult)}
+	prev := runCommandInput
+	runCommandInput = f.run
+	t.Cleanup(func() { runCommandInput = prev })
+	return f
+}
+
+// set makes the command line return output and err
+func (f *fakeCommands) set(line, output string, err error) {
+	f.results[line] = fakeResult{output: output, err: err}
+}
+
+// fail makes the command line fail with output, as a command exiting non-zero does
+func (f *fakeCommands) fail(line, output string) {
+	f.set(line, output, errors.New("exit status 1: "+output))
+}
+
+func (f *fakeCommands) run(input, name string, args ...string) (string, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.runs = append(f.runs, line)
+	f.inputs = append(f.inputs, input)
+	r := f.results[line]
+	return r.output, r.err
+}
+
+// ran returns the command lines run so far, in order
+func (f *fakeCommands) ran() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.runs)
+}
+
+// fed returns the input fed to each command run so far, in order
+func (f *fakeCommands) fed() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.inputs)
+}
@@ -1,15 +1,22 @@
 package conflux
 
+import (
+	"context"
+	"time"
+)
+
 type Conflux interface {
 
-	// Start starts the conflux
-	Start(apiBaseURL, anchorToken string, portal bool) error
+	// Start starts the conflux, cancelling the context aborts the startup and rolls back the host changes
+	// A conflux can only be started once, other calls return an error naming its state
+	Start(ctx context.Context, apiBaseURL, anchorToken string, portal bool) error
 
-	// Stop stops the conflux
-	Stop()
+	// Stop stops the conflux, returning a CleanupError if the host was left partially configured
+	// It waits for a Start in progress to finish, and later calls return the result of the first
+	Stop() error
 
-	// StartAnchor starts the veilnet anchor
-	StartAnchor(apiBaseURL, anchorToken string, portal bool) error
+	// StartAnchor starts the veilnet anchor, returning early if the context is cancelled
+	StartAnchor(ctx context.Context, apiBaseURL, anchorToken string, portal bool) error
 
 	// StopAnchor stops the veilnet anchor
 	StopAnchor()
@@ -20,16 +27,201 @@ type Conflux interface {
 	// CloseTUN closes the TUN device
 	CloseTUN() error
 
-	// DetectHostGateway detects the host default gateway and interface
+	// CheckBinaries checks the host commands needed to configure the host are available
+	CheckBinaries() error
+
+	// DetectHostGateway detects the host default gateway and interface, waiting up to WaitForNetwork for one to appear
 	DetectHostGateway() error
 
 	// AddBypassRoutes adds bypass routes
 	AddBypassRoutes()
 
-	// RemoveBypassRoutes removes bypass routes
-	RemoveBypassRoutes()
+	// RemoveBypassRoutes removes bypass routes, returning a CleanupError listing the routes left in place
+	RemoveBypassRoutes() error
+
+	// Status returns the status of the conflux
+	Status() ConfluxStatus
+
+	// Routes lists the routes the conflux added to or changed in the host routing table while it runs
+	Routes() []ManagedRoute
+
+	// Done returns a channel closed when the anchor is lost, unless ExitOnAnchorLoss exits the process instead
+	Done() <-chan struct{}
+
+	// Stalled returns a channel closed when the TUN wedged while the anchor is alive, see EgressStallTimeout
+	Stalled() <-chan struct{}
+}
+
+// Options configures how the conflux modifies the host
+type Options struct {
+
+	// Interface is the name of the TUN interface, veilnet by default
+	Interface string
+
+	// Fallback keeps the host default route at a lower priority instead of removing it
+	Fallback bool
+
+	// UpScript is run once the host is configured
+	UpScript string
+
+	// DownScript is run before the host configuration is cleaned
+	DownScript string
+
+	// DNS is the list of resolvers configured for the tunnel, in order of preference, 1.1.1.1 by default
+	DNS []string
+
+	// DNSSearch is the list of DNS search domains to configure
+	DNSSearch []string
+
+	// DNSBypass pins the public DNS servers outside the tunnel CIDR to the host gateway, so they are queried outside the tunnel
+	DNSBypass bool
+
+	// Peer is the point-to-point peer address of the TUN, used as the gateway of the TUN default route, Linux and macOS only
+	Peer string
+
+	// ExtraAddresses are assigned to the TUN interface in addition to the anchor CIDR
+	ExtraAddresses []string
+
+	// RequireNAT fails the portal startup if NAT cannot be set up
+	RequireNAT bool
+
+	// FirewallBackend is how the portal FORWARD and NAT rules are added: auto, iptables or firewalld, auto uses
+	// firewalld if it is running, Linux only
+	FirewallBackend string
+
+	// TuneForwarding relaxes reverse path filtering and turns off ICMP redirects in portal mode, Linux only
+	TuneForwarding bool
+
+	// DNSMode is the transport used for the tunnel resolver: udp, dot or doh
+	DNSMode string
+
+	// DNSMethod is how the DNS settings are applied: auto, none, resolvconf, systemd-resolved or direct-file
+	// Only none is supported on macOS, to leave the DNS settings alone
+	DNSMethod string
+
+	// AnchorTimeout bounds the initial connection of the anchor, zero waits forever
+	AnchorTimeout time.Duration
+
+	// DSCP marks the packets a portal forwards from the tunnel with a DSCP given as 0-63 or a class name such as EF,
+	// empty leaves them unmarked, Linux only
+	DSCP string
+
+	// WaitForNetwork is how long to wait at startup for the host to get a default route, e.g. from DHCP early in boot,
+	// zero only rides out a momentary loss of the default route
+	WaitForNetwork time.Duration
+
+	// InterfaceUpTimeout is how long to wait for the TUN to come up before adding routes
+	InterfaceUpTimeout time.Duration
+
+	// Offload sets the TUN checksum and segmentation offloads: auto, on or off, Linux only
+	Offload string
+
+	// AutoIface uses the first free numbered name after Interface, e.g. veilnet1, if Interface is taken, Linux and
+	// Windows only
+	AutoIface bool
+
+	// GatewayIface is the host interface whose default route VeilNet is reached through, chosen if empty, macOS only
+	GatewayIface string
+
+	// KeepInterface leaves the TUN in place, down, when the conflux stops, Linux only
+	KeepInterface bool
+
+	// DisableIPv6 disables IPv6 autoconfiguration on the TUN, Linux only
+	DisableIPv6 bool
+
+	// Strict fails the startup on conditions that are otherwise only warned about
+	Strict bool
+
+	// RateLimit caps the portal bandwidth in each direction, e.g. 50mbit, Linux only
+	RateLimit string
+
+	// Drain is how long to let established portal flows finish on stop before removing NAT, Linux only
+	Drain time.Duration
+
+	// IPFile is a file the tunnel IP and CIDR are written to once the host is configured, removed on stop
+	IPFile string
+
+	// TUNFd is a TUN file descriptor inherited from the parent, used instead of creating the TUN, zero creates it
+	TUNFd int
+
+	// Userspace runs the data plane on a userspace network stack behind a SOCKS5 proxy instead of a TUN
+	Userspace bool
+
+	// SOCKSAddress is the address the SOCKS5 proxy listens on in userspace mode
+	SOCKSAddress string
+
+	// ExitOnAnchorLoss exits the process with status 1 when the anchor goes down, otherwise Done is closed
+	ExitOnAnchorLoss bool
+
+	// NoCleanupOnExit leaves the host configuration in place when ExitOnAnchorLoss exits the process, which otherwise
+	// stops the conflux first
+	NoCleanupOnExit bool
+
+	// EgressStallTimeout closes Stalled if no TUN read completes for this long while the anchor is alive and packets are
+	// still written to the TUN, an idle host does not trip it, zero disables it
+	EgressStallTimeout time.Duration
+
+	// Priority places the TUN default route before (high) or after (low) the default routes of other tunnels, or sets
+	// its metric with metric:N, high by default
+	Priority string
+
+	// RouteTable is the routing table used for policy routing, Linux only
+	RouteTable int
+
+	// MaxPacketRate caps the packets each packet loop processes per second, as a safety valve against a runaway loop,
+	// zero does not limit
+	MaxPacketRate int
+
+	// QueueDepth is how many batches may wait between the reads and the writes of each packet loop, the batches
+	// arriving while it is full are dropped and counted, zero writes each batch as soon as it is read
+	QueueDepth int
+
+	// StatsInterval is how often a traffic summary is logged, zero disables it
+	StatsInterval time.Duration
+
+	// TUNGUID is the wintun adapter GUID, derived from the interface name if empty, Windows only
+	TUNGUID string
+
+	// TUNDescription is the description of the wintun adapter that policies and monitoring tools can match on,
+	// veilnet if empty, Windows only
+	TUNDescription string
+
+	// SystemWintun uses a wintun.dll installed next to the executable or in System32 instead of extracting the
+	// embedded copy, Windows only
+	SystemWintun bool
+
+	// TUNOffset overrides the headroom left in front of each packet for the device, zero derives it from the device
+	TUNOffset int
+
+	// AuditRoutes logs the host routing table, and the iptables rules in portal mode, before the host is configured
+	// and after it is cleaned, for bug reports
+	AuditRoutes bool
+
+	// VerifyCleanup re-reads the routing table and firewall after the cleanup and logs what the conflux left behind
+	VerifyCleanup bool
+
+	// StrictCleanup verifies the cleanup like VerifyCleanup and fails it if anything was left behind
+	StrictCleanup bool
+
+	// CPUAffinity pins the ingress and egress loops to these CPUs, Linux only
+	CPUAffinity []int
 }
 
-func NewConflux() Conflux {
-	return newConflux()
+func NewConflux(opts Options) Conflux {
+	if opts.Interface == "" {
+		opts.Interface = "veilnet"
+	}
+	if len(opts.DNS) == 0 {
+		opts.DNS = []string{tunnelDNS}
+	}
+	if opts.TUNDescription == "" {
+		opts.TUNDescription = defaultInterfaceDescription
+	}
+	if opts.Priority == "" {
+		opts.Priority = PriorityHigh
+	}
+	if opts.RouteTable == 0 {
+		opts.RouteTable = DefaultRouteTable
+	}
+	return newConflux(opts)
 }
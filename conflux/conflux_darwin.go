@@ -4,45 +4,96 @@
 package conflux
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"os"
-	"os/exec"
+	"net/netip"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/veil-net/veilnet"
 	tun "golang.zx2c4.com/wireguard/tun"
 )
 
 type conflux struct {
-	anchor           *veilnet.Anchor
+	opts             Options
+	anchor           Anchor
 	device           tun.Device
 	portal           bool
 	gateway          string
 	iface            string
+	cidr             string
+	extraAddrs       []*net.IPNet
 	bypassRoutes     sync.Map
+	defaultChanges   []ManagedRoute
+	session          session
 	ipForwardEnabled bool
+	socksListener    net.Listener
+	stopped          atomic.Bool
+	lost             chan struct{}
+	stalled          chan struct{}
+	failOnce         sync.Once
+	life             lifecycle
+	stopErr          atomic.Pointer[CleanupError]
+	lastEgress       atomic.Int64
+	lastIngress      atomic.Int64
+	ready            atomic.Bool
+	dnsService       string
+	prevDNS          serviceDNS
+	dnsSet           bool
+	dnsSearchSet     bool
 
 	once sync.Once
 }
 
-func newConflux() *conflux {
-	return &conflux{}
+func newConflux(opts Options) *conflux {
+	c := &conflux{opts: opts, lost: make(chan struct{}), stalled: make(chan struct{})}
+	registerSession(opts.Interface, &c.session)
+	return c
 }
 
-func (c *conflux) Start(apiBaseURL, anchorToken string, portal bool) error {
+// start runs the startup of Start, rolling back what it applied if it fails
+func (c *conflux) start(ctx context.Context, apiBaseURL, anchorToken string, portal bool) error {
+
+	// Use the userspace network stack instead of a TUN
+	if c.opts.Userspace {
+		return c.startUserspace(ctx, apiBaseURL, anchorToken, portal)
+	}
+
+	// Time the startup phases
+	timer := newStartTimer()
 
 	// Set portal
 	if portal {
-		return fmt.Errorf("portal is not supported on Windows")
+		return fmt.Errorf("portal is not supported on macOS")
+	}
+
+	// Check the host commands used to configure the host are available
+	err := c.CheckBinaries()
+	if err != nil {
+		return err
 	}
 
 	// Get the default gateway and interface
-	err := c.DetectHostGateway()
+	err = c.waitGateway(ctx)
+	if err != nil {
+		return err
+	}
+	timer.phase("detect")
+
+	// Create the anchor
+	c.anchor = newAnchor()
+
+	// Start the anchor before touching the host so a rejected token leaves no routes or TUN behind
+	err = c.StartAnchor(ctx, apiBaseURL, anchorToken, portal)
 	if err != nil {
+		c.rollback()
 		return err
 	}
+	c.session.connected()
+	timer.phase("anchor")
 
 	// Set bypass routes
 	c.AddBypassRoutes()
@@ -50,75 +101,137 @@ func (c *conflux) Start(apiBaseURL, anchorToken string, portal bool) error {
 	// Create the TUN device
 	err = c.CreateTUN()
 	if err != nil {
+		c.rollback()
 		return err
 	}
 
-	// Create the anchor
-	c.anchor = veilnet.NewAnchor()
+	// Get the CIDR
+	cidr, err := c.anchor.GetCIDR()
+	if err != nil {
+		c.rollback()
+		return err
+	}
 
-	// Start the anchor
-	err = c.StartAnchor(apiBaseURL, anchorToken, portal)
+	// Accept a bare IP as a host address
+	cidr, err = normalizeCIDR(cidr)
 	if err != nil {
+		c.rollback()
 		return err
 	}
+	c.cidr = cidr
 
-	// Get the CIDR
-	cidr, err := c.anchor.GetCIDR()
+	// Check the extra addresses do not conflict with the CIDR
+	c.extraAddrs, err = parseExtraAddresses(cidr, c.opts.ExtraAddresses)
+	if err != nil {
+		c.rollback()
+		return err
+	}
+
+	// Check the CIDR does not overlap the host network or the bypass hosts
+	err = c.checkOverlaps(cidr)
 	if err != nil {
+		c.rollback()
 		return err
 	}
 
+	// Pin the DNS servers to the host gateway, once the CIDR they may lie in is known
+	c.AddDNSBypassRoutes(cidr)
+
+	// Check the peer address fits the CIDR
+	if c.opts.Peer != "" {
+		err = checkPeer(cidr, c.opts.Peer)
+		if err != nil {
+			c.rollback()
+			return err
+		}
+	}
+
 	// Split CIDR into IP and netmask
 	parts := strings.Split(cidr, "/")
 	if len(parts) != 2 {
+		c.rollback()
 		return fmt.Errorf("invalid CIDR format: %s", cidr)
 	}
 	ip := parts[0]
 	netmask := parts[1]
 
-	// Configure the host
+	// Configure the host, cleaning whatever was applied if it fails
+	timer.phase("cidr")
+	c.auditRoutes("before host configuration")
 	err = c.ConfigHost(ip, netmask)
 	if err != nil {
+		c.CleanHostConfiguraions()
+		c.rollback()
 		return err
 	}
 
-	// Start the ingress and egress threads
+	// Make sure the interface has the MTU the packet loops use
+	c.checkMTU(true)
+
+	// Run the up script
+	c.runUpScript()
+
+	// Let the packet loops write to the TUN and start them
+	c.ready.Store(true)
 	go c.ingress()
 	go c.egress()
 
-	// Check if the anchor is alive and if not, stop the conflux and exit
-	go func() {
-		<-c.anchor.Ctx.Done()
-		veilnet.Logger.Sugar().Info("Anchor stopped")
-		c.Stop()
-		os.Exit(1)
-	}()
+	// Log a periodic traffic summary
+	go c.logStats(c.opts.StatsInterval)
+
+	// Watch the anchor and handle it going down
+	go c.watchAnchor()
+
+	// Restart the conflux if the egress loop wedges
+	go c.watchEgress(c.opts.EgressStallTimeout)
+
+	// Set the MTU back if the interface loses it
+	go c.watchMTU()
+
+	// Log how long the startup took
+	timer.phase("config")
+	timer.report(c.opts.Interface)
 
 	return nil
 }
 
-func (c *conflux) Stop() {
+// stop runs the cleanup of Stop once, later calls wait for it and return its result
+func (c *conflux) stop() error {
 	c.once.Do(func() {
+		c.stopped.Store(true)
+		c.ready.Store(false)
+		if c.opts.Userspace {
+			c.stopUserspace()
+			return
+		}
+		var errs cleanupErrors
 		if c.anchor != nil {
 			c.anchor.Stop()
 		}
-		c.CleanHostConfiguraions()
-		c.RemoveBypassRoutes()
+		c.session.disconnected()
+		c.runDownScript()
+		errs.merge(c.CleanHostConfiguraions())
+		c.auditRoutes("after host cleanup")
+		hosts := c.cleanupHosts()
+		errs.merge(c.RemoveBypassRoutes())
 		if c.device != nil {
-			c.device.Close()
+			errs.add("close TUN device", c.device.Close())
 		}
+		errs.merge(c.verifyCleanup(hosts))
+		c.stopErr.Store(errs.cleanupError())
 	})
+	return c.stopResult()
 }
 
-func (c *conflux) StartAnchor(apiBaseURL, anchorToken string, portal bool) error {
-
-	// Start the anchor
-	err := c.anchor.Start(apiBaseURL, anchorToken, portal)
-	if err != nil {
-		return err
+// rollback undoes the steps of a Start that did not complete
+func (c *conflux) rollback() {
+	if c.anchor != nil {
+		c.anchor.Stop()
 	}
-
-	return nil
+	c.session.disconnected()
+	c.revertDNS()
+	c.RemoveBypassRoutes()
+	c.CloseTUN()
 }
 
 func (c *conflux) StopAnchor() {
@@ -126,8 +239,12 @@ func (c *conflux) StopAnchor() {
 }
 
 func (c *conflux) CreateTUN() error {
+	if c.opts.TUNFd != 0 {
+		return c.createTUNFromFd(tunMTU)
+	}
+
 	var err error
-	c.device, err = tun.CreateTUN("veilnet", 1500)
+	c.device, err = tun.CreateTUN(c.opts.Interface, tunMTU)
 	if err != nil {
 		veilnet.Logger.Sugar().Errorf("failed to create TUN device: %v", err)
 		return err
@@ -135,6 +252,11 @@ func (c *conflux) CreateTUN() error {
 	return nil
 }
 
+// minTUNOffset is the headroom the utun needs in front of each packet for its 4 byte address family header
+func (c *conflux) minTUNOffset() int {
+	return 4
+}
+
 func (c *conflux) CloseTUN() error {
 	if c.device != nil {
 		err := c.device.Close()
@@ -146,131 +268,139 @@ func (c *conflux) CloseTUN() error {
 	return nil
 }
 
+func (c *conflux) CheckBinaries() error {
+	required := []string{"route", "ifconfig", "netstat"}
+	if c.opts.DNSMethod != DNSMethodNone {
+		required = append(required, "networksetup")
+		if len(c.opts.DNSSearch) > 0 {
+			required = append(required, "scutil")
+		}
+	}
+	return checkBinaries(required, nil)
+}
+
 func (c *conflux) DetectHostGateway() error {
+	return c.waitGateway(context.Background())
+}
 
-	cmd := exec.Command("route", "-n", "get", "default")
-	out, err := cmd.Output()
+// detectHostGateway looks up the host default gateway and interface once
+func (c *conflux) detectHostGateway() error {
+
+	out, err := runCommand("route", "-n", "get", "default")
 	if err != nil {
-		veilnet.Logger.Sugar().Errorf("Failed to get default route: %v", err)
-		return err
+		if strings.Contains(err.Error(), "not in table") {
+			return errNoDefaultRoute
+		}
+		return fmt.Errorf("failed to get default route: %v", err)
 	}
 
+	var gateway, iface string
 	lines := strings.Split(string(out), "\n")
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
 		if strings.HasPrefix(line, "gateway:") {
-			c.gateway = strings.TrimSpace(strings.TrimPrefix(line, "gateway:"))
+			gateway = strings.TrimSpace(strings.TrimPrefix(line, "gateway:"))
 		}
 		if strings.HasPrefix(line, "interface:") {
-			c.iface = strings.TrimSpace(strings.TrimPrefix(line, "interface:"))
+			iface = strings.TrimSpace(strings.TrimPrefix(line, "interface:"))
 		}
 	}
 
-	if c.gateway == "" || c.iface == "" {
-		err = fmt.Errorf("default gateway or interface not found")
-		veilnet.Logger.Sugar().Errorf("Host default gateway or interface not found")
+	if iface == "" {
+		return gatewayParseError("route -n get default", "the default route has no interface", out)
+	}
+
+	// Another VPN may hold the default route, prefer a physical interface or the one asked for
+	chosen, err := c.chooseGateway(defaultRoute{gateway: gateway, netif: iface})
+	if err != nil {
 		return err
 	}
+	if chosen.gateway == "" {
+		return gatewayParseError("route -n get default", "the default route has no gateway", out)
+	}
 
+	c.gateway = chosen.gateway
+	c.iface = chosen.netif
 	veilnet.Logger.Sugar().Infof("Found Host Default gateway: %s via interface %s", c.gateway, c.iface)
 	return nil
 }
 
-func (c *conflux) AddBypassRoutes() {
-	hosts := []string{"stun.cloudflare.com", "turn.cloudflare.com", "guardian.veilnet.org", "turn.veilnet.org"}
-
-	for _, host := range hosts {
-		// Resolve IP addresses
-		ips, err := net.LookupIP(host)
-		if err != nil {
-			veilnet.Logger.Sugar().Errorf("Failed to resolve %s: %v", host, err)
+// specificRoute returns the route to dest if it is more specific than the default route and not through the TUN
+func (c *conflux) specificRoute(dest string) string {
+	out, err := runCommand("route", "-n", "get", dest)
+	if err != nil {
+		return ""
+	}
+	var destination, mask, iface string
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
 			continue
 		}
-
-		for _, ip := range ips {
-			// Add route for IPv4 addresses
-			if ip4 := ip.To4(); ip4 != nil {
-				dest := ip4.String()
-				cmd := exec.Command("route", "-n", "add", dest, c.gateway, "-interface", c.iface)
-				cmd.Run()
-				// Store the bypass route
-				c.bypassRoutes.Store(host, dest)
-			}
+		switch key {
+		case "destination":
+			destination = strings.TrimSpace(value)
+		case "mask":
+			mask = strings.TrimSpace(value)
+		case "interface":
+			iface = strings.TrimSpace(value)
 		}
 	}
-}
+	addr, err := netip.ParseAddr(destination)
+	if err != nil || iface == c.opts.Interface {
+		return ""
+	}
 
-func (c *conflux) RemoveBypassRoutes() {
-	c.bypassRoutes.Range(func(key, value interface{}) bool {
-		// Remove bypass route
-		cmd := exec.Command("route", "-n", "del", value.(string))
-		err := cmd.Run()
-		if err != nil {
-			veilnet.Logger.Sugar().Errorf("Failed to clear bypass route for %s: %v", key, err)
-			return false
+	// A route without a mask is a host route
+	bits := 32
+	if mask != "" {
+		ip := net.ParseIP(mask).To4()
+		if ip == nil {
+			return ""
 		}
-		return true
-	})
+		bits, _ = net.IPMask(ip).Size()
+	}
+	prefix := netip.PrefixFrom(addr, bits)
+	if !isSpecificRoute(prefix) {
+		return ""
+	}
+	return fmt.Sprintf("%s on %s", prefix, iface)
 }
 
-func (c *conflux) Read(bufs [][]byte, batchSize int) int {
-	return c.anchor.Read(bufs, batchSize)
+// hasHostRoute reports whether a host route to dest is in the routing table
+func (c *conflux) hasHostRoute(dest string) bool {
+	out, err := runCommand("route", "-n", "get", dest)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "destination:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "destination:")) == dest
+		}
+	}
+	return false
 }
 
-func (c *conflux) Write(bufs [][]byte, sizes []int) int {
-	return c.anchor.Write(bufs, sizes)
+// adoptHostRoute reports whether the host route to dest was left by an earlier run, the routes here carry no tag to
+// tell so
+func (c *conflux) adoptHostRoute(dest string) bool {
+	return false
 }
 
-func (c *conflux) ingress() {
-	bufs := make([][]byte, c.device.BatchSize())
-	for {
-		select {
-		case <-c.anchor.Ctx.Done():
-			veilnet.Logger.Sugar().Info("Portal ingress stopped")
-			return
-		default:
-			n := c.Read(bufs, c.device.BatchSize())
-			for i := 0; i < n; i++ {
-				newBuf := make([]byte, 16+len(bufs[i]))
-				copy(newBuf[16:], bufs[i])
-				bufs[i] = newBuf
-			}
-			if n > 0 {
-				c.device.Write(bufs[:n], 16)
-			}
-		}
+// addHostRoute adds a host route to dest via the host gateway
+func (c *conflux) addHostRoute(dest string) error {
+	out, err := runCommand("route", "-n", "add", dest, c.gateway, "-interface", c.iface)
+	if err != nil && strings.Contains(out, "File exists") {
+		return errRouteExists
 	}
+	return err
 }
 
-func (c *conflux) egress() {
-	bufs := make([][]byte, c.device.BatchSize())
-	sizes := make([]int, c.device.BatchSize())
-	mtu, err := c.device.MTU()
-	if err != nil {
-		veilnet.Logger.Sugar().Errorf("failed to get TUN MTU: %v", err)
-		// Use default MTU if we can't get the actual one
-		mtu = 1500
-	}
-	// Pre-allocate buffers
-	for i := range bufs {
-		bufs[i] = make([]byte, mtu)
-	}
-
-	for {
-		select {
-		case <-c.anchor.Ctx.Done():
-			veilnet.Logger.Sugar().Info("Portal egress stopped")
-			return
-		default:
-			n, err := c.device.Read(bufs, sizes, 0)
-			if err != nil {
-				continue
-			}
-			if n > 0 {
-				c.Write(bufs[:n], sizes[:n])
-			}
-		}
-	}
+// delHostRoute removes the host route to dest added by addHostRoute
+func (c *conflux) delHostRoute(dest string) error {
+	_, err := runCommand("route", "-n", "del", dest)
+	return err
 }
 
 // ConfigHost configures the TUN interface with the given IP address and netmask
@@ -281,47 +411,227 @@ func (c *conflux) ConfigHost(ip, netmask string) error {
 	// Add bypass route for Veil Master
 	veilHost := c.anchor.GetVeilHost()
 	if veilHost != "" {
-		cmd := exec.Command("route", "-n", "add", veilHost, c.gateway, "-interface", c.iface)
-		cmd.Run()
+		runCommand("route", "-n", "add", veilHost, c.gateway, "-interface", c.iface)
 	}
 	// Bring the interface up
-	if err := exec.Command("ifconfig", "veilnet", "up").Run(); err != nil {
+	if _, err := runCommand("ifconfig", c.opts.Interface, "up"); err != nil {
 		veilnet.Logger.Sugar().Errorf("Failed to bring interface veilnet up: %v", err)
 		return err
 	}
 	veilnet.Logger.Sugar().Infof("Set VeilNet TUN interface up")
 
-	// Set the IP address and netmask
-	if err := exec.Command("ifconfig", "veilnet", "inet", ip, "netmask", c.convertNetmask(netmask)).Run(); err != nil {
+	// Wait for the link to be operational before adding routes
+	if err := waitInterfaceUp(c.opts.Interface, c.opts.InterfaceUpTimeout); err != nil {
+		veilnet.Logger.Sugar().Errorf("%v", err)
+		return err
+	}
+
+	// Set the IP address and netmask, and the destination address of the point-to-point link if there is a peer
+	args := []string{c.opts.Interface, "inet", ip}
+	if c.opts.Peer != "" {
+		args = append(args, c.opts.Peer)
+	}
+	if _, err := runCommand("ifconfig", append(args, "netmask", c.convertNetmask(netmask))...); err != nil {
 		veilnet.Logger.Sugar().Errorf("Failed to set IP %s/%s on veilnet: %v", ip, netmask, err)
 		return err
 	}
-	veilnet.Logger.Sugar().Infof("Set VeilNet TUN IP to %s/%s", ip, netmask)
+	if c.opts.Peer != "" {
+		veilnet.Logger.Sugar().Infof("Set VeilNet TUN IP to %s/%s with peer %s", ip, netmask, c.opts.Peer)
+	} else {
+		veilnet.Logger.Sugar().Infof("Set VeilNet TUN IP to %s/%s", ip, netmask)
+	}
+
+	// Set the extra addresses as aliases
+	for _, addr := range c.extraAddrs {
+		if _, err := runCommand("ifconfig", c.opts.Interface, "inet", addr.IP.String(), "netmask", net.IP(addr.Mask).String(), "alias"); err != nil {
+			veilnet.Logger.Sugar().Errorf("Failed to add extra address %s on veilnet: %v", addr, err)
+			return err
+		}
+		veilnet.Logger.Sugar().Infof("Added extra address %s to VeilNet TUN", addr)
+	}
+
+	// Point the network service of the host interface at the tunnel resolver
+	if c.opts.DNSMethod == DNSMethodNone {
+		veilnet.Logger.Sugar().Infof("DNS method is none, leaving the DNS settings alone")
+	} else if err := c.applyDNS(); err != nil {
+		veilnet.Logger.Sugar().Errorf("%v", err)
+		return err
+	}
+	if c.opts.DNSMode == DNSModeDoT || c.opts.DNSMode == DNSModeDoH {
+		veilnet.Logger.Sugar().Warnf("Encrypted DNS is not supported on darwin, ignoring --dns-mode %s", c.opts.DNSMode)
+	}
+
+	// Make sure the TUN is present before giving up the original default route
+	if _, err := net.InterfaceByName(c.opts.Interface); err != nil {
+		veilnet.Logger.Sugar().Errorf("Refusing to delete the default route, veilnet interface not found: %v", err)
+		return err
+	}
+
+	// Pick the hopcount of the TUN default route, macOS does not order default routes by metric so only metric:N sets it
+	hopcount, err := parsePriority(c.opts.Priority)
+	if err != nil {
+		return err
+	}
+	if hopcount < 0 {
+		hopcount = 5
+	}
+	fallbackHopcount := max(10, hopcount+1)
+	if netifs := splitRouteInterfaces(); len(netifs) > 0 && c.opts.Priority == PriorityHigh {
+		veilnet.Logger.Sugar().Warnf("Another tunnel routes 0/1 and 128.0/1 through %s, which take precedence over the VeilNet default route", strings.Join(netifs, ", "))
+	}
 
 	// Delete the original default route
-	if err := exec.Command("route", "-n", "delete", "default").Run(); err != nil {
+	if _, err := runCommand("route", "-n", "delete", "default"); err != nil {
 		veilnet.Logger.Sugar().Errorf("Failed to delete original default route: %v", err)
 		return err
 	}
 	veilnet.Logger.Sugar().Infof("Deleted original default route")
+	hostDefault := ManagedRoute{Kind: routeKindHostDefault, Destination: "0.0.0.0/0", Gateway: c.gateway, Interface: c.iface, Change: routeRemoved}
+
+	// From here on a failure must put the original default route back so the host is never left offline
 
 	// Recreate the original default route with higher hopcount (lower priority)
-	if err := exec.Command("route", "-n", "add", "default", c.gateway, "-hopcount", "10").Run(); err != nil {
-		veilnet.Logger.Sugar().Errorf("Failed to recreate default route with higher hopcount: %v", err)
-		return err
+	if c.opts.Fallback {
+		if _, err := runCommand("route", "-n", "add", "default", c.gateway, "-hopcount", strconv.Itoa(fallbackHopcount)); err != nil {
+			veilnet.Logger.Sugar().Errorf("Failed to recreate default route with higher hopcount: %v", err)
+			c.restoreDefaultRoute()
+			return err
+		}
+		veilnet.Logger.Sugar().Infof("Recreated default route with hopcount %d", fallbackHopcount)
+		hostDefault.Metric, hostDefault.Change = fallbackHopcount, routeFallback
 	}
-	veilnet.Logger.Sugar().Infof("Recreated default route with hopcount 10")
 
-	// Add a route through the TUN interface with lower hopcount (higher priority)
-	if err := exec.Command("route", "-n", "add", "default", "-interface", "veilnet", "-hopcount", "5").Run(); err != nil {
+	// Add a route through the TUN interface with lower hopcount (higher priority), via the peer if there is one
+	args = append([]string{"-n", "add", "default"}, c.tunGateway()...)
+	if _, err := runCommand("route", append(args, "-hopcount", strconv.Itoa(hopcount))...); err != nil {
 		veilnet.Logger.Sugar().Errorf("Failed to set default route: %v", err)
+		c.restoreDefaultRoute()
 		return err
 	}
-	veilnet.Logger.Sugar().Infof("Set veilnet as default route with hopcount 5")
+	veilnet.Logger.Sugar().Infof("Set veilnet as default route with hopcount %d", hopcount)
+
+	// Verify the TUN default route is installed before relying on it
+	if out, err := runCommand("route", "-n", "get", "default"); err != nil || !strings.Contains(out, "interface: "+c.opts.Interface) {
+		veilnet.Logger.Sugar().Errorf("Default route does not go through veilnet after setting it: %v", err)
+		c.restoreDefaultRoute()
+		return fmt.Errorf("failed to verify default route through %s", c.opts.Interface)
+	}
+	c.defaultChanges = append(c.defaultChanges, hostDefault, ManagedRoute{Kind: routeKindDefault, Destination: "0.0.0.0/0", Gateway: c.opts.Peer, Interface: c.opts.Interface, Metric: hopcount, Change: routeAdded})
 
 	return nil
 }
 
+// tunGateway returns the route arguments that send a route through the TUN, the peer address if there is one
+func (c *conflux) tunGateway() []string {
+	if c.opts.Peer != "" {
+		return []string{c.opts.Peer}
+	}
+	return []string{"-interface", c.opts.Interface}
+}
+
+// defaultRoute is an IPv4 default route in the host routing table
+type defaultRoute struct {
+	gateway string
+	netif   string
+}
+
+// defaultRoutes lists the IPv4 default routes in the host routing table
+func defaultRoutes() ([]defaultRoute, error) {
+	out, err := runCommand("netstat", "-rn", "-f", "inet")
+	if err != nil {
+		return nil, err
+	}
+	var routes []defaultRoute
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "default" {
+			continue
+		}
+		routes = append(routes, defaultRoute{gateway: fields[1], netif: fields[3]})
+	}
+	return routes, nil
+}
+
+// splitRouteInterfaces lists the interfaces other tunnels route 0/1 through, overriding any default route
+func splitRouteInterfaces() []string {
+	out, err := runCommand("netstat", "-rn", "-f", "inet")
+	if err != nil {
+		return nil
+	}
+	var netifs []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[0] == "0/1" {
+			netifs = append(netifs, fields[3])
+		}
+	}
+	return netifs
+}
+
+// restoreDefaultRoute puts the host default route back, checking the routing table before each step so it is
+// safe to run whatever state the host is in, e.g. when the network already dropped its default route
+func (c *conflux) restoreDefaultRoute() error {
+	var errs cleanupErrors
+	routes, err := defaultRoutes()
+	if err != nil {
+		errs.add("read the routing table", err)
+		return errs.err()
+	}
+
+	// Delete the route through the TUN interface, if any
+	var remaining []defaultRoute
+	for _, route := range routes {
+		if route.netif != c.opts.Interface {
+			remaining = append(remaining, route)
+			continue
+		}
+		if _, err := runCommand("route", append([]string{"-n", "delete", "default"}, c.tunGateway()...)...); err != nil {
+			errs.add("delete TUN default route", err)
+			continue
+		}
+		veilnet.Logger.Sugar().Infof("Deleted TUN default route")
+	}
+
+	// Put the original default route back without the fallback hopcount, unless the host network moved on
+	switch {
+	case len(remaining) == 0:
+		if _, err := runCommand("route", "-n", "add", "default", c.gateway); err != nil {
+			errs.add("restore host default route via "+c.gateway+", the host may be offline", err)
+			break
+		}
+		veilnet.Logger.Sugar().Infof("Restored host default route via %s", c.gateway)
+	case len(remaining) == 1 && remaining[0].gateway == c.gateway:
+		if _, err := runCommand("route", "-n", "change", "default", c.gateway, "-hopcount", "0"); err != nil {
+			errs.add("reset the hopcount of the host default route", err)
+			break
+		}
+		veilnet.Logger.Sugar().Infof("Restored host default route via %s", c.gateway)
+	case len(remaining) == 1:
+		veilnet.Logger.Sugar().Infof("Host default route now goes via %s, leaving it in place", remaining[0].gateway)
+	}
+
+	// Verify a single default route is left outside the tunnel
+	c.verifyDefaultRoute()
+	return errs.err()
+}
+
+// verifyDefaultRoute logs whether the routing table has exactly one default route outside the tunnel
+func (c *conflux) verifyDefaultRoute() {
+	routes, err := defaultRoutes()
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("Failed to verify the default route: %v", err)
+		return
+	}
+	switch {
+	case len(routes) == 0:
+		veilnet.Logger.Sugar().Warnf("No default route is left, the host is offline until its network adds one")
+	case len(routes) > 1:
+		veilnet.Logger.Sugar().Warnf("%d default routes are left, check them with: netstat -rn -f inet", len(routes))
+	case routes[0].netif == c.opts.Interface:
+		veilnet.Logger.Sugar().Warnf("The default route still goes through %s, remove it with: route -n delete default -interface %s", c.opts.Interface, c.opts.Interface)
+	}
+}
+
 // convertNetmask converts CIDR notation to dotted decimal notation
 func (c *conflux) convertNetmask(cidr string) string {
 	switch cidr {
@@ -339,31 +649,26 @@ func (c *conflux) convertNetmask(cidr string) string {
 }
 
 // CleanHostConfiguraions removes the iptables FORWARD rules and NAT rule for the TUN interface
-// It also disables IP forwarding if it was not enabled
-func (c *conflux) CleanHostConfiguraions() {
+// It also disables IP forwarding if it was not enabled, returning a CleanupError listing the steps that failed
+func (c *conflux) CleanHostConfiguraions() error {
+	var errs cleanupErrors
+
+	// Remove the extra addresses
+	for _, addr := range c.extraAddrs {
+		_, err := runCommand("ifconfig", c.opts.Interface, "inet", addr.IP.String(), "-alias")
+		errs.add("remove extra address "+addr.String(), err)
+	}
+
+	// Restore the DNS settings
+	errs.merge(c.revertDNS())
 
 	// Remove the route to the Veil Master
 	veilHost := c.anchor.GetVeilHost()
 	if veilHost != "" {
-		cmd := exec.Command("route", "-n", "del", veilHost, c.gateway)
-		cmd.Run()
+		runCommand("route", "-n", "del", veilHost, c.gateway)
 	}
 
-	// Delete the route through the TUN interface
-	if err := exec.Command("route", "-n", "delete", "default", "-interface", "veilnet").Run(); err != nil {
-		veilnet.Logger.Sugar().Errorf("Failed to delete TUN default route: %v", err)
-	}
-	veilnet.Logger.Sugar().Infof("Deleted TUN default route")
-
-	// Delete the altered default route
-	if err := exec.Command("route", "-n", "delete", "default").Run(); err != nil {
-		veilnet.Logger.Sugar().Errorf("Failed to delete altered default route: %v", err)
-	}
-	veilnet.Logger.Sugar().Infof("Deleted altered default route")
-
 	// Restore the original host default route
-	if err := exec.Command("route", "-n", "add", "default", c.gateway).Run(); err != nil {
-		veilnet.Logger.Sugar().Errorf("Failed to restore host default route: %v", err)
-	}
-	veilnet.Logger.Sugar().Infof("Restored host default route")
+	errs.merge(c.restoreDefaultRoute())
+	return errs.err()
 }
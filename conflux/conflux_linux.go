@@ -4,43 +4,128 @@
 package conflux
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/veil-net/veilnet"
+	"golang.org/x/sys/unix"
 	tun "golang.zx2c4.com/wireguard/tun"
 )
 
+const (
+	// virtioNetHdrLen is the size of the virtio header the TUN prepends when offloads are enabled
+	virtioNetHdrLen = 10
+
+	// routeProto tags the routes installed by the conflux, 86 is "V" in ASCII
+	routeProto = "86"
+)
+
 type conflux struct {
-	anchor           *veilnet.Anchor
+	opts             Options
+	anchor           Anchor
 	device           tun.Device
 	portal           bool
 	gateway          string
 	iface            string
+	cidr             string
+	extraAddrs       []*net.IPNet
 	bypassRoutes     sync.Map
+	defaultChanges   []ManagedRoute
+	session          session
 	ipForwardEnabled bool
+	ipForwardSet     bool
+	forwardApplied   bool
+	natApplied       bool
+	firewallBackend  string
+	forwardChain     string
+	defaultRemoved   bool
+	defaultMetric    string
+	nexthops         []nexthop
+	shapingApplied   bool
+	dscpApplied      bool
+	prevDisableIPv6  string
+	tunedSysctls     []sysctlValue
+	dnsMethod        string
+	dnsApplied       bool
+	drainApplied     bool
+	socksListener    net.Listener
+	stopped          atomic.Bool
+	lost             chan struct{}
+	stalled          chan struct{}
+	failOnce         sync.Once
+	life             lifecycle
+	stopErr          atomic.Pointer[CleanupError]
+	lastEgress       atomic.Int64
+	lastIngress      atomic.Int64
+	ready            atomic.Bool
 
 	once sync.Once
 }
 
-func newConflux() *conflux {
-	return &conflux{}
+func newConflux(opts Options) *conflux {
+	c := &conflux{opts: opts, lost: make(chan struct{}), stalled: make(chan struct{})}
+	registerSession(opts.Interface, &c.session)
+	return c
 }
 
-func (c *conflux) Start(apiBaseURL, anchorToken string, portal bool) error {
+// start runs the startup of Start, rolling back what it applied if it fails
+func (c *conflux) start(ctx context.Context, apiBaseURL, anchorToken string, portal bool) error {
+
+	// Use the userspace network stack instead of a TUN
+	if c.opts.Userspace {
+		return c.startUserspace(ctx, apiBaseURL, anchorToken, portal)
+	}
+
+	// Time the startup phases
+	timer := newStartTimer()
 
 	// Set portal
 	c.portal = portal
 
+	// Pick how the DNS settings are applied
+	err := c.resolveDNSMethod()
+	if err != nil {
+		return err
+	}
+
+	// Check the host commands used to configure the host are available
+	err = c.CheckBinaries()
+	if err != nil {
+		return err
+	}
+
+	// Check the routing table is free for the conflux
+	err = c.checkRouteTable()
+	if err != nil {
+		return err
+	}
+
 	// Get the default gateway and interface
-	err := c.DetectHostGateway()
+	err = c.waitGateway(ctx)
 	if err != nil {
 		return err
 	}
+	timer.phase("detect")
+
+	// Create the anchor
+	c.anchor = newAnchor()
+
+	// Start the anchor before touching the host so a rejected token leaves no routes or TUN behind
+	err = c.StartAnchor(ctx, apiBaseURL, anchorToken, portal)
+	if err != nil {
+		c.rollback()
+		return err
+	}
+	c.session.connected()
+	timer.phase("anchor")
 
 	// Set bypass routes
 	c.AddBypassRoutes()
@@ -48,91 +133,291 @@ func (c *conflux) Start(apiBaseURL, anchorToken string, portal bool) error {
 	// Create the TUN device
 	err = c.CreateTUN()
 	if err != nil {
+		c.rollback()
 		return err
 	}
 
-	// Create the anchor
-	c.anchor = veilnet.NewAnchor()
+	// Get the CIDR
+	cidr, err := c.anchor.GetCIDR()
+	if err != nil {
+		c.rollback()
+		return err
+	}
 
-	// Start the anchor
-	err = c.StartAnchor(apiBaseURL, anchorToken, portal)
+	// Accept a bare IP as a host address
+	cidr, err = normalizeCIDR(cidr)
 	if err != nil {
+		c.rollback()
 		return err
 	}
+	c.cidr = cidr
 
-	// Get the CIDR
-	cidr, err := c.anchor.GetCIDR()
+	// Check the extra addresses do not conflict with the CIDR
+	c.extraAddrs, err = parseExtraAddresses(cidr, c.opts.ExtraAddresses)
+	if err != nil {
+		c.rollback()
+		return err
+	}
+
+	// Check the CIDR does not overlap the host network or the bypass hosts
+	err = c.checkOverlaps(cidr)
 	if err != nil {
+		c.rollback()
 		return err
 	}
 
+	// Pin the DNS servers to the host gateway, once the CIDR they may lie in is known
+	c.AddDNSBypassRoutes(cidr)
+
+	// Check the peer address fits the CIDR
+	if c.opts.Peer != "" {
+		err = checkPeer(cidr, c.opts.Peer)
+		if err != nil {
+			c.rollback()
+			return err
+		}
+	}
+
 	// Split CIDR into IP and netmask
 	parts := strings.Split(cidr, "/")
 	if len(parts) != 2 {
+		c.rollback()
 		return fmt.Errorf("invalid CIDR format: %s", cidr)
 	}
 	ip := parts[0]
 	netmask := parts[1]
 
-	// Configure the host
+	// Configure the host, cleaning whatever was applied if it fails
+	timer.phase("cidr")
+	c.auditRoutes("before host configuration")
 	err = c.ConfigHost(ip, netmask)
 	if err != nil {
+		c.CleanHostConfiguraions()
+		c.rollback()
 		return err
 	}
 
-	// Start the ingress and egress threads
+	// Make sure the interface has the MTU the packet loops use
+	c.checkMTU(true)
+
+	// Run the up script
+	c.runUpScript()
+
+	// Let the packet loops write to the TUN and start them
+	c.ready.Store(true)
 	go c.ingress()
 	go c.egress()
 
-	// Check if the anchor is alive and if not, stop the conflux and exit
-	go func() {
-		<-c.anchor.Ctx.Done()
-		veilnet.Logger.Sugar().Info("Anchor stopped")
-		c.Stop()
-		os.Exit(1)
-	}()
+	// Log a periodic traffic summary
+	go c.logStats(c.opts.StatsInterval)
+
+	// Watch the anchor and handle it going down
+	go c.watchAnchor()
+
+	// Restart the conflux if the egress loop wedges
+	go c.watchEgress(c.opts.EgressStallTimeout)
+
+	// Set the MTU back if the interface loses it
+	go c.watchMTU()
+
+	// Add the portal firewall rules back if a firewall reload removes them
+	go c.watchFirewall()
+
+	// Log how long the startup took
+	timer.phase("config")
+	timer.report(c.opts.Interface)
 
 	return nil
 }
 
-func (c *conflux) Stop() {
+// stop runs the cleanup of Stop once, later calls wait for it and return its result
+func (c *conflux) stop() error {
 	c.once.Do(func() {
+		c.stopped.Store(true)
+		if c.opts.Userspace {
+			c.stopUserspace()
+			return
+		}
+		var errs cleanupErrors
+		c.drain()
+		c.ready.Store(false)
 		if c.anchor != nil {
 			c.anchor.Stop()
 		}
-		c.CleanHostConfiguraions()
-		c.RemoveBypassRoutes()
+		c.session.disconnected()
+		c.runDownScript()
+		errs.merge(c.CleanHostConfiguraions())
+		c.auditRoutes("after host cleanup")
+		hosts := c.cleanupHosts()
+		errs.merge(c.RemoveBypassRoutes())
 		if c.device != nil {
-			c.device.Close()
+			c.keepInterface()
+			errs.add("close TUN device", c.device.Close())
+			if c.opts.KeepInterface {
+				runCommand("ip", "link", "set", "down", c.opts.Interface)
+				veilnet.Logger.Sugar().Infof("Kept VeilNet TUN interface, remove it with: ip link del %s", c.opts.Interface)
+			}
 		}
+		errs.merge(c.verifyCleanup(hosts))
+		c.stopErr.Store(errs.cleanupError())
 	})
+	return c.stopResult()
 }
 
-func (c *conflux) StartAnchor(apiBaseURL, anchorToken string, portal bool) error {
-
-	// Start the anchor
-	err := c.anchor.Start(apiBaseURL, anchorToken, portal)
-	if err != nil {
-		return err
+// rollback undoes the steps of a Start that did not complete
+func (c *conflux) rollback() {
+	if c.anchor != nil {
+		c.anchor.Stop()
 	}
-
-	return nil
+	c.session.disconnected()
+	c.RemoveBypassRoutes()
+	c.CloseTUN()
 }
 
 func (c *conflux) StopAnchor() {
 	c.anchor.Stop()
 }
 
+// CreateTUN creates the TUN, trying the numbered names after the one asked for if it is taken and AutoIface is set
 func (c *conflux) CreateTUN() error {
+	return c.createTUNAuto(c.createTUN)
+}
+
+// createTUN creates the TUN named by opts.Interface, or attaches to a persistent one kept by an earlier run
+func (c *conflux) createTUN() error {
+
+	// A persistent TUN kept by an earlier run is attached to instead of created, any other interface is in the way
+	if _, err := net.InterfaceByName(c.opts.Interface); err == nil && c.opts.TUNFd == 0 {
+		if !isPersistentTUN(c.opts.Interface) {
+			hint := "pick another name with --interface"
+			if !c.opts.AutoIface {
+				hint += " or use --auto-iface"
+			}
+			return fmt.Errorf("interface %s already exists and is not a TUN kept with --keep-interface, %s", c.opts.Interface, hint)
+		}
+		veilnet.Logger.Sugar().Infof("Reusing the VeilNet TUN interface %s kept by an earlier run", c.opts.Interface)
+	}
+
 	var err error
-	c.device, err = tun.CreateTUN("veilnet", 1500)
+	if c.opts.TUNFd != 0 {
+		err = c.createTUNFromFd(tunMTU)
+		if err != nil {
+			return err
+		}
+	} else if c.opts.Offload == OffloadOff {
+		c.device, err = createTUNWithoutOffload(c.opts.Interface, tunMTU)
+	} else {
+		c.device, err = tun.CreateTUN(c.opts.Interface, tunMTU)
+	}
 	if err != nil {
 		veilnet.Logger.Sugar().Errorf("failed to create TUN device: %v", err)
 		return err
 	}
+
+	// The TUN only batches when the kernel accepted the checksum and segmentation offloads
+	if c.device.BatchSize() > 1 {
+		veilnet.Logger.Sugar().Infof("TUN offloads enabled: checksum, TSO, GRO")
+	} else if c.opts.Offload == OffloadOn {
+		c.device.Close()
+		c.device = nil
+		return fmt.Errorf("TUN offloads are not supported by this kernel")
+	} else {
+		veilnet.Logger.Sugar().Infof("TUN offloads disabled")
+	}
+
+	// Clear the persistence of a kept TUN so it is removed on exit as usual, an inherited TUN belongs to the parent
+	if !c.opts.KeepInterface && c.opts.TUNFd == 0 {
+		if err := c.setPersist(false); err != nil {
+			veilnet.Logger.Sugar().Warnf("failed to clear TUN persistence: %v", err)
+		}
+	}
 	return nil
 }
 
+// createTUNWithoutOffload creates a TUN without the virtio header, so the kernel hands over and expects plain packets
+// with no checksum offload, TSO, USO or GRO coalescing
+func createTUNWithoutOffload(name string, mtu int) (tun.Device, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	err = unix.SetNonblock(fd, true)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return tun.CreateTUNFromFile(os.NewFile(uintptr(fd), "/dev/net/tun"), mtu)
+}
+
+// keepInterface marks the TUN as persistent before it is closed if --keep-interface is set
+func (c *conflux) keepInterface() {
+	if !c.opts.KeepInterface {
+		return
+	}
+	if err := c.setPersist(true); err != nil {
+		veilnet.Logger.Sugar().Errorf("failed to keep VeilNet TUN interface: %v", err)
+	}
+}
+
+// sysClassNet is where the kernel lists the network interfaces
+var sysClassNet = "/sys/class/net"
+
+// isPersistentTUN reports whether the interface name is a TUN set to outlive its file descriptor
+func isPersistentTUN(name string) bool {
+	raw, err := os.ReadFile(filepath.Join(sysClassNet, name, "tun_flags"))
+	if err != nil {
+		return false
+	}
+	flags, err := strconv.ParseUint(strings.TrimSpace(string(raw)), 0, 32)
+	if err != nil {
+		return false
+	}
+	return flags&unix.IFF_TUN != 0 && flags&unix.IFF_PERSIST != 0
+}
+
+// setPersist sets whether the TUN outlives its file descriptor
+func (c *conflux) setPersist(persist bool) error {
+	value := 0
+	if persist {
+		value = 1
+	}
+
+	// Use the raw descriptor without switching the file to blocking mode
+	conn, err := c.device.File().SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ioctlErr error
+	err = conn.Control(func(fd uintptr) {
+		ioctlErr = unix.IoctlSetInt(int(fd), unix.TUNSETPERSIST, value)
+	})
+	if err != nil {
+		return err
+	}
+	return ioctlErr
+}
+
+// minTUNOffset is the headroom the TUN needs in front of each packet, room for the virtio header with offloads
+func (c *conflux) minTUNOffset() int {
+	if c.device.BatchSize() > 1 {
+		return virtioNetHdrLen
+	}
+	return 0
+}
+
 func (c *conflux) CloseTUN() error {
 	if c.device != nil {
 		err := c.device.Close()
@@ -144,19 +429,58 @@ func (c *conflux) CloseTUN() error {
 	return nil
 }
 
+func (c *conflux) CheckBinaries() error {
+	required := []string{"ip"}
+	if c.portal {
+		required = append(required, "iptables", "sysctl")
+	}
+	if c.portal && c.opts.FirewallBackend == FirewallBackendFirewalld {
+		required = append(required, "firewall-cmd")
+	}
+	if c.dnsMethod == DNSMethodSystemdResolved {
+		required = append(required, "resolvectl")
+	}
+	if c.dnsMethod == DNSMethodResolvconf {
+		required = append(required, "resolvconf")
+	}
+	if c.portal && c.opts.RateLimit != "" {
+		required = append(required, "tc")
+	}
+	if c.opts.DisableIPv6 {
+		required = append(required, "sysctl")
+	}
+	return checkBinaries(required, map[string]string{
+		"tc":           "install iproute2",
+		"ip":           "install iproute2",
+		"iptables":     "install iptables",
+		"firewall-cmd": "install firewalld",
+		"sysctl":       "install procps",
+		"resolvectl":   "requires systemd-resolved",
+		"resolvconf":   "install resolvconf or openresolv",
+	})
+}
+
 func (c *conflux) DetectHostGateway() error {
+	return c.waitGateway(context.Background())
+}
+
+// detectHostGateway looks up the host default gateway and interface once
+// A multipath default route is recorded with all of its nexthops so it can be restored as it was
+func (c *conflux) detectHostGateway() error {
 
 	// Get the host default gateway and interface
-	cmd := exec.Command("ip", "route", "show", "default")
-	out, err := cmd.Output()
+	out, err := runCommand("ip", "route", "show", "default")
 	if err != nil {
-		veilnet.Logger.Sugar().Errorf("Failed to get default route: %v", err)
-		return err
+		return fmt.Errorf("failed to get default route: %v", err)
 	}
 	lines := strings.Split(string(out), "\n")
-	var gateway, iface string
-	for _, line := range lines {
+	var gateway, iface, metric string
+	var nexthops []nexthop
+	exact := true
+	found := false
+	for i, line := range lines {
 		if strings.HasPrefix(line, "default") {
+			found = true
 			fields := strings.Fields(line)
 			for i := 0; i < len(fields); i++ {
 				if fields[i] == "via" && i+1 < len(fields) {
@@ -165,119 +489,239 @@ func (c *conflux) DetectHostGateway() error {
 				if fields[i] == "dev" && i+1 < len(fields) {
 					iface = fields[i+1]
 				}
+				if fields[i] == "metric" && i+1 < len(fields) {
+					metric = fields[i+1]
+				}
+			}
+
+			// A multipath route lists its nexthops on the indented lines that follow
+			for _, next := range lines[i+1:] {
+				fields := strings.Fields(next)
+				if len(fields) == 0 || fields[0] != "nexthop" {
+					break
+				}
+				hop, ok := parseNexthop(fields[1:])
+				if !ok {
+					exact = false
+				}
+				if hop.via != "" && hop.dev != "" {
+					nexthops = append(nexthops, hop)
+				}
 			}
 			break
 		}
 	}
 
-	// If the host default gateway or interface is not found, return an error
+	// Tell a missing default route from one that could not be parsed
+	if !found {
+		return errNoDefaultRoute
+	}
+	if gateway == "" && iface == "" && len(nexthops) > 0 {
+		gateway = nexthops[0].via
+		iface = nexthops[0].dev
+	}
 	if gateway == "" || iface == "" {
-		veilnet.Logger.Sugar().Errorf("Host default gateway or interface not found")
-		return fmt.Errorf("host default gateway or interface not found")
+		return gatewayParseError("ip route show default", "the default route has no gateway or interface", out)
 	}
 
 	// Store the host default gateway and interface
-	veilnet.Logger.Sugar().Infof("Found Host Default gateway: %s via interface %s", gateway, iface)
 	c.gateway = gateway
 	c.iface = iface
+	c.defaultMetric = metric
+	c.nexthops = nil
+	if len(nexthops) > 1 {
+		c.nexthops = nexthops
+		veilnet.Logger.Sugar().Infof("Found Host multipath default route %s, using %s via interface %s for bypass routes", c.hostDefaultString(), gateway, iface)
+		if !exact {
+			veilnet.Logger.Sugar().Warnf("The host multipath default route has nexthop settings that are not restored, check it after the conflux stops")
+		}
+		return nil
+	}
+	veilnet.Logger.Sugar().Infof("Found Host Default gateway: %s via interface %s", gateway, iface)
 	return nil
 }
 
-func (c *conflux) AddBypassRoutes() {
-	hosts := []string{"stun.cloudflare.com", "turn.cloudflare.com", "guardian.veilnet.org", "turn.veilnet.org"}
-
-	for _, host := range hosts {
-		// Resolve IP addresses
-		ips, err := net.LookupIP(host)
-		if err != nil {
-			veilnet.Logger.Sugar().Errorf("Failed to resolve %s: %v", host, err)
-			continue
-		}
+// nexthop is one path of a multipath default route
+type nexthop struct {
+	via    string
+	dev    string
+	weight string
+}
 
-		for _, ip := range ips {
-			// Add route for IPv4 addresses
-			if ip4 := ip.To4(); ip4 != nil {
-				dest := ip4.String()
-				cmd := exec.Command("ip", "route", "add", dest, "via", c.gateway, "dev", c.iface)
-				cmd.Run()
-				// Store the bypass route
-				c.bypassRoutes.Store(host, dest)
+// parseNexthop parses the fields of an ip route nexthop line after the nexthop keyword
+// It reports false if the nexthop has settings other than its gateway, interface and weight
+func parseNexthop(fields []string) (nexthop, bool) {
+	var hop nexthop
+	ok := true
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "via", "dev", "weight":
+			if i+1 >= len(fields) {
+				return hop, false
 			}
+			switch fields[i] {
+			case "via":
+				hop.via = fields[i+1]
+			case "dev":
+				hop.dev = fields[i+1]
+			case "weight":
+				hop.weight = fields[i+1]
+			}
+			i++
+		case "dead", "linkdown":
+			// State flags set by the kernel, not part of the route
+		default:
+			ok = false
 		}
 	}
+	return hop, ok && hop.via != "" && hop.dev != ""
 }
 
-func (c *conflux) RemoveBypassRoutes() {
-	c.bypassRoutes.Range(func(key, value interface{}) bool {
-		// Remove bypass route
-		cmd := exec.Command("ip", "route", "del", value.(string))
-		err := cmd.Run()
-		if err != nil {
-			veilnet.Logger.Sugar().Errorf("Failed to clear bypass route for %s: %v", key, err)
-			return false
+// hostDefaultRoute returns the ip arguments to run verb on the host default route, with args placed before the nexthops
+func (c *conflux) hostDefaultRoute(verb string, args ...string) []string {
+	route := append([]string{"route", verb, "default"}, args...)
+	if len(c.nexthops) == 0 {
+		return append(route, "via", c.gateway, "dev", c.iface)
+	}
+	for _, hop := range c.nexthops {
+		route = append(route, "nexthop", "via", hop.via, "dev", hop.dev)
+		if hop.weight != "" {
+			route = append(route, "weight", hop.weight)
 		}
-		return true
-	})
-}
-
-func (c *conflux) Read(bufs [][]byte, batchSize int) int {
-	return c.anchor.Read(bufs, batchSize)
+	}
+	return route
 }
 
-func (c *conflux) Write(bufs [][]byte, sizes []int) int {
-	return c.anchor.Write(bufs, sizes)
+// hostDefaultString describes the host default route for the logs
+func (c *conflux) hostDefaultString() string {
+	if len(c.nexthops) == 0 {
+		return fmt.Sprintf("via %s on %s", c.gateway, c.iface)
+	}
+	hops := make([]string, len(c.nexthops))
+	for i, hop := range c.nexthops {
+		hops[i] = fmt.Sprintf("%s on %s", hop.via, hop.dev)
+	}
+	return "via " + strings.Join(hops, ", ")
 }
 
-func (c *conflux) ingress() {
-	bufs := make([][]byte, c.device.BatchSize())
-	for {
-		select {
-		case <-c.anchor.Ctx.Done():
-			veilnet.Logger.Sugar().Info("Portal ingress stopped")
-			return
-		default:
-			n := c.Read(bufs, c.device.BatchSize())
-			for i := 0; i < n; i++ {
-				newBuf := make([]byte, 16+len(bufs[i]))
-				copy(newBuf[16:], bufs[i])
-				bufs[i] = newBuf
-			}
-			if n > 0 {
-				c.device.Write(bufs[:n], 16)
+// otherDefaultMetrics returns the metrics of the IPv4 default routes of other tunnels, leaving out the host gateway
+func (c *conflux) otherDefaultMetrics() []int {
+	out, err := runCommand("ip", "-4", "route", "show", "default")
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("Failed to list the default routes, ignoring other tunnels: %v", err)
+		return nil
+	}
+	var metrics []int
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "default" {
+			continue
+		}
+		var via, dev string
+		metric := 0
+		for i := 1; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "via":
+				via = fields[i+1]
+			case "dev":
+				dev = fields[i+1]
+			case "metric":
+				metric, _ = strconv.Atoi(fields[i+1])
 			}
 		}
+		if dev == c.opts.Interface || (via == c.gateway && dev == c.iface) {
+			continue
+		}
+
+		// Only the host multipath route has neither, its nexthops are on the lines that follow
+		if via == "" && dev == "" && len(c.nexthops) > 0 {
+			continue
+		}
+		metrics = append(metrics, metric)
 	}
+	return metrics
 }
 
-func (c *conflux) egress() {
-	bufs := make([][]byte, c.device.BatchSize())
-	sizes := make([]int, c.device.BatchSize())
-	mtu, err := c.device.MTU()
-	if err != nil {
-		veilnet.Logger.Sugar().Errorf("failed to get TUN MTU: %v", err)
-		// Use default MTU if we can't get the actual one
-		mtu = 1500
+// flushAddresses removes all addresses from dev, an interface without addresses is not an error
+func flushAddresses(dev string) error {
+	out, err := runCommand("ip", "addr", "flush", "dev", dev)
+	if err == nil || strings.Contains(out, "Nothing to flush") {
+		return nil
 	}
-	// Pre-allocate buffers
-	for i := range bufs {
-		bufs[i] = make([]byte, mtu)
+
+	// Some environments fail to flush an interface that has nothing to flush
+	addrs, showErr := runCommand("ip", "-o", "addr", "show", "dev", dev)
+	if showErr == nil && addrs == "" {
+		return nil
 	}
+	return err
+}
 
-	for {
-		select {
-		case <-c.anchor.Ctx.Done():
-			veilnet.Logger.Sugar().Info("Portal egress stopped")
-			return
-		default:
-			n, err := c.device.Read(bufs, sizes, 0)
-			if err != nil {
-				continue
-			}
-			if n > 0 {
-				c.Write(bufs[:n], sizes[:n])
+// specificRoute returns the route to dest if it is more specific than the default route and not through the TUN
+func (c *conflux) specificRoute(dest string) string {
+	out, err := runCommand("ip", "-4", "route", "show", "match", dest)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == "default" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(fields[0])
+		if err != nil || !isSpecificRoute(prefix) {
+			continue
+		}
+		dev := ""
+		for i := 1; i+1 < len(fields); i++ {
+			if fields[i] == "dev" {
+				dev = fields[i+1]
 			}
 		}
+		if dev == c.opts.Interface {
+			continue
+		}
+		return strings.TrimSpace(line)
+	}
+	return ""
+}
+
+// hasHostRoute reports whether a host route to dest is in the routing table
+func (c *conflux) hasHostRoute(dest string) bool {
+	out, err := runCommand("ip", "route", "show", dest+"/32")
+	return err == nil && out != ""
+}
+
+// adoptHostRoute reports whether the host route to dest is tagged as the conflux's, left by a run that did not clean
+// up. Such a route is pointed at the current host gateway, which may have changed since
+func (c *conflux) adoptHostRoute(dest string) bool {
+	out, err := runCommand("ip", "route", "show", dest+"/32", "proto", routeProto)
+	if err != nil || out == "" {
+		return false
+	}
+	if strings.Contains(out, "via "+c.gateway+" dev "+c.iface) {
+		return true
 	}
+	if _, err := runCommand("ip", "route", "replace", dest, "via", c.gateway, "dev", c.iface, "proto", routeProto); err != nil {
+		veilnet.Logger.Sugar().Warnf("Failed to point the stale route to %s at the host gateway: %v", dest, err)
+		return false
+	}
+	return true
+}
+
+// addHostRoute adds a host route to dest via the host gateway
+func (c *conflux) addHostRoute(dest string) error {
+	out, err := runCommand("ip", "route", "add", dest, "via", c.gateway, "dev", c.iface, "proto", routeProto)
+	if err != nil && strings.Contains(out, "File exists") {
+		return errRouteExists
+	}
+	return err
+}
+
+// delHostRoute removes the host route to dest added by addHostRoute
+func (c *conflux) delHostRoute(dest string) error {
+	_, err := runCommand("ip", "route", "del", dest, "proto", routeProto)
+	return err
 }
 
 // ConfigHost configures the TUN interface with the given IP address and netmask
@@ -288,59 +732,93 @@ func (c *conflux) ConfigHost(ip, netmask string) error {
 	// Add bypass route for Veil Master
 	veilHost := c.anchor.GetVeilHost()
 	if veilHost != "" {
-		cmd := exec.Command("ip", "route", "add", veilHost, "via", c.gateway, "dev", c.iface)
-		cmd.Run()
+		runCommand("ip", "route", "add", veilHost, "via", c.gateway, "dev", c.iface, "proto", routeProto)
+	}
+
+	// Keep the kernel from autoconfiguring IPv6 on the IPv4-only TUN
+	if c.opts.DisableIPv6 {
+		c.disableIPv6()
 	}
 
 	// Flush existing IPs first
-	cmd := exec.Command("ip", "addr", "flush", "dev", "veilnet")
-	if err := cmd.Run(); err != nil {
+	if err := flushAddresses(c.opts.Interface); err != nil {
 		veilnet.Logger.Sugar().Errorf("failed to clear existing IPs: %v", err)
 		return err
 	}
 
-	// Set the IP address
-	cmd = exec.Command("ip", "addr", "add", fmt.Sprintf("%s/%s", ip, netmask), "dev", "veilnet")
-	if err := cmd.Run(); err != nil {
+	// Set the IP address, with the peer taking the prefix if there is one
+	args := []string{"addr", "add", fmt.Sprintf("%s/%s", ip, netmask), "dev", c.opts.Interface}
+	if c.opts.Peer != "" {
+		args = []string{"addr", "add", ip, "peer", fmt.Sprintf("%s/%s", c.opts.Peer, netmask), "dev", c.opts.Interface}
+	}
+	if _, err := runCommand("ip", args...); err != nil {
 		veilnet.Logger.Sugar().Errorf("failed to set IP address: %v", err)
 		return err
 	}
-	veilnet.Logger.Sugar().Infof("VeilNet TUN IP address set to %s", ip)
+	if c.opts.Peer != "" {
+		veilnet.Logger.Sugar().Infof("VeilNet TUN IP address set to %s with peer %s", ip, c.opts.Peer)
+	} else {
+		veilnet.Logger.Sugar().Infof("VeilNet TUN IP address set to %s", ip)
+	}
+
+	// Set the extra addresses
+	for _, addr := range c.extraAddrs {
+		if _, err := runCommand("ip", "addr", "add", addr.String(), "dev", c.opts.Interface); err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to add extra address %s: %v", addr, err)
+			return err
+		}
+		veilnet.Logger.Sugar().Infof("Added extra address %s to VeilNet TUN", addr)
+	}
 
 	// Set the interface up
-	cmd = exec.Command("ip", "link", "set", "up", "veilnet")
-	if err := cmd.Run(); err != nil {
+	if _, err := runCommand("ip", "link", "set", "up", c.opts.Interface); err != nil {
 		veilnet.Logger.Sugar().Errorf("failed to set interface up: %v", err)
 		return err
 	}
 	veilnet.Logger.Sugar().Infof("VeilNet TUN interface set to up")
 
+	// Wait for the link to be operational before adding routes
+	if err := waitInterfaceUp(c.opts.Interface, c.opts.InterfaceUpTimeout); err != nil {
+		veilnet.Logger.Sugar().Errorf("%v", err)
+		return err
+	}
+
+	// Apply the DNS settings
+	if err := c.applyDNS(); err != nil {
+		return err
+	}
+
 	if c.portal {
 
-		// Set iptables FORWARD
-		cmd = exec.Command("iptables", "-A", "FORWARD", "-i", "veilnet", "-j", "ACCEPT")
-		if err := cmd.Run(); err != nil {
-			veilnet.Logger.Sugar().Errorf("failed to set inbound iptables FORWARD rules: %v", err)
+		// Pick the firewall backend, firewalld or iptables, and the chain to use alongside Docker
+		c.detectFirewall()
+
+		// Set FORWARD
+		if err := c.addFirewallRule(c.forwardRule("-i")); err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to set inbound FORWARD rules: %v", err)
 			return err
 		}
-		cmd = exec.Command("iptables", "-A", "FORWARD", "-o", "veilnet", "-j", "ACCEPT")
-		if err := cmd.Run(); err != nil {
-			veilnet.Logger.Sugar().Errorf("failed to set outbound iptables FORWARD rules: %v", err)
+		c.forwardApplied = true
+		if err := c.addFirewallRule(c.forwardRule("-o")); err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to set outbound FORWARD rules: %v", err)
 			return err
 		}
-		veilnet.Logger.Sugar().Infof("Updated iptables FORWARD rules for VeilNet TUN")
+		veilnet.Logger.Sugar().Infof("Updated %s FORWARD rules for VeilNet TUN", c.firewallBackend)
 
-		// Set up NAT
-		cmd = exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING", "-o", c.iface, "-j", "MASQUERADE")
-		if err := cmd.Run(); err != nil {
-			veilnet.Logger.Sugar().Errorf("failed to set NAT rules: %v", err)
-			return err
+		// Set up NAT, forwarding without NAT is valid when the upstream routes the portal subnet
+		if err := c.addFirewallRule(c.natRule()); err != nil {
+			if c.opts.RequireNAT {
+				veilnet.Logger.Sugar().Errorf("failed to set NAT rules: %v", err)
+				return err
+			}
+			veilnet.Logger.Sugar().Warnf("failed to set NAT rules, continuing without NAT: %v", err)
+		} else {
+			c.natApplied = true
+			veilnet.Logger.Sugar().Infof("Set up NAT for VeilNet TUN")
 		}
-		veilnet.Logger.Sugar().Infof("Set up NAT for VeilNet TUN")
 
 		// Check if IP forwarding is already enabled
-		cmd = exec.Command("sysctl", "-n", "net.ipv4.ip_forward")
-		output, err := cmd.Output()
+		output, err := runCommand("sysctl", "-n", "net.ipv4.ip_forward")
 		if err != nil {
 			veilnet.Logger.Sugar().Errorf("failed to check IP forwarding status: %v", err)
 			return err
@@ -351,96 +829,238 @@ func (c *conflux) ConfigHost(ip, netmask string) error {
 
 		if !c.ipForwardEnabled {
 			// Enable IP forwarding
-			cmd = exec.Command("sysctl", "-w", "net.ipv4.ip_forward=1")
-			if err := cmd.Run(); err != nil {
+			if _, err := runCommand("sysctl", "-w", "net.ipv4.ip_forward=1"); err != nil {
 				veilnet.Logger.Sugar().Errorf("failed to enable IP forwarding: %v", err)
 				return err
 			}
+			c.ipForwardSet = true
 			veilnet.Logger.Sugar().Infof("IP forwarding enabled")
 		} else {
 			veilnet.Logger.Sugar().Infof("IP forwarding already enabled")
 		}
+
+		// Relax reverse path filtering and turn off ICMP redirects
+		if c.opts.TuneForwarding {
+			c.tuneForwarding()
+		}
+
+		// Mark the forwarded packets for QoS
+		if err := c.applyForwardDSCP(); err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to set DSCP marking rule: %v", err)
+			return err
+		}
+
+		// Cap the portal bandwidth
+		if c.opts.RateLimit != "" {
+			if err := c.applyShaping(); err != nil {
+				veilnet.Logger.Sugar().Errorf("failed to set rate limit: %v", err)
+				return err
+			}
+		}
 	} else {
+		// Pick the metric of the TUN default route relative to the default routes of other tunnels
+		metric, err := priorityMetric(c.opts.Priority, c.otherDefaultMetrics(), 0, 0)
+		if err != nil {
+			return err
+		}
+		fallbackMetric := max(50, metric+1)
+
 		// Delete the default route
-		if err := exec.Command("ip", "route", "del", "default", "via", c.gateway, "dev", c.iface).Run(); err != nil {
+		if _, err := runCommand("ip", c.hostDefaultRoute("del")...); err != nil {
 			veilnet.Logger.Sugar().Errorf("Failed to delete default route: %v", err)
 			return err
 		}
+		c.defaultRemoved = true
 
-		// Add the default route with high metric
-		if err := exec.Command("ip", "route", "add", "default", "via", c.gateway, "dev", c.iface, "metric", "50").Run(); err != nil {
-			veilnet.Logger.Sugar().Errorf("Failed to add default route: %v", err)
-			return err
+		if c.opts.Fallback {
+			// Add the default route with high metric so it is kept as a fallback
+			if _, err := runCommand("ip", c.hostDefaultRoute("add", "metric", strconv.Itoa(fallbackMetric), "proto", routeProto)...); err != nil {
+				veilnet.Logger.Sugar().Errorf("Failed to add default route: %v", err)
+				return err
+			}
+			veilnet.Logger.Sugar().Infof("Altered host default route %s with metric %d", c.hostDefaultString(), fallbackMetric)
+			c.defaultChanges = append(c.defaultChanges, ManagedRoute{Kind: routeKindHostDefault, Destination: "0.0.0.0/0", Gateway: c.gateway, Interface: c.iface, Metric: fallbackMetric, Change: routeFallback})
+		} else {
+			veilnet.Logger.Sugar().Infof("Removed host default route %s", c.hostDefaultString())
+			c.defaultChanges = append(c.defaultChanges, ManagedRoute{Kind: routeKindHostDefault, Destination: "0.0.0.0/0", Gateway: c.gateway, Interface: c.iface, Change: routeRemoved})
 		}
-		veilnet.Logger.Sugar().Infof("Altered host default route via %s on %s with metric 50", c.gateway, c.iface)
 
 		// Set the TUN interface as the default route
-		if err := exec.Command("ip", "route", "add", "default", "dev", "veilnet").Run(); err != nil {
+		route := []string{"route", "add", "default", "dev", c.opts.Interface, "metric", strconv.Itoa(metric), "proto", routeProto}
+		if c.opts.Peer != "" {
+			route = append(route, "via", c.opts.Peer)
+		}
+		if _, err := runCommand("ip", route...); err != nil {
 			veilnet.Logger.Sugar().Errorf("Failed to set default route: %v", err)
 			return err
 		}
-		veilnet.Logger.Sugar().Infof("Set veilnet as default route")
+		veilnet.Logger.Sugar().Infof("Set veilnet as default route with metric %d", metric)
+		c.defaultChanges = append(c.defaultChanges, ManagedRoute{Kind: routeKindDefault, Destination: "0.0.0.0/0", Gateway: c.opts.Peer, Interface: c.opts.Interface, Metric: metric, Change: routeAdded})
 	}
 
 	return nil
 }
 
 // CleanHostConfiguraions removes the iptables FORWARD rules and NAT rule for the TUN interface
-// It also disables IP forwarding if it was not enabled
-func (c *conflux) CleanHostConfiguraions() {
+// It also disables IP forwarding if it was not enabled, returning a CleanupError listing the steps that failed
+func (c *conflux) CleanHostConfiguraions() error {
+	var errs cleanupErrors
+
+	// Remove the extra addresses
+	for _, addr := range c.extraAddrs {
+		_, err := runCommand("ip", "addr", "del", addr.String(), "dev", c.opts.Interface)
+		errs.add("remove extra address "+addr.String(), err)
+	}
+
+	// Revert the DNS settings
+	errs.merge(c.revertDNS())
+
+	// Restore IPv6 on the TUN
+	if c.prevDisableIPv6 != "" {
+		if _, err := runCommand("sysctl", "-w", c.ipv6Sysctl()+"="+c.prevDisableIPv6); err != nil {
+			errs.add("restore IPv6 on VeilNet TUN", err)
+		} else {
+			c.prevDisableIPv6 = ""
+			veilnet.Logger.Sugar().Infof("Restored IPv6 on VeilNet TUN")
+		}
+	}
 
 	// Remove the route to the Veil Master
 	veilHost := c.anchor.GetVeilHost()
 	if veilHost != "" {
-		cmd := exec.Command("ip", "route", "del", veilHost, "via", c.gateway, "dev", c.iface)
-		cmd.Run()
+		runCommand("ip", "route", "del", veilHost, "via", c.gateway, "dev", c.iface, "proto", routeProto)
 	}
 
 	if c.portal {
 
-		// Remove iptables FORWARD rules
-		cmd := exec.Command("iptables", "-D", "FORWARD", "-i", "veilnet", "-j", "ACCEPT")
-		if err := cmd.Run(); err != nil {
-			veilnet.Logger.Sugar().Warnf("failed to remove inbound iptables FORWARD rule: %v", err)
-		}
-		cmd = exec.Command("iptables", "-D", "FORWARD", "-o", "veilnet", "-j", "ACCEPT")
-		if err := cmd.Run(); err != nil {
-			veilnet.Logger.Sugar().Warnf("failed to remove outbound iptables FORWARD rule: %v", err)
+		// Remove the drain rule
+		errs.add("remove drain rule", c.removeDrainRule())
+
+		// Remove FORWARD rules
+		if c.forwardApplied {
+			errs.add("remove inbound FORWARD rule", c.removeFirewallRule(c.forwardRule("-i")))
+			errs.add("remove outbound FORWARD rule", c.removeFirewallRule(c.forwardRule("-o")))
+			veilnet.Logger.Sugar().Infof("Removed inbound and outbound %s FORWARD rules", c.firewallBackend)
 		}
-		veilnet.Logger.Sugar().Infof("Removed inbound and outbound iptables FORWARD rules")
 
 		// Remove NAT rule
-		cmd = exec.Command("iptables", "-t", "nat", "-D", "POSTROUTING", "-o", c.iface, "-j", "MASQUERADE")
-		if err := cmd.Run(); err != nil {
-			veilnet.Logger.Sugar().Warnf("failed to remove NAT rule: %v", err)
+		if c.natApplied {
+			errs.add("remove NAT rule", c.removeFirewallRule(c.natRule()))
+			veilnet.Logger.Sugar().Infof("Removed NAT rule")
+		}
+
+		// Remove the DSCP marking
+		errs.add("remove DSCP marking rule", c.removeForwardDSCP())
+
+		// Remove the rate limit
+		if c.shapingApplied {
+			errs.merge(c.removeShaping())
 		}
-		veilnet.Logger.Sugar().Infof("Removed NAT rule")
+
+		// Restore the forwarding sysctls
+		errs.merge(c.restoreForwarding())
 
 		// Disable IP forwarding if it was not enabled
-		if !c.ipForwardEnabled {
-			cmd = exec.Command("sysctl", "-w", "net.ipv4.ip_forward=0")
-			if err := cmd.Run(); err != nil {
-				veilnet.Logger.Sugar().Warnf("failed to disable IP forwarding: %v", err)
-			}
+		if c.ipForwardSet {
+			_, err := runCommand("sysctl", "-w", "net.ipv4.ip_forward=0")
+			errs.add("disable IP forwarding", err)
 			veilnet.Logger.Sugar().Infof("Disabled IP forwarding")
 		}
-	} else {
+	} else if c.defaultRemoved {
 		// Remove veilnet TUN as default route
-		if err := exec.Command("ip", "route", "del", "default", "dev", "veilnet").Run(); err != nil {
-			veilnet.Logger.Sugar().Errorf("Failed to remove veilnet TUN as default route: %v", err)
-		}
+		_, err := runCommand("ip", "route", "del", "default", "dev", c.opts.Interface, "proto", routeProto)
+		errs.add("remove veilnet TUN as default route", err)
 		veilnet.Logger.Sugar().Infof("Removed veilnet TUN as default route")
 
 		// Delete the altered host default route
-		if err := exec.Command("ip", "route", "del", "default", "via", c.gateway, "dev", c.iface).Run(); err != nil {
-			veilnet.Logger.Sugar().Errorf("Failed to delete altered host default route: %v", err)
+		if c.opts.Fallback {
+			_, err := runCommand("ip", c.hostDefaultRoute("del", "proto", routeProto)...)
+			errs.add("delete altered host default route", err)
+			veilnet.Logger.Sugar().Infof("Removed altered host default route")
 		}
-		veilnet.Logger.Sugar().Infof("Removed altered host default route")
 
-		// Restore the host default route
-		if err := exec.Command("ip", "route", "add", "default", "via", c.gateway, "dev", c.iface).Run(); err != nil {
-			veilnet.Logger.Sugar().Errorf("Failed to restore default route on host: %v", err)
+		// Restore the host default route with its original metric
+		var args []string
+		if c.defaultMetric != "" {
+			args = []string{"metric", c.defaultMetric}
 		}
+		_, err = runCommand("ip", c.hostDefaultRoute("add", args...)...)
+		errs.add("restore default route on host", err)
 		veilnet.Logger.Sugar().Infof("Restored default route on host")
 	}
+	return errs.err()
+}
+
+// applyShaping caps the traffic through the veilnet interface in both directions
+// Traffic to VeilNet is shaped by a token bucket, traffic from VeilNet is policed on ingress
+func (c *conflux) applyShaping() error {
+	rate, err := parseRate(c.opts.RateLimit)
+	if err != nil {
+		return err
+	}
+
+	// Shape the traffic leaving through veilnet
+	_, err = runCommand("tc", "qdisc", "replace", "dev", c.opts.Interface, "root", "tbf", "rate", rate, "burst", "64kb", "latency", "50ms")
+	if err != nil {
+		return err
+	}
+	c.shapingApplied = true
+
+	// Police the traffic arriving from veilnet
+	_, err = runCommand("tc", "qdisc", "replace", "dev", c.opts.Interface, "handle", "ffff:", "ingress")
+	if err != nil {
+		return err
+	}
+	_, err = runCommand("tc", "filter", "replace", "dev", c.opts.Interface, "parent", "ffff:", "protocol", "all", "u32", "match", "u32", "0", "0", "police", "rate", rate, "burst", "64k", "drop", "flowid", ":1")
+	if err != nil {
+		return err
+	}
+
+	veilnet.Logger.Sugar().Infof("Limited VeilNet TUN to %s in each direction", rate)
+	return nil
+}
+
+// removeShaping removes the rate limit from the veilnet interface
+func (c *conflux) removeShaping() error {
+	var errs cleanupErrors
+	_, err := runCommand("tc", "qdisc", "del", "dev", c.opts.Interface, "root")
+	errs.add("remove rate limit", err)
+	_, err = runCommand("tc", "qdisc", "del", "dev", c.opts.Interface, "ingress")
+	errs.add("remove ingress rate limit", err)
+	veilnet.Logger.Sugar().Infof("Removed rate limit from VeilNet TUN")
+	return errs.err()
+}
+
+// ruleComment tags the iptables rules installed by the conflux
+func (c *conflux) ruleComment() string {
+	return interfaceRuleComment(c.opts.Interface)
+}
+
+// interfaceRuleComment is the comment the iptables rules of the conflux on iface are tagged with
+func interfaceRuleComment(iface string) string {
+	return "veilnet:" + iface
+}
+
+// ipv6Sysctl disables IPv6, and with it SLAAC and link-local addresses, on the TUN
+func (c *conflux) ipv6Sysctl() string {
+	return "net.ipv6.conf." + c.opts.Interface + ".disable_ipv6"
+}
+
+// disableIPv6 disables IPv6 on the TUN, keeping the previous value to restore on cleanup
+func (c *conflux) disableIPv6() {
+	prev, err := runCommand("sysctl", "-n", c.ipv6Sysctl())
+	if err != nil {
+		// The kernel has no IPv6 support, so there is nothing to autoconfigure
+		veilnet.Logger.Sugar().Infof("IPv6 is not available on VeilNet TUN, skipping")
+		return
+	}
+	if prev == "1" {
+		return
+	}
+	if _, err := runCommand("sysctl", "-w", c.ipv6Sysctl()+"=1"); err != nil {
+		veilnet.Logger.Sugar().Warnf("failed to disable IPv6 on VeilNet TUN: %v", err)
+		return
+	}
+	c.prevDisableIPv6 = prev
+	veilnet.Logger.Sugar().Infof("Disabled IPv6 autoconfiguration on VeilNet TUN")
 }
@@ -0,0 +1,250 @@
+package conflux
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// hostChanges returns the commands in ran that change the host, anything but a listing
+func hostChanges(ran []string) []string {
+	var changes []string
+	for _, line := range ran {
+		if !strings.Contains(line, " show") {
+			changes = append(changes, line)
+		}
+	}
+	return changes
+}
+
+func TestStartRejectedTokenLeavesHostAlone(t *testing.T) {
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("start checks ip is installed")
+	}
+	f := useFakeCommands(t)
+	f.set("ip route show default", "default via 192.168.1.1 dev eth0 proto dhcp metric 100", nil)
+	anchor := newMockAnchor()
+	anchor.startErr = errors.New("token rejected")
+	useMockAnchor(t, anchor)
+
+	c := newConflux(Options{Interface: "veilnet", DNSMethod: DNSMethodNone, Priority: PriorityHigh})
+	var beforeStart []string
+	tunBeforeStart := false
+	anchor.onStart = func() {
+		beforeStart = f.ran()
+		tunBeforeStart = c.device != nil
+	}
+
+	err := c.start(context.Background(), "https://guardian.example", "token", false)
+	if !errors.Is(err, anchor.startErr) {
+		t.Fatalf("start returned %v, want %v", err, anchor.startErr)
+	}
+	if !slices.Contains(anchor.called(), "Start") {
+		t.Fatal("start returned without starting the anchor")
+	}
+	if changes := hostChanges(beforeStart); len(changes) > 0 {
+		t.Errorf("ran %q before starting the anchor, want only listings", changes)
+	}
+	if tunBeforeStart {
+		t.Error("created the TUN before starting the anchor")
+	}
+	if changes := hostChanges(f.ran()); len(changes) > 0 {
+		t.Errorf("ran %q after the token was rejected, want the host left alone", changes)
+	}
+	if c.device != nil {
+		t.Error("created the TUN after the token was rejected")
+	}
+	if slices.Contains(anchor.called(), "GetCIDR") {
+		t.Error("asked the rejected anchor for a CIDR")
+	}
+}
+
+func TestFlushAddresses(t *testing.T) {
+	const (
+		flush = "ip addr flush dev veilnet"
+		show  = "ip -o addr show dev veilnet"
+	)
+	tests := []struct {
+		name    string
+		setup   func(f *fakeCommands)
+		wantErr bool
+		ran     []string
+	}{
+		{
+			name: "flushed",
+			ran:  []string{flush},
+		},
+		{
+			name:  "nothing to flush",
+			setup: func(f *fakeCommands) { f.fail(flush, "Nothing to flush.") },
+			ran:   []string{flush},
+		},
+		{
+			name:  "flush fails on an interface without addresses",
+			setup: func(f *fakeCommands) { f.fail(flush, "RTNETLINK answers: Operation not supported") },
+			ran:   []string{flush, show},
+		},
+		{
+			name: "flush fails with addresses left",
+			setup: func(f *fakeCommands) {
+				f.fail(flush, "RTNETLINK answers: Operation not permitted")
+				f.set(show, "5: veilnet    inet 10.128.0.5/16 scope global veilnet", nil)
+			},
+			wantErr: true,
+			ran:     []string{flush, show},
+		},
+		{
+			name: "flush and show fail",
+			setup: func(f *fakeCommands) {
+				f.fail(flush, "RTNETLINK answers: Operation not permitted")
+				f.fail(show, "Device \"veilnet\" does not exist.")
+			},
+			wantErr: true,
+			ran:     []string{flush, show},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakeCommands(t)
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			err := flushAddresses("veilnet")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("flushAddresses returned %v, want error %v", err, tt.wantErr)
+			}
+			if got := f.ran(); !slices.Equal(got, tt.ran) {
+				t.Errorf("ran %q, want %q", got, tt.ran)
+			}
+		})
+	}
+}
+
+func TestAddBypassRoute(t *testing.T) {
+	const (
+		dest     = "198.51.100.7"
+		tagged   = "ip route show 198.51.100.7/32 proto 86"
+		untagged = "ip route show 198.51.100.7/32"
+		add      = "ip route add 198.51.100.7 via 192.168.1.1 dev eth0 proto 86"
+	)
+	tests := []struct {
+		name    string
+		setup   func(f *fakeCommands)
+		adopted bool
+		ran     string
+		notRan  string
+	}{
+		{
+			name:    "new route",
+			adopted: true,
+			ran:     add,
+		},
+		{
+			name:    "stale route via the gateway",
+			setup:   func(f *fakeCommands) { f.set(tagged, dest+" via 192.168.1.1 dev eth0", nil) },
+			adopted: true,
+			notRan:  add,
+		},
+		{
+			name:    "stale route via an old gateway",
+			setup:   func(f *fakeCommands) { f.set(tagged, dest+" via 10.0.0.1 dev wlan0", nil) },
+			adopted: true,
+			ran:     "ip route replace 198.51.100.7 via 192.168.1.1 dev eth0 proto 86",
+		},
+		{
+			name:   "route of someone else",
+			setup:  func(f *fakeCommands) { f.set(untagged, dest+" via 10.0.0.1 dev wg0 proto static", nil) },
+			notRan: add,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakeCommands(t)
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			c := newConflux(Options{Interface: "veilnet"})
+			c.gateway = "192.168.1.1"
+			c.iface = "eth0"
+
+			c.addBypassRoute("relay", dest)
+			if _, ok := c.bypassRoutes.Load(dest); ok != tt.adopted {
+				t.Errorf("bypass route recorded %v, want %v", ok, tt.adopted)
+			}
+			if tt.ran != "" && !slices.Contains(f.ran(), tt.ran) {
+				t.Errorf("ran %q, want %q", f.ran(), tt.ran)
+			}
+			if tt.notRan != "" && slices.Contains(f.ran(), tt.notRan) {
+				t.Errorf("ran %q, want no %q", f.ran(), tt.notRan)
+			}
+		})
+	}
+}
+
+func TestRollbackEndsSession(t *testing.T) {
+	useFakeCommands(t)
+	c := newConflux(Options{Interface: "veilnet"})
+	c.anchor = newMockAnchor()
+	c.session.connected()
+
+	c.rollback()
+	if stats := c.session.stats(); stats.SessionUptime != 0 {
+		t.Errorf("session uptime %v after the rollback, want the session ended", stats.SessionUptime)
+	}
+}
+
+func TestIsPersistentTUN(t *testing.T) {
+	dir := t.TempDir()
+	prev := sysClassNet
+	sysClassNet = dir
+	t.Cleanup(func() { sysClassNet = prev })
+
+	links := map[string]string{
+		"kept":   "0x1801\n",
+		"owned":  "0x1001\n",
+		"tap":    "0x1802\n",
+		"broken": "none\n",
+	}
+	for name, flags := range links {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, "tun_flags"), []byte(flags), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "eth0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]bool{"kept": true, "owned": false, "tap": false, "broken": false, "eth0": false, "missing": false} {
+		if got := isPersistentTUN(name); got != want {
+			t.Errorf("isPersistentTUN(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestRoutesHostDestinations(t *testing.T) {
+	c := newConflux(Options{Interface: "veilnet"})
+	anchor := newMockAnchor()
+	anchor.veilHost = "203.0.113.7"
+	c.anchor = anchor
+	c.gateway = "192.168.1.1"
+	c.iface = "eth0"
+	c.bypassRoutes.Store("104.16.1.1", "guardian.veilnet.org")
+	c.life.set(stateRunning)
+
+	var got []string
+	for _, route := range c.Routes() {
+		got = append(got, route.Kind+" "+route.Destination)
+	}
+	want := []string{"bypass 104.16.1.1/32", "veil-master 203.0.113.7/32"}
+	if !slices.Equal(got, want) {
+		t.Errorf("routes %q, want %q", got, want)
+	}
+}
@@ -4,52 +4,101 @@
 package conflux
 
 import (
-	_ "embed"
+	"context"
+	"errors"
 	"fmt"
 	"net"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"net/netip"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/veil-net/veilnet"
 	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
 	tun "golang.zx2c4.com/wireguard/tun"
 )
 
-//go:embed wintun.dll
-var wintunDLL []byte
-
 type conflux struct {
-	anchor           *veilnet.Anchor
+	opts             Options
+	anchor           Anchor
 	device           tun.Device
 	portal           bool
 	gateway          string
 	iface            string
+	cidr             string
+	extraAddrs       []*net.IPNet
 	bypassRoutes     sync.Map
+	defaultChanges   []ManagedRoute
+	session          session
 	ipForwardEnabled bool
+	prevDNSSearch    []string
+	dnsSearchSet     bool
+	dohSet           bool
+	prevDoH          dohState
+	defaultRemoved   bool
+	adapterGUID      string
+	socksListener    net.Listener
+	stopped          atomic.Bool
+	lost             chan struct{}
+	stalled          chan struct{}
+	failOnce         sync.Once
+	life             lifecycle
+	stopErr          atomic.Pointer[CleanupError]
+	lastEgress       atomic.Int64
+	lastIngress      atomic.Int64
+	ready            atomic.Bool
 
 	once sync.Once
 }
 
-func newConflux() *conflux {
-	return &conflux{}
+func newConflux(opts Options) *conflux {
+	c := &conflux{opts: opts, lost: make(chan struct{}), stalled: make(chan struct{})}
+	registerSession(opts.Interface, &c.session)
+	return c
 }
 
-func (c *conflux) Start(apiBaseURL, anchorToken string, portal bool) error {
+// start runs the startup of Start, rolling back what it applied if it fails
+func (c *conflux) start(ctx context.Context, apiBaseURL, anchorToken string, portal bool) error {
+
+	// Use the userspace network stack instead of a TUN
+	if c.opts.Userspace {
+		return c.startUserspace(ctx, apiBaseURL, anchorToken, portal)
+	}
+
+	// Time the startup phases
+	timer := newStartTimer()
 
 	// Set portal
 	if portal {
 		return fmt.Errorf("portal is not supported on Windows")
 	}
 
+	// Check the host commands used to configure the host are available
+	err := c.CheckBinaries()
+	if err != nil {
+		return err
+	}
+
 	// Get the default gateway and interface
-	err := c.DetectHostGateway()
+	err = c.waitGateway(ctx)
+	if err != nil {
+		return err
+	}
+	timer.phase("detect")
+
+	// Create the anchor
+	c.anchor = newAnchor()
+
+	// Start the anchor before touching the host so a rejected token leaves no routes or TUN behind
+	err = c.StartAnchor(ctx, apiBaseURL, anchorToken, portal)
 	if err != nil {
+		c.rollback()
 		return err
 	}
+	c.session.connected()
+	timer.phase("anchor")
 
 	// Set bypass routes
 	c.AddBypassRoutes()
@@ -57,109 +106,167 @@ func (c *conflux) Start(apiBaseURL, anchorToken string, portal bool) error {
 	// Create the TUN device
 	err = c.CreateTUN()
 	if err != nil {
+		c.rollback()
 		return err
 	}
 
-	// Create the anchor
-	c.anchor = veilnet.NewAnchor()
+	// Get the IP address
+	cidr, err := c.anchor.GetCIDR()
+	if err != nil {
+		c.rollback()
+		return err
+	}
 
-	// Start the anchor
-	err = c.StartAnchor(apiBaseURL, anchorToken, portal)
+	// Accept a bare IP as a host address
+	cidr, err = normalizeCIDR(cidr)
 	if err != nil {
+		c.rollback()
 		return err
 	}
+	c.cidr = cidr
 
-	// Get the IP address
-	cidr, err := c.anchor.GetCIDR()
+	// Check the extra addresses do not conflict with the CIDR
+	c.extraAddrs, err = parseExtraAddresses(cidr, c.opts.ExtraAddresses)
+	if err != nil {
+		c.rollback()
+		return err
+	}
+
+	// Check the CIDR does not overlap the host network or the bypass hosts
+	err = c.checkOverlaps(cidr)
 	if err != nil {
+		c.rollback()
 		return err
 	}
+
+	// Pin the DNS servers to the host gateway, once the CIDR they may lie in is known
+	c.AddDNSBypassRoutes(cidr)
+
+	// Split CIDR into IP and netmask, netsh takes the mask in dotted decimal so it must be a 4-byte IPv4 mask
 	ipAddr, ipNet, err := net.ParseCIDR(cidr)
 	if err != nil {
+		c.rollback()
 		return err
 	}
-	ip := ipAddr.String()
-	netmask := fmt.Sprintf("%d.%d.%d.%d", ipNet.Mask[0], ipNet.Mask[1], ipNet.Mask[2], ipNet.Mask[3])
+	if ipAddr.To4() == nil || len(ipNet.Mask) != net.IPv4len {
+		c.rollback()
+		return fmt.Errorf("cannot configure %s on the TUN, only IPv4 CIDRs are supported on Windows", cidr)
+	}
+	ip := ipAddr.To4().String()
+	netmask := net.IP(ipNet.Mask).String()
 
-	// Configure the host
+	// Configure the host, cleaning whatever was applied if it fails
+	timer.phase("cidr")
+	c.auditRoutes("before host configuration")
 	err = c.ConfigHost(ip, netmask)
 	if err != nil {
+		c.CleanHostConfiguraions()
+		c.rollback()
 		return err
 	}
 
-	// Start the ingress and egress threads
+	// Make sure the interface has the MTU the packet loops use
+	c.checkMTU(true)
+
+	// Run the up script
+	c.runUpScript()
+
+	// Let the packet loops write to the TUN and start them
+	c.ready.Store(true)
 	go c.ingress()
 	go c.egress()
 
-	// Check if the anchor is alive and if not, stop the conflux and exit
-	go func() {
-		<-c.anchor.Ctx.Done()
-		veilnet.Logger.Sugar().Info("Anchor stopped")
-		c.Stop()
-		os.Exit(1)
-	}()
+	// Log a periodic traffic summary
+	go c.logStats(c.opts.StatsInterval)
+
+	// Watch the anchor and handle it going down
+	go c.watchAnchor()
+
+	// Restart the conflux if the egress loop wedges
+	go c.watchEgress(c.opts.EgressStallTimeout)
+
+	// Set the MTU back if the interface loses it
+	go c.watchMTU()
+
+	// Log how long the startup took
+	timer.phase("config")
+	timer.report(c.opts.Interface)
 
 	return nil
 }
 
-func (c *conflux) Stop() {
+// stop runs the cleanup of Stop once, later calls wait for it and return its result
+func (c *conflux) stop() error {
 	c.once.Do(func() {
+		c.stopped.Store(true)
+		c.ready.Store(false)
+		if c.opts.Userspace {
+			c.stopUserspace()
+			return
+		}
+		var errs cleanupErrors
 		if c.anchor != nil {
 			c.anchor.Stop()
 		}
-		c.CleanHostConfiguraions()
-		c.RemoveBypassRoutes()
+		c.session.disconnected()
+		c.runDownScript()
+		errs.merge(c.CleanHostConfiguraions())
+		c.auditRoutes("after host cleanup")
+		hosts := c.cleanupHosts()
+		errs.merge(c.RemoveBypassRoutes())
 		if c.device != nil {
-			c.device.Close()
+			errs.add("close TUN device", c.device.Close())
 		}
+		errs.merge(c.verifyCleanup(hosts))
+		c.stopErr.Store(errs.cleanupError())
 	})
+	return c.stopResult()
 }
 
-func (c *conflux) StartAnchor(apiBaseURL, anchorToken string, portal bool) error {
-
-	// Start the anchor
-	err := c.anchor.Start(apiBaseURL, anchorToken, portal)
-	if err != nil {
-		return err
+// rollback undoes the steps of a Start that did not complete
+func (c *conflux) rollback() {
+	if c.anchor != nil {
+		c.anchor.Stop()
 	}
-
-	return nil
+	c.session.disconnected()
+	c.RemoveBypassRoutes()
+	c.CloseTUN()
 }
 
 func (c *conflux) StopAnchor() {
 	c.anchor.Stop()
 }
 
+// CreateTUN creates the TUN, trying the numbered names after the one asked for if it is taken and AutoIface is set
 func (c *conflux) CreateTUN() error {
-	// Extract the wintun.dll to the current directory
-	executablePath, err := os.Executable()
+	return c.createTUNAuto(c.createTUN)
+}
+
+// createTUN creates the wintun adapter named by opts.Interface
+func (c *conflux) createTUN() error {
+	if c.opts.TUNFd != 0 {
+		return fmt.Errorf("an inherited TUN file descriptor is not supported on Windows")
+	}
+
+	// Extract the wintun.dll next to the executable, or check the installed one loads
+	err := c.loadWintun()
 	if err != nil {
 		return err
 	}
-	exeDir := filepath.Dir(executablePath)
-	dllPath := filepath.Join(exeDir, "wintun.dll")
 
-	// Check if the file already exists
-	if _, err := os.Stat(dllPath); os.IsNotExist(err) {
-		// File does not exist, so write it
-		if err := os.WriteFile(dllPath, wintunDLL, 0644); err != nil {
-			return err
-		}
-	} else if err != nil {
-		// An error occurred while checking the file
+	// Set the GUID for the TUN device, fixed per interface so restarts reuse the adapter
+	guid, err := c.tunGUID()
+	if err != nil {
 		return err
 	}
+	tun.WintunStaticRequestedGUID = guid
+	c.adapterGUID = guid.String()
 
-	// Set the GUID for the TUN device
-	tun.WintunStaticRequestedGUID = &windows.GUID{
-		Data1: 0x564E4554,                                              // "VNET" in ASCII
-		Data2: 0x564E,                                                  // "VN" in ASCII
-		Data3: 0x4554,                                                  // "ET" in ASCII
-		Data4: [8]byte{0x56, 0x45, 0x49, 0x4C, 0x4E, 0x45, 0x54, 0x00}, // "VEILNET" in ASCII
-	}
+	// Set the adapter description, shown in Device Manager and matched by group policy and monitoring tools
+	tun.WintunTunnelType = c.opts.TUNDescription
 
 	// Create a new TUN device
-	tun, err := tun.CreateTUN("veilnet", 1500)
+	tun, err := tun.CreateTUN(c.opts.Interface, tunMTU)
 	if err != nil {
 		return err
 	}
@@ -167,6 +274,57 @@ func (c *conflux) CreateTUN() error {
 	return nil
 }
 
+// tunGUID returns the wintun GUID of the adapter, --tun-guid or one derived from the interface name
+func (c *conflux) tunGUID() (*windows.GUID, error) {
+	guid := deriveTUNGUID(c.opts.Interface)
+	if c.opts.TUNGUID != "" {
+		checked, err := checkTUNGUID(c.opts.TUNGUID)
+		if err != nil {
+			return nil, err
+		}
+		guid = checked
+	}
+	parsed, err := windows.GUIDFromString(guid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TUN GUID %s: %v", guid, err)
+	}
+	veilnet.Logger.Sugar().Infof("Using wintun GUID %s for %s", guid, c.opts.Interface)
+	return &parsed, nil
+}
+
+// defaultMetrics returns the metrics of the default routes of other tunnels and of the host gateway, zero if not found
+// The TUN default route through tunIP is left out
+func (c *conflux) defaultMetrics(tunIP string) ([]int, int) {
+	out, err := runCommand("route", "print", "0.0.0.0")
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("Failed to list the default routes, ignoring other tunnels: %v", err)
+		return nil, 0
+	}
+	var others []int
+	host := 0
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != "0.0.0.0" || fields[1] != "0.0.0.0" || fields[3] == tunIP {
+			continue
+		}
+		metric, err := strconv.Atoi(fields[4])
+		if err != nil {
+			continue
+		}
+		if fields[2] == c.gateway && fields[3] == c.iface {
+			host = metric
+			continue
+		}
+		others = append(others, metric)
+	}
+	return others, host
+}
+
+// minTUNOffset is the headroom the wintun adapter needs in front of each packet, it needs none
+func (c *conflux) minTUNOffset() int {
+	return 0
+}
+
 func (c *conflux) CloseTUN() error {
 	if c.device != nil {
 		err := c.device.Close()
@@ -178,33 +336,57 @@ func (c *conflux) CloseTUN() error {
 	return nil
 }
 
+func (c *conflux) CheckBinaries() error {
+	required := []string{"route", "netsh"}
+	if c.opts.DNSMode == DNSModeDoH {
+		required = append(required, "powershell")
+	}
+	return checkBinaries(required, nil)
+}
+
 func (c *conflux) DetectHostGateway() error {
+	return c.waitGateway(context.Background())
+}
+
+// detectHostGateway looks up the host default gateway and interface once
+func (c *conflux) detectHostGateway() error {
 
 	// Get the host default gateway and interface
-	cmd := exec.Command("route", "print", "0.0.0.0")
-	out, err := cmd.Output()
+	out, err := runCommand("route", "print", "0.0.0.0")
 	if err != nil {
-		veilnet.Logger.Sugar().Errorf("Failed to get host default gateway: %v", err)
-		return err
+		return fmt.Errorf("failed to get host default gateway: %v", err)
 	}
 
 	// Parse the output
 	lines := strings.Split(string(out), "\n")
 	var gateway string
 	var iface string
+	others := 0
 	for _, line := range lines {
 		fields := strings.Fields(line)
 		if len(fields) >= 5 && fields[0] == "0.0.0.0" && fields[1] == "0.0.0.0" {
+			if gateway != "" {
+				if fields[2] != gateway {
+					others++
+				}
+				continue
+			}
 			gateway = fields[2]
 			iface = fields[3]
-			break
 		}
 	}
 
-	// If the host default gateway or interface is not found, return an error
+	// Tell a missing default route from output that could not be parsed
 	if gateway == "" || iface == "" {
-		veilnet.Logger.Sugar().Errorf("Host default gateway or interface not found")
-		return fmt.Errorf("host default gateway or interface not found")
+		if strings.Contains(out, "Active Routes:") {
+			return errNoDefaultRoute
+		}
+		return gatewayParseError("route print 0.0.0.0", "no route table found", out)
+	}
+
+	// Only the first default gateway is removed and restored, the others are left in place
+	if others > 0 && !c.opts.Fallback {
+		veilnet.Logger.Sugar().Warnf("Found %d more host default gateways, only the one via %s is removed and restored, the others may carry traffic outside VeilNet", others, gateway)
 	}
 
 	// Store the host default gateway and interface
@@ -214,102 +396,80 @@ func (c *conflux) DetectHostGateway() error {
 	return nil
 }
 
-func (c *conflux) AddBypassRoutes() {
-	hosts := []string{"stun.cloudflare.com", "turn.cloudflare.com", "guardian.veilnet.org", "turn.veilnet.org"}
-
-	for _, host := range hosts {
-		// Resolve IP addresses
-		ips, err := net.LookupIP(host)
+// specificRoute returns the most specific route to dest if it is more specific than the default route and not through the TUN
+func (c *conflux) specificRoute(dest string) string {
+	addr, err := netip.ParseAddr(dest)
+	if err != nil {
+		return ""
+	}
+	out, err := runCommand("route", "print", "-4")
+	if err != nil {
+		return ""
+	}
+	tunIP := ""
+	if ip, _, err := net.ParseCIDR(c.cidr); err == nil {
+		tunIP = ip.String()
+	}
+	var best netip.Prefix
+	route := ""
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[3] == tunIP {
+			continue
+		}
+		network, err := netip.ParseAddr(fields[0])
 		if err != nil {
-			veilnet.Logger.Sugar().Errorf("Failed to resolve %s: %v", host, err)
 			continue
 		}
-
-		for _, ip := range ips {
-			// Add route for IPv4 addresses
-			if ip4 := ip.To4(); ip4 != nil {
-				dest := ip4.String()
-				cmd := exec.Command("route", "add", dest, "mask", "255.255.255.255", c.gateway)
-				cmd.Run()
-				// Store the bypass route
-				c.bypassRoutes.Store(host, dest)
-			}
+		mask := net.ParseIP(fields[1]).To4()
+		if mask == nil {
+			continue
+		}
+		bits, _ := net.IPMask(mask).Size()
+		prefix := netip.PrefixFrom(network, bits)
+		if !prefix.Contains(addr) || !isSpecificRoute(prefix) || (route != "" && bits <= best.Bits()) {
+			continue
 		}
+		best = prefix
+		route = fmt.Sprintf("%s via %s on %s", prefix, fields[2], fields[3])
 	}
+	return route
 }
 
-func (c *conflux) RemoveBypassRoutes() {
-	c.bypassRoutes.Range(func(key, value interface{}) bool {
-		// Remove bypass route
-		cmd := exec.Command("route", "delete", value.(string), "mask", "255.255.255.255", c.gateway)
-		err := cmd.Run()
-		if err != nil {
-			veilnet.Logger.Sugar().Errorf("Failed to clear bypass route for %s: %v", key, err)
-			return false
+// hasHostRoute reports whether a host route to dest is in the routing table
+func (c *conflux) hasHostRoute(dest string) bool {
+	out, err := runCommand("route", "print", dest)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == dest && fields[1] == "255.255.255.255" {
+			return true
 		}
-		return true
-	})
-}
-
-func (c *conflux) Read(bufs [][]byte, batchSize int) int {
-	return c.anchor.Read(bufs, batchSize)
+	}
+	return false
 }
 
-func (c *conflux) Write(bufs [][]byte, sizes []int) int {
-	return c.anchor.Write(bufs, sizes)
+// adoptHostRoute reports whether the host route to dest was left by an earlier run, the routes here carry no tag to
+// tell so
+func (c *conflux) adoptHostRoute(dest string) bool {
+	return false
 }
 
-func (c *conflux) ingress() {
-	bufs := make([][]byte, c.device.BatchSize())
-	for {
-		select {
-		case <-c.anchor.Ctx.Done():
-			veilnet.Logger.Sugar().Info("Portal ingress stopped")
-			return
-		default:
-			n := c.Read(bufs, c.device.BatchSize())
-			for i := 0; i < n; i++ {
-				newBuf := make([]byte, 16+len(bufs[i]))
-				copy(newBuf[16:], bufs[i])
-				bufs[i] = newBuf
-			}
-			if n > 0 {
-				c.device.Write(bufs[:n], 16)
-			}
-		}
+// addHostRoute adds a host route to dest via the host gateway
+func (c *conflux) addHostRoute(dest string) error {
+	out, err := runNetCommand("route", "add", dest, "mask", "255.255.255.255", c.gateway)
+	if err != nil && strings.Contains(out, "already exists") {
+		return errRouteExists
 	}
+	return err
 }
 
-func (c *conflux) egress() {
-	bufs := make([][]byte, c.device.BatchSize())
-	sizes := make([]int, c.device.BatchSize())
-	mtu, err := c.device.MTU()
-	if err != nil {
-		veilnet.Logger.Sugar().Errorf("failed to get TUN MTU: %v", err)
-		// Use default MTU if we can't get the actual one
-		mtu = 1500
-	}
-	// Pre-allocate buffers
-	for i := range bufs {
-		bufs[i] = make([]byte, mtu)
-	}
-
-	for {
-		select {
-		case <-c.anchor.Ctx.Done():
-			veilnet.Logger.Sugar().Info("Portal egress stopped")
-			return
-		default:
-			n, err := c.device.Read(bufs, sizes, 0)
-			if err != nil {
-				veilnet.Logger.Sugar().Errorf("failed to read from TUN device: %v", err)
-				continue
-			}
-			if n > 0 {
-				c.Write(bufs[:n], sizes[:n])
-			}
-		}
-	}
+// delHostRoute removes the host route to dest added by addHostRoute
+func (c *conflux) delHostRoute(dest string) error {
+	_, err := runCommand("route", "delete", dest, "mask", "255.255.255.255", c.gateway)
+	return err
 }
 
 // ConfigHost configures the TUN interface with the given IP address and netmask
@@ -320,8 +480,7 @@ func (c *conflux) ConfigHost(ip, netmask string) error {
 	// Add bypass routes for Veil Master
 	veilHost := c.anchor.GetVeilHost()
 	if veilHost != "" {
-		cmd := exec.Command("route", "add", veilHost, "mask", "255.255.255.255", c.gateway)
-		err := cmd.Run()
+		_, err := runNetCommand("route", "add", veilHost, "mask", "255.255.255.255", c.gateway)
 		if err != nil {
 			veilnet.Logger.Sugar().Errorf("Failed to add route for Veil Master at %s via %s: %v", veilHost, c.gateway, err)
 		} else {
@@ -330,66 +489,270 @@ func (c *conflux) ConfigHost(ip, netmask string) error {
 	}
 
 	// Set the IP address and netmask
-	cmd := exec.Command("netsh", "interface", "ip", "set", "address", "name=veilnet", "static", ip, netmask)
-	if err := cmd.Run(); err != nil {
+	if _, err := runNetCommand("netsh", "interface", "ip", "set", "address", "name="+c.opts.Interface, "static", ip, netmask); err != nil {
 		veilnet.Logger.Sugar().Errorf("failed to configure VeilNet TUN IP address: %v", err)
 		return err
 	}
 	veilnet.Logger.Sugar().Infof("Set VeilNet TUN to %s", ip)
 
-	// Set the DNS server
-	cmd = exec.Command("netsh", "interface", "ip", "set", "dns", "name=veilnet", "static", "1.1.1.1")
-	if err := cmd.Run(); err != nil {
+	// Set the extra addresses
+	for _, addr := range c.extraAddrs {
+		if _, err := runNetCommand("netsh", "interface", "ip", "add", "address", "name="+c.opts.Interface, addr.IP.String(), net.IP(addr.Mask).String()); err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to add extra address %s: %v", addr, err)
+			return err
+		}
+		veilnet.Logger.Sugar().Infof("Added extra address %s to VeilNet TUN", addr)
+	}
+
+	// Set the DNS servers, the first replaces any set before and the others are added in order as alternates
+	if _, err := runNetCommand("netsh", "interface", "ip", "set", "dns", "name="+c.opts.Interface, "static", c.opts.DNS[0]); err != nil {
 		veilnet.Logger.Sugar().Errorf("failed to configure VeilNet TUN DNS: %v", err)
 		return err
 	}
-	veilnet.Logger.Sugar().Infof("Set VeilNet TUN DNS to 1.1.1.1")
+	for i, server := range c.opts.DNS[1:] {
+		if _, err := runNetCommand("netsh", "interface", "ip", "add", "dns", "name="+c.opts.Interface, "addr="+server, "index="+strconv.Itoa(i+2)); err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to add VeilNet TUN DNS server %s: %v", server, err)
+			return err
+		}
+	}
+	veilnet.Logger.Sugar().Infof("Set VeilNet TUN DNS to %s", strings.Join(c.opts.DNS, ", "))
+
+	// Use DNS over HTTPS for the tunnel resolver, keeping the previous setting to restore on cleanup
+	if c.opts.DNSMode == DNSModeDoH {
+		prev, err := getDoH()
+		if err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to get DNS over HTTPS setting, requires Windows 11 or Server 2022: %v", err)
+			return err
+		}
+		c.prevDoH = prev
+		if err := setDoH(dohState{present: true, template: tunnelDoHTemplate, autoUpgrade: true}); err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to enable DNS over HTTPS, requires Windows 11 or Server 2022: %v", err)
+			return err
+		}
+		c.dohSet = true
+		veilnet.Logger.Sugar().Infof("Set VeilNet TUN DNS to %s over HTTPS", tunnelDNS)
+	}
+
+	// Set the DNS search domains of the adapter, keeping the previous list to restore on cleanup
+	if len(c.opts.DNSSearch) > 0 {
+		prev, err := c.dnsSearch()
+		if err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to get DNS search domains: %v", err)
+			return err
+		}
+		c.prevDNSSearch = prev
+		if err := c.setDNSSearch(c.opts.DNSSearch); err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to set DNS search domains: %v", err)
+			return err
+		}
+		c.dnsSearchSet = true
+		veilnet.Logger.Sugar().Infof("Set VeilNet TUN DNS search domains to %s", strings.Join(c.opts.DNSSearch, ", "))
+	}
+
+	// Wait for the link to be operational before adding routes
+	if err := waitInterfaceUp(c.opts.Interface, c.opts.InterfaceUpTimeout); err != nil {
+		veilnet.Logger.Sugar().Errorf("%v", err)
+		return err
+	}
 
 	// Get the interface index
-	iface, err := net.InterfaceByName("veilnet")
+	iface, err := net.InterfaceByName(c.opts.Interface)
 	if err != nil {
 		veilnet.Logger.Sugar().Errorf("failed to get VeilNet TUN interface index: %v", err)
 		return err
 	}
 	veilnet.Logger.Sugar().Infof("Got VeilNet TUN interface index: %d", iface.Index)
 
+	// Pick the metric of the TUN default route relative to the default routes of other tunnels
+	// route print shows the route plus the interface metric, so the TUN interface metric is pinned to 1 to compare them
+	others, hostMetric := c.defaultMetrics(ip)
+	metric, err := priorityMetric(c.opts.Priority, others, 6, 2)
+	if err != nil {
+		return err
+	}
+	if _, err := runNetCommand("netsh", "interface", "ipv4", "set", "interface", c.opts.Interface, "metric=1"); err != nil {
+		veilnet.Logger.Sugar().Errorf("failed to set VeilNet TUN interface metric: %v", err)
+		return err
+	}
+	if c.opts.Fallback && hostMetric > 0 && metric >= hostMetric {
+		veilnet.Logger.Sugar().Warnf("The host default route via %s has metric %d, ahead of the VeilNet default route with metric %d", c.gateway, hostMetric, metric)
+	}
+
 	// Set the route
-	cmd = exec.Command("route", "add", "0.0.0.0", "mask", "0.0.0.0", ip, "metric", "5", "if", strconv.Itoa(iface.Index))
-	if err := cmd.Run(); err != nil {
+	if _, err := runNetCommand("route", "add", "0.0.0.0", "mask", "0.0.0.0", ip, "metric", strconv.Itoa(metric-1), "if", strconv.Itoa(iface.Index)); err != nil {
 		veilnet.Logger.Sugar().Errorf("failed to set VeilNet TUN as alternate gateway: %v", err)
 		return err
 	}
-	veilnet.Logger.Sugar().Infof("Set VeilNet TUN as preferred gateway")
+	veilnet.Logger.Sugar().Infof("Set VeilNet TUN as preferred gateway with metric %d", metric)
+	c.defaultChanges = append(c.defaultChanges, ManagedRoute{Kind: routeKindDefault, Destination: "0.0.0.0/0", Gateway: ip, Interface: c.opts.Interface, Metric: metric, Change: routeAdded})
+
+	// Remove the host default route if it should not be kept as a fallback
+	if !c.opts.Fallback {
+		if _, err := runCommand("route", "delete", "0.0.0.0", "mask", "0.0.0.0", c.gateway); err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to remove host default route via %s: %v", c.gateway, err)
+			return err
+		}
+		veilnet.Logger.Sugar().Infof("Removed host default route via %s", c.gateway)
+		c.defaultRemoved = true
+		c.defaultChanges = append(c.defaultChanges, ManagedRoute{Kind: routeKindHostDefault, Destination: "0.0.0.0/0", Gateway: c.gateway, Interface: c.iface, Change: routeRemoved})
+	}
 
 	return nil
 }
 
 // CleanHostConfiguraions removes the iptables FORWARD rules and NAT rule for the TUN interface
-// It also disables IP forwarding if it was not enabled
-func (c *conflux) CleanHostConfiguraions() {
+// It also disables IP forwarding if it was not enabled, returning a CleanupError listing the steps that failed
+func (c *conflux) CleanHostConfiguraions() error {
+	var errs cleanupErrors
+
+	// Remove the extra addresses
+	for _, addr := range c.extraAddrs {
+		_, err := runCommand("netsh", "interface", "ip", "delete", "address", "name="+c.opts.Interface, "addr="+addr.IP.String())
+		errs.add("remove extra address "+addr.String(), err)
+	}
+
+	// Restore the DNS over HTTPS setting of the tunnel resolver
+	if c.dohSet {
+		if err := setDoH(c.prevDoH); err != nil {
+			errs.add("restore DNS over HTTPS setting", err)
+		} else {
+			c.dohSet = false
+			veilnet.Logger.Sugar().Infof("Restored the DNS over HTTPS setting of %s to %s", tunnelDNS, c.prevDoH)
+		}
+	}
+
+	// Restore the DNS search domains
+	if c.dnsSearchSet {
+		errs.add("restore DNS search domains", c.setDNSSearch(c.prevDNSSearch))
+		veilnet.Logger.Sugar().Infof("Restored DNS search domains")
+	}
 
 	// Get the interface index
-	iface, err := net.InterfaceByName("veilnet")
+	iface, err := net.InterfaceByName(c.opts.Interface)
 	if err != nil {
-		veilnet.Logger.Sugar().Errorf("failed to get VeilNet TUN interface index: %v", err)
-		return
+		errs.add("get VeilNet TUN interface index", err)
+	} else {
+		// Remove the route
+		_, err := runCommand("route", "delete", "0.0.0.0", "mask", "0.0.0.0", "if", strconv.Itoa(iface.Index))
+		errs.add("remove VeilNet TUN route", err)
+		veilnet.Logger.Sugar().Infof("Removed VeilNet TUN as preferred gateway")
 	}
 
-	// Remove the route
-	cmd := exec.Command("route", "delete", "0.0.0.0", "mask", "0.0.0.0", "if", strconv.Itoa(iface.Index))
-	if err := cmd.Run(); err != nil {
-		veilnet.Logger.Sugar().Errorf("failed to remove VeilNet TUN route: %v", err)
+	// Restore the host default route if it was removed
+	if c.defaultRemoved {
+		_, err := runCommand("route", "add", "0.0.0.0", "mask", "0.0.0.0", c.gateway)
+		errs.add("restore host default route via "+c.gateway, err)
+		veilnet.Logger.Sugar().Infof("Restored host default route via %s", c.gateway)
+		c.defaultRemoved = false
 	}
-	veilnet.Logger.Sugar().Infof("Removed VeilNet TUN as preferred gateway")
 
 	// Remove the bypass routes for Veil Master
 	veilHost := c.anchor.GetVeilHost()
 	if veilHost != "" {
-		cmd := exec.Command("route", "delete", veilHost, "mask", "255.255.255.255", c.gateway)
-		err := cmd.Run()
-		if err != nil {
-			veilnet.Logger.Sugar().Errorf("Failed to remove route for Veil Master at %s via %s: %v", veilHost, c.gateway, err)
-		}
+		_, err := runCommand("route", "delete", veilHost, "mask", "255.255.255.255", c.gateway)
+		errs.add("remove route for Veil Master at "+veilHost+" via "+c.gateway, err)
 	}
 	veilnet.Logger.Sugar().Infof("Removed bypass routes")
+	return errs.err()
+}
+
+// adapterKey opens the TCP/IP settings of the TUN adapter in the registry
+func (c *conflux) adapterKey(access uint32) (registry.Key, error) {
+	return registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\Tcpip\Parameters\Interfaces\`+c.adapterGUID, access)
+}
+
+// dnsSearch returns the DNS suffix search list of the TUN adapter, nil if none is set
+func (c *conflux) dnsSearch() ([]string, error) {
+	key, err := c.adapterKey(registry.QUERY_VALUE)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Close()
+
+	value, _, err := key.GetStringValue("SearchList")
+	if errors.Is(err, registry.ErrNotExist) || value == "" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(value, ","), nil
+}
+
+// setDNSSearch sets the DNS suffix search list of the TUN adapter, an empty list removes it
+// Only names resolved through the adapter use it, the global suffix search list of the host is left alone
+func (c *conflux) setDNSSearch(domains []string) error {
+	key, err := c.adapterKey(registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+
+	if len(domains) == 0 {
+		err = key.DeleteValue("SearchList")
+		if errors.Is(err, registry.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return key.SetStringValue("SearchList", strings.Join(domains, ","))
+}
+
+// dohState is the DNS over HTTPS setting of the tunnel resolver
+type dohState struct {
+	present     bool
+	template    string
+	autoUpgrade bool
+	fallback    bool
+}
+
+// String describes the DNS over HTTPS setting for the logs
+func (d dohState) String() string {
+	if !d.present {
+		return "none"
+	}
+	return fmt.Sprintf("%s, automatic upgrade %t, UDP fallback %t", d.template, d.autoUpgrade, d.fallback)
+}
+
+// getDoH reads the DNS over HTTPS setting of the tunnel resolver, not present if there is none
+func getDoH() (dohState, error) {
+	script := fmt.Sprintf("$s = Get-DnsClientDohServerAddress -ServerAddress %s -ErrorAction SilentlyContinue; if ($s) { '{0}|{1}|{2}' -f $s.DohTemplate, $s.AutoUpgrade, $s.AllowFallbackToUdp }", tunnelDNS)
+	out, err := runCommand("powershell", "-NoProfile", "-Command", script)
+	if err != nil {
+		return dohState{}, err
+	}
+	if out == "" {
+		return dohState{}, nil
+	}
+	parts := strings.Split(out, "|")
+	if len(parts) != 3 {
+		return dohState{}, fmt.Errorf("unexpected DNS over HTTPS setting %q", out)
+	}
+	return dohState{
+		present:     true,
+		template:    parts[0],
+		autoUpgrade: strings.EqualFold(parts[1], "True"),
+		fallback:    strings.EqualFold(parts[2], "True"),
+	}, nil
+}
+
+// setDoH sets the DNS over HTTPS setting of the tunnel resolver, removing it if it is not present
+func setDoH(d dohState) error {
+	var script string
+	if d.present {
+		template := strings.ReplaceAll(d.template, "'", "''")
+		script = fmt.Sprintf("if (Get-DnsClientDohServerAddress -ServerAddress %[1]s -ErrorAction SilentlyContinue) { Set-DnsClientDohServerAddress -ServerAddress %[1]s -DohTemplate '%[2]s' -AutoUpgrade %[3]s -AllowFallbackToUdp %[4]s } else { Add-DnsClientDohServerAddress -ServerAddress %[1]s -DohTemplate '%[2]s' -AutoUpgrade %[3]s -AllowFallbackToUdp %[4]s }", tunnelDNS, template, psBool(d.autoUpgrade), psBool(d.fallback))
+	} else {
+		script = fmt.Sprintf("Remove-DnsClientDohServerAddress -ServerAddress %s -ErrorAction SilentlyContinue", tunnelDNS)
+	}
+	_, err := runCommand("powershell", "-NoProfile", "-Command", script)
+	return err
+}
+
+// psBool formats a boolean as a PowerShell literal
+func psBool(b bool) string {
+	if b {
+		return "$true"
+	}
+	return "$false"
 }
@@ -0,0 +1,47 @@
+package conflux
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// startPhase is a step of the startup and how long it took
+type startPhase struct {
+	name     string
+	duration time.Duration
+}
+
+// startTimer times the phases of a startup: detect, anchor, cidr and config
+type startTimer struct {
+	started time.Time
+	last    time.Time
+	phases  []startPhase
+}
+
+// newStartTimer starts timing a startup
+func newStartTimer() *startTimer {
+	now := time.Now()
+	return &startTimer{started: now, last: now}
+}
+
+// phase records the time since the previous phase ended under name
+func (t *startTimer) phase(name string) {
+	now := time.Now()
+	t.phases = append(t.phases, startPhase{name: name, duration: now.Sub(t.last)})
+	t.last = now
+}
+
+// report logs how long the startup and each of its phases took, and exports them as metrics
+func (t *startTimer) report(iface string) {
+	total := time.Since(t.started)
+	connectDuration.WithLabelValues(iface).Set(total.Seconds())
+	parts := make([]string, len(t.phases))
+	for i, p := range t.phases {
+		connectPhaseDuration.WithLabelValues(iface, p.name).Set(p.duration.Seconds())
+		parts[i] = fmt.Sprintf("%s=%s", p.name, p.duration.Round(time.Millisecond))
+	}
+	veilnet.Logger.Sugar().Infof("Connected in %s: %s", total.Round(time.Millisecond), strings.Join(parts, " "))
+}
@@ -0,0 +1,159 @@
+package conflux
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Control commands accepted by a running conflux
+const (
+	ControlStatus = "status"
+	ControlStop   = "stop"
+	ControlReload = "reload"
+	ControlJoin   = "join"
+	ControlLeave  = "leave"
+	ControlRoutes = "routes"
+)
+
+// ControlRequest is a command sent to a running conflux over its control socket or pipe
+type ControlRequest struct {
+	Command string `json:"command"`
+
+	// Instance is the plane to start for a join
+	Instance *MultiInstance `json:"instance,omitempty"`
+
+	// Iface is the interface of the plane to stop for a leave
+	Iface string `json:"iface,omitempty"`
+}
+
+// ControlResponse is the reply of a running conflux to a ControlRequest
+type ControlResponse struct {
+	OK     bool           `json:"ok"`
+	Error  string         `json:"error,omitempty"`
+	Status *ConfluxStatus `json:"status,omitempty"`
+	Routes []ManagedRoute `json:"routes,omitempty"`
+}
+
+// ConfluxStatus describes a running conflux
+type ConfluxStatus struct {
+	State         string `json:"state"`
+	Interface     string `json:"interface"`
+	CIDR          string `json:"cidr"`
+	Gateway       string `json:"gateway"`
+	HostInterface string `json:"host_interface"`
+	Portal        bool   `json:"portal"`
+	AnchorAlive   bool   `json:"anchor_alive"`
+
+	SessionUptimeSeconds float64 `json:"session_uptime_seconds"`
+	TotalUptimeSeconds   float64 `json:"total_uptime_seconds"`
+
+	// CleanupErrors lists the cleanup steps that failed once the conflux stopped
+	CleanupErrors []string `json:"cleanup_errors,omitempty"`
+
+	// Planes lists the interfaces of all planes run by the same up-multi
+	Planes []string `json:"planes,omitempty"`
+}
+
+// ControlHandler handles a control request
+type ControlHandler func(req ControlRequest) ControlResponse
+
+// ServeControl serves control requests for the given interface until the returned function is called
+func ServeControl(iface string, handler ControlHandler) (func(), error) {
+	return listenControl(controlAddress(iface), handler)
+}
+
+// SendControl sends a control request to the conflux running on the given interface
+func SendControl(iface string, req ControlRequest) (ControlResponse, error) {
+	var resp ControlResponse
+
+	conn, err := dialControl(controlAddress(iface))
+	if err != nil {
+		return resp, fmt.Errorf("failed to connect to conflux on %s, is it running? %v", iface, err)
+	}
+	defer conn.Close()
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return resp, fmt.Errorf("failed to send control request: %v", err)
+	}
+
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		return resp, fmt.Errorf("failed to read control response: %v", err)
+	}
+
+	if !resp.OK {
+		return resp, fmt.Errorf("%s failed: %s", req.Command, resp.Error)
+	}
+	return resp, nil
+}
+
+// controlConns tracks the control connections being served, so the listener can let them finish before the exit
+type controlConns struct {
+	wg sync.WaitGroup
+}
+
+// serve serves conn on its own goroutine
+func (cc *controlConns) serve(conn io.ReadWriteCloser, handler ControlHandler) {
+	cc.wg.Add(1)
+	go func() {
+		defer cc.wg.Done()
+		handleControlConn(conn, handler)
+	}()
+}
+
+// wait waits for the connections being served, e.g. a down waiting for the cleanup result, up to a second
+func (cc *controlConns) wait() {
+	done := make(chan struct{})
+	go func() {
+		cc.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+}
+
+// handleControlConn serves a single control request on conn
+func handleControlConn(conn io.ReadWriteCloser, handler ControlHandler) {
+	defer conn.Close()
+
+	var req ControlRequest
+	var resp ControlResponse
+	err := json.NewDecoder(conn).Decode(&req)
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid control request: %v", err)
+	} else {
+		resp = handler(req)
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// Status returns the status of the conflux
+func (c *conflux) Status() ConfluxStatus {
+	status := ConfluxStatus{
+		State:         c.life.get().String(),
+		Interface:     c.opts.Interface,
+		CIDR:          c.cidr,
+		Gateway:       c.gateway,
+		HostInterface: c.iface,
+		Portal:        c.portal,
+	}
+	if c.anchor != nil {
+		status.AnchorAlive = c.anchor.IsAlive()
+	}
+
+	stats := c.session.stats()
+	status.SessionUptimeSeconds = stats.SessionUptime.Seconds()
+	status.TotalUptimeSeconds = stats.TotalUptime.Seconds()
+	if cleanup := c.stopErr.Load(); cleanup != nil {
+		for _, step := range cleanup.Steps {
+			status.CleanupErrors = append(status.CleanupErrors, step.Error())
+		}
+	}
+	return status
+}
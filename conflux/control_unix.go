@@ -0,0 +1,63 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package conflux
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// controlAddress returns the path of the control socket for the given interface
+func controlAddress(iface string) string {
+	return "/var/run/veilnet-" + iface + ".sock"
+}
+
+func listenControl(addr string, handler ControlHandler) (func(), error) {
+
+	// Remove a stale socket left by a conflux that did not exit cleanly, but never the socket of a running one
+	conn, err := net.Dial("unix", addr)
+	if err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a conflux is already listening on %s", addr)
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		os.Remove(addr)
+	}
+
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only root may control the conflux
+	err = os.Chmod(addr, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	var conns controlConns
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns.serve(conn, handler)
+		}
+	}()
+
+	return func() {
+		listener.Close()
+		conns.wait()
+	}, nil
+}
+
+func dialControl(addr string) (io.ReadWriteCloser, error) {
+	return net.Dial("unix", addr)
+}
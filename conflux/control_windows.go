@@ -0,0 +1,89 @@
+//go:build windows
+// +build windows
+
+package conflux
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/veil-net/veilnet"
+	"golang.org/x/sys/windows"
+)
+
+// controlAddress returns the name of the control pipe for the given interface
+func controlAddress(iface string) string {
+	return `\\.\pipe\veilnet-` + iface
+}
+
+func listenControl(addr string, handler ControlHandler) (func(), error) {
+	path, err := windows.UTF16PtrFromString(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the first pipe instance up front so a second conflux on the same interface is reported
+	pipe, err := createControlPipe(path, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var closed atomic.Bool
+	var conns controlConns
+	go func() {
+		for {
+			err := windows.ConnectNamedPipe(pipe, nil)
+			if closed.Load() {
+				windows.CloseHandle(pipe)
+				return
+			}
+			if err != nil && err != windows.ERROR_PIPE_CONNECTED {
+				veilnet.Logger.Sugar().Errorf("failed to accept control connection: %v", err)
+				windows.CloseHandle(pipe)
+			} else {
+				conns.serve(&pipeConn{os.NewFile(uintptr(pipe), addr)}, handler)
+			}
+
+			// Create the next pipe instance for the next client
+			pipe, err = createControlPipe(path, false)
+			if err != nil {
+				veilnet.Logger.Sugar().Errorf("failed to create control pipe: %v", err)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		closed.Store(true)
+		// Connect to the pipe to release the pending ConnectNamedPipe
+		if f, err := os.OpenFile(addr, os.O_RDWR, 0); err == nil {
+			f.Close()
+		}
+		conns.wait()
+	}, nil
+}
+
+func dialControl(addr string) (io.ReadWriteCloser, error) {
+	return os.OpenFile(addr, os.O_RDWR, 0)
+}
+
+// createControlPipe creates a named pipe instance at path
+func createControlPipe(path *uint16, first bool) (windows.Handle, error) {
+	mode := uint32(windows.PIPE_ACCESS_DUPLEX)
+	if first {
+		mode |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	return windows.CreateNamedPipe(path, mode, windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT, windows.PIPE_UNLIMITED_INSTANCES, 4096, 4096, 0, nil)
+}
+
+// pipeConn is the server end of a control pipe connection
+type pipeConn struct {
+	*os.File
+}
+
+// Close flushes the pipe before closing it so the client receives the full response
+func (p *pipeConn) Close() error {
+	windows.FlushFileBuffers(windows.Handle(p.Fd()))
+	return p.File.Close()
+}
@@ -0,0 +1,96 @@
+package conflux
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// detachedEnv marks the background process started by --detach, which then runs the conflux itself
+const detachedEnv = "VEILNET_CONFLUX_DETACHED"
+
+// defaultPIDFile is where a detached conflux writes its PID unless --pid-file is set
+func defaultPIDFile(iface string) string {
+	return "/run/veilnet-" + iface + ".pid"
+}
+
+// defaultLogFile is where a detached conflux writes its logs unless --log-file is set
+func defaultLogFile(iface string) string {
+	return "/var/log/veilnet-" + iface + ".log"
+}
+
+// detach starts the conflux again in a new session in the background, with the same arguments and its logs appended to logFile
+// It returns once the background conflux answers on the control interface, or fails if it exits first
+func detach(iface, logFile string) error {
+
+	// A running conflux would answer for the new one
+	if _, err := SendControl(iface, ControlRequest{Command: ControlStatus}); err == nil {
+		return fmt.Errorf("a conflux is already running on %s", iface)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the conflux executable: %v", err)
+	}
+	log, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	defer log.Close()
+
+	// Start the background conflux with no terminal, it logs to stderr so the log file gets everything
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), detachedEnv+"=1")
+	cmd.Stdout = log
+	cmd.Stderr = log
+	cmd.SysProcAttr = detachAttr()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start the conflux in the background: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	// Wait for the background conflux to serve its control interface
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-exited:
+			if err != nil {
+				return fmt.Errorf("the conflux exited during startup: %v, see %s", err, logFile)
+			}
+			return fmt.Errorf("the conflux exited during startup, see %s", logFile)
+		case <-ticker.C:
+			if _, err := SendControl(iface, ControlRequest{Command: ControlStatus}); err == nil {
+				veilnet.Logger.Sugar().Infof("Conflux started in the background with PID %d, logging to %s, stop it with down --iface %s", cmd.Process.Pid, logFile, iface)
+				return nil
+			}
+		}
+	}
+}
+
+// writePIDFile writes the PID of the running conflux to path
+func writePIDFile(path string) error {
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write PID file: %v", err)
+	}
+	return nil
+}
+
+// removePIDFile removes the PID file at path, unless another conflux has since written its own PID to it
+func removePIDFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		veilnet.Logger.Sugar().Warnf("Failed to remove PID file: %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package conflux
+
+import "syscall"
+
+// detachAttr starts the background conflux in a new session, away from the terminal and its hangups
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package conflux
+
+import "syscall"
+
+// detachAttr is unused, --detach is not supported on Windows
+func detachAttr() *syscall.SysProcAttr {
+	return nil
+}
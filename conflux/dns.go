@@ -0,0 +1,89 @@
+package conflux
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// DNS modes for the tunnel resolver
+const (
+	DNSModeUDP = "udp"
+	DNSModeDoT = "dot"
+	DNSModeDoH = "doh"
+)
+
+// DNS methods for applying the DNS settings on Linux
+const (
+	DNSMethodAuto            = "auto"
+	DNSMethodNone            = "none"
+	DNSMethodResolvconf      = "resolvconf"
+	DNSMethodSystemdResolved = "systemd-resolved"
+	DNSMethodDirectFile      = "direct-file"
+)
+
+const (
+	// tunnelDNS is the resolver used through the tunnel unless --dns is set
+	tunnelDNS = "1.1.1.1"
+
+	// tunnelDNSName is the TLS server name of the tunnel resolver
+	tunnelDNSName = "cloudflare-dns.com"
+
+	// tunnelDoHTemplate is the DNS over HTTPS template of the tunnel resolver
+	tunnelDoHTemplate = "https://cloudflare-dns.com/dns-query"
+)
+
+// checkDNSMode reports whether the DNS mode is supported on this platform
+func checkDNSMode(mode string) error {
+	switch mode {
+	case DNSModeUDP, "":
+		return nil
+	case DNSModeDoT:
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("DNS over TLS is not supported on Windows, use --dns-mode doh")
+		}
+	case DNSModeDoH:
+		if runtime.GOOS == "linux" {
+			return fmt.Errorf("DNS over HTTPS is not supported by systemd-resolved, use --dns-mode dot")
+		}
+	default:
+		return fmt.Errorf("invalid DNS mode %s, must be udp, dot or doh", mode)
+	}
+	return nil
+}
+
+// checkDNSMethod reports whether the DNS method can carry the DNS mode
+func checkDNSMethod(method, mode string) error {
+	switch method {
+	case DNSMethodAuto, DNSMethodSystemdResolved, "":
+		return nil
+	case DNSMethodNone, DNSMethodResolvconf, DNSMethodDirectFile:
+		if mode == DNSModeDoT {
+			return fmt.Errorf("DNS over TLS requires --dns-method systemd-resolved")
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid DNS method %s, must be auto, none, resolvconf, systemd-resolved or direct-file", method)
+	}
+}
+
+// checkDNSServers validates the tunnel resolvers, encrypted DNS is only set up for the default resolver alone
+func checkDNSServers(servers []string, mode string) error {
+	if len(servers) == 0 {
+		return fmt.Errorf("no DNS server set")
+	}
+	seen := make(map[string]bool)
+	for _, server := range servers {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("invalid DNS server %q, must be an IP address", server)
+		}
+		if seen[server] {
+			return fmt.Errorf("DNS server %s is listed twice", server)
+		}
+		seen[server] = true
+	}
+	if (len(servers) > 1 || servers[0] != tunnelDNS) && (mode == DNSModeDoT || mode == DNSModeDoH) {
+		return fmt.Errorf("--dns-mode %s is only supported with the default DNS server %s alone", mode, tunnelDNS)
+	}
+	return nil
+}
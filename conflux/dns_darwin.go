@@ -0,0 +1,215 @@
+//go:build darwin
+// +build darwin
+
+package conflux
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/veil-net/veilnet"
+)
+
+// networkService returns the network service of the host interface, e.g. Wi-Fi for en0
+func (c *conflux) networkService() (string, error) {
+	out, err := runNetworksetup("-listnetworkserviceorder")
+	if err != nil {
+		return "", err
+	}
+
+	// Services are listed as "(1) Wi-Fi" followed by "(Hardware Port: Wi-Fi, Device: en0)"
+	var service string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "(Hardware Port:") {
+			if strings.HasSuffix(line, "Device: "+c.iface+")") && service != "" {
+				return service, nil
+			}
+			continue
+		}
+		if _, name, ok := strings.Cut(line, ") "); ok && strings.HasPrefix(line, "(") {
+			service = name
+		}
+	}
+	return "", fmt.Errorf("no network service found for %s", c.iface)
+}
+
+// serviceDNS is the manual DNS configuration of a network service, an empty list means none is set and the service
+// uses the settings DHCP provides
+type serviceDNS struct {
+	servers []string
+}
+
+// captureDNS reads the DNS servers of the service
+func captureDNS(service string) (serviceDNS, error) {
+	servers, err := networkSetting("-getdnsservers", service)
+	if err != nil {
+		return serviceDNS{}, fmt.Errorf("failed to get the DNS servers of %s: %v", service, err)
+	}
+	for _, server := range servers {
+		if net.ParseIP(server) == nil {
+			return serviceDNS{}, fmt.Errorf("failed to get the DNS servers of %s: unexpected output %q", service, strings.Join(servers, " "))
+		}
+	}
+	return serviceDNS{servers: servers}, nil
+}
+
+// networkSetting reads a list setting of the service with networksetup, nil if none is set
+func networkSetting(flag, service string) ([]string, error) {
+	out, err := runNetworksetup(flag, service)
+	if err != nil {
+		return nil, err
+	}
+	return parseNetworkSetting(out), nil
+}
+
+// parseNetworkSetting parses a list setting printed by networksetup, one value per line, nil if none is set
+// An unset list is reported as "There aren't any DNS Servers set on Wi-Fi." rather than as the Empty it is set with
+func parseNetworkSetting(out string) []string {
+	if strings.Contains(out, "There aren't any") {
+		return nil
+	}
+	values := strings.Fields(out)
+	if len(values) == 1 && values[0] == "Empty" {
+		return nil
+	}
+	return values
+}
+
+// setNetworkSetting sets a list setting of the service with networksetup, an empty list clears it
+func setNetworkSetting(flag, service string, values []string) error {
+	if len(values) == 0 {
+		values = []string{"Empty"}
+	}
+	_, err := runNetworksetup(append([]string{flag, service}, values...)...)
+	return err
+}
+
+// runNetworksetup runs networksetup, which reports most failures on its output with a zero exit status
+func runNetworksetup(args ...string) (string, error) {
+	out, err := runCommand("networksetup", args...)
+	if err == nil && strings.Contains(out, "Error") {
+		err = fmt.Errorf("%s", out)
+	}
+	if err == nil {
+		return out, nil
+	}
+
+	// Explain the failures users hit most
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "admin") || strings.Contains(msg, "root") || strings.Contains(msg, "not permitted"):
+		return "", fmt.Errorf("networksetup needs to run as root to change the DNS settings, run the conflux with sudo: %v", err)
+	case strings.Contains(msg, "not a recognized network service"):
+		return "", fmt.Errorf("networksetup does not know the network service, it may have been renamed: %v", err)
+	}
+	return "", err
+}
+
+// applyDNS points the network service of the host interface at the tunnel resolver, keeping its settings to restore
+func (c *conflux) applyDNS() error {
+	service, err := c.networkService()
+	if err != nil {
+		return fmt.Errorf("failed to find the network service to set DNS on: %v", err)
+	}
+	c.dnsService = service
+
+	// Capture the DNS state before changing it
+	c.prevDNS, err = captureDNS(service)
+	if err != nil {
+		return err
+	}
+	veilnet.Logger.Sugar().Infof("The DNS of %s was %s", service, c.prevDNS)
+
+	// Set the DNS server
+	if err := setNetworkSetting("-setdnsservers", service, c.opts.DNS); err != nil {
+		return fmt.Errorf("failed to set the DNS servers of %s: %v", service, err)
+	}
+	c.dnsSet = true
+	veilnet.Logger.Sugar().Infof("Set the DNS servers of %s to %s", service, strings.Join(c.opts.DNS, ", "))
+
+	// Set the DNS search domains
+	if len(c.opts.DNSSearch) > 0 {
+		if err := c.setDNSSearch(); err != nil {
+			return fmt.Errorf("failed to set the DNS search domains: %v", err)
+		}
+		c.dnsSearchSet = true
+		veilnet.Logger.Sugar().Infof("Set the DNS search domains to %s", strings.Join(c.opts.DNSSearch, ", "))
+	}
+	return nil
+}
+
+// dnsSearchKey is the dynamic store key the search domains are published under, owned by the conflux alone
+func (c *conflux) dnsSearchKey() string {
+	return "State:/Network/Service/veilnet-" + c.opts.Interface + "/DNS"
+}
+
+// setDNSSearch publishes the search domains with scutil as a supplemental resolver for the tunnel DNS servers
+// The match domains are added to the search list of the host, leaving the settings of the network service alone
+func (c *conflux) setDNSSearch() error {
+	domains := strings.Join(c.opts.DNSSearch, " ")
+	script := "d.init\n" +
+		"d.add ServerAddresses * " + strings.Join(c.opts.DNS, " ") + "\n" +
+		"d.add SearchDomains * " + domains + "\n" +
+		"d.add SupplementalMatchDomains * " + domains + "\n" +
+		"set " + c.dnsSearchKey() + "\n"
+	_, err := runCommandInput(script, "scutil")
+	return err
+}
+
+// removeDNSSearch removes the search domains published by setDNSSearch
+func (c *conflux) removeDNSSearch() error {
+	_, err := runCommandInput("remove "+c.dnsSearchKey()+"\n", "scutil")
+	return err
+}
+
+// revertDNS restores the DNS settings of the network service changed by applyDNS
+// Settings another tool, such as an MDM profile or another VPN, changed in the meantime are left in place
+func (c *conflux) revertDNS() error {
+	var errs cleanupErrors
+	if c.dnsSet {
+		if c.changedSince("-getdnsservers", c.opts.DNS, "DNS servers") {
+			c.dnsSet = false
+		} else if err := setNetworkSetting("-setdnsservers", c.dnsService, c.prevDNS.servers); err != nil {
+			errs.add("restore the DNS servers of "+c.dnsService, err)
+		} else {
+			c.dnsSet = false
+			veilnet.Logger.Sugar().Infof("Restored the DNS servers of %s to %s", c.dnsService, listOrEmpty(c.prevDNS.servers))
+		}
+	}
+	if c.dnsSearchSet {
+		if err := c.removeDNSSearch(); err != nil {
+			errs.add("remove the DNS search domains", err)
+		} else {
+			c.dnsSearchSet = false
+			veilnet.Logger.Sugar().Infof("Removed the DNS search domains")
+		}
+	}
+	return errs.err()
+}
+
+// changedSince reports whether a list setting of the DNS service no longer holds the values the conflux set
+// A setting that cannot be read is restored anyway
+func (c *conflux) changedSince(flag string, set []string, what string) bool {
+	current, err := networkSetting(flag, c.dnsService)
+	if err != nil || slices.Equal(current, set) {
+		return false
+	}
+	veilnet.Logger.Sugar().Warnf("The %s of %s were changed to %s by another tool, leaving them in place", what, c.dnsService, listOrEmpty(current))
+	return true
+}
+
+// String describes the DNS state for the logs
+func (d serviceDNS) String() string {
+	return fmt.Sprintf("servers %s", listOrEmpty(d.servers))
+}
+
+// listOrEmpty joins a list setting for the logs, naming an unset one as networksetup does
+func listOrEmpty(values []string) string {
+	if len(values) == 0 {
+		return "Empty (DHCP)"
+	}
+	return strings.Join(values, ", ")
+}
@@ -0,0 +1,143 @@
+//go:build darwin
+// +build darwin
+
+package conflux
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseNetworkSetting(t *testing.T) {
+	tests := []struct {
+		out  string
+		want []string
+	}{
+		{out: "1.1.1.1\n8.8.8.8", want: []string{"1.1.1.1", "8.8.8.8"}},
+		{out: "192.168.1.1", want: []string{"192.168.1.1"}},
+		{out: "corp.example\nlab.example\n", want: []string{"corp.example", "lab.example"}},
+		{out: "There aren't any DNS Servers set on Wi-Fi."},
+		{out: "There aren't any Search Domains set on Wi-Fi."},
+		{out: "Empty"},
+		{out: ""},
+	}
+	for _, tt := range tests {
+		if got := parseNetworkSetting(tt.out); !slices.Equal(got, tt.want) {
+			t.Errorf("parseNetworkSetting(%q) = %q, want %q", tt.out, got, tt.want)
+		}
+	}
+}
+
+const (
+	listServices = "networksetup -listnetworkserviceorder"
+	getServers   = "networksetup -getdnsservers Wi-Fi"
+)
+
+// serviceOrder is the networksetup listing of a host with Wi-Fi on en0
+const serviceOrder = `An asterisk (*) denotes that a network service is disabled.
+(1) Wi-Fi
+(Hardware Port: Wi-Fi, Device: en0)
+
+(2) Thunderbolt Bridge
+(Hardware Port: Thunderbolt Bridge, Device: bridge0)`
+
+// newDNSConflux returns a conflux on en0 that points the DNS at the tunnel resolver
+func newDNSConflux(search ...string) *conflux {
+	c := newConflux(Options{Interface: "veilnet", DNS: []string{"100.64.0.1"}, DNSSearch: search})
+	c.iface = "en0"
+	return c
+}
+
+func TestDNSRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers string
+		restore string
+	}{
+		{name: "manual servers", servers: "1.1.1.1\n8.8.8.8", restore: "networksetup -setdnsservers Wi-Fi 1.1.1.1 8.8.8.8"},
+		{name: "DHCP servers", servers: "There aren't any DNS Servers set on Wi-Fi.", restore: "networksetup -setdnsservers Wi-Fi Empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakeCommands(t)
+			f.set(listServices, serviceOrder, nil)
+			f.set(getServers, tt.servers, nil)
+			c := newDNSConflux("corp.example")
+
+			if err := c.applyDNS(); err != nil {
+				t.Fatalf("applyDNS: %v", err)
+			}
+			f.set(getServers, "100.64.0.1", nil)
+			if err := c.revertDNS(); err != nil {
+				t.Fatalf("revertDNS: %v", err)
+			}
+
+			want := []string{
+				listServices,
+				getServers,
+				"networksetup -setdnsservers Wi-Fi 100.64.0.1",
+				"scutil",
+				getServers,
+				tt.restore,
+				"scutil",
+			}
+			if got := f.ran(); !slices.Equal(got, want) {
+				t.Fatalf("ran %q, want %q", got, want)
+			}
+			fed := f.fed()
+			key := "State:/Network/Service/veilnet-veilnet/DNS"
+			if set := fed[3]; !strings.Contains(set, "d.add SearchDomains * corp.example\n") || !strings.Contains(set, "set "+key+"\n") {
+				t.Errorf("scutil was fed %q, want the search domains set on %s", set, key)
+			}
+			if remove := fed[6]; remove != "remove "+key+"\n" {
+				t.Errorf("scutil was fed %q, want %s removed", remove, key)
+			}
+			if c.dnsSet || c.dnsSearchSet {
+				t.Error("the DNS is still marked as set after it was restored")
+			}
+		})
+	}
+}
+
+func TestRevertDNSLeavesOtherTools(t *testing.T) {
+	f := useFakeCommands(t)
+	f.set(listServices, serviceOrder, nil)
+	f.set(getServers, "1.1.1.1", nil)
+	c := newDNSConflux()
+
+	if err := c.applyDNS(); err != nil {
+		t.Fatalf("applyDNS: %v", err)
+	}
+
+	// Another VPN takes over the DNS while the conflux runs
+	f.set(getServers, "10.9.9.9", nil)
+	if err := c.revertDNS(); err != nil {
+		t.Fatalf("revertDNS: %v", err)
+	}
+	if ran := f.ran(); slices.Contains(ran, "networksetup -setdnsservers Wi-Fi 1.1.1.1") {
+		t.Errorf("ran %q, overwriting the DNS servers another tool set", ran)
+	}
+	if c.dnsSet {
+		t.Error("the DNS is still marked as set after it was left to the other tool")
+	}
+}
+
+func TestRevertDNSKeepsFailedRestore(t *testing.T) {
+	f := useFakeCommands(t)
+	f.set(listServices, serviceOrder, nil)
+	f.set(getServers, "1.1.1.1", nil)
+	c := newDNSConflux()
+
+	if err := c.applyDNS(); err != nil {
+		t.Fatalf("applyDNS: %v", err)
+	}
+	f.set(getServers, "100.64.0.1", nil)
+	f.fail("networksetup -setdnsservers Wi-Fi 1.1.1.1", "You must run this tool as root.")
+	if err := c.revertDNS(); err == nil {
+		t.Fatal("revertDNS succeeded while the restore failed")
+	}
+	if !c.dnsSet {
+		t.Error("the DNS is no longer marked as set after the restore failed, a retry would skip it")
+	}
+}
@@ -0,0 +1,175 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/veil-net/veilnet"
+)
+
+const (
+	// resolvConfPath is the resolver configuration written by the direct-file DNS method
+	resolvConfPath = "/etc/resolv.conf"
+
+	// resolvedRunDir exists while systemd-resolved is running
+	resolvedRunDir = "/run/systemd/resolve"
+)
+
+// resolvConfBackup is where the host resolv.conf is kept while the conflux owns it
+func (c *conflux) resolvConfBackup() string {
+	return resolvConfPath + ".veilnet-" + c.opts.Interface
+}
+
+// resolveDNSMethod picks how the DNS settings are applied, detecting the active manager for auto
+func (c *conflux) resolveDNSMethod() error {
+	err := checkDNSMethod(c.opts.DNSMethod, c.opts.DNSMode)
+	if err != nil {
+		return err
+	}
+	method := c.opts.DNSMethod
+	if method == DNSMethodAuto || method == "" {
+		method = DNSMethodNone
+		if _, err := os.Stat(resolvedRunDir); err == nil {
+			method = DNSMethodSystemdResolved
+		} else if _, err := exec.LookPath("resolvconf"); err == nil && len(c.opts.DNSSearch) > 0 {
+			method = DNSMethodResolvconf
+		}
+		if method == DNSMethodNone && c.opts.DNSMode == DNSModeDoT {
+			return fmt.Errorf("DNS over TLS requires systemd-resolved, which is not running")
+		}
+		veilnet.Logger.Sugar().Infof("Using DNS method %s", method)
+	}
+	if method == DNSMethodNone && len(c.opts.DNSSearch) > 0 {
+		veilnet.Logger.Sugar().Warnf("DNS method is none, ignoring the DNS search domains")
+	}
+	c.dnsMethod = method
+	return nil
+}
+
+// resolvConf renders the resolver configuration for the tunnel
+func (c *conflux) resolvConf() string {
+	var b strings.Builder
+	b.WriteString("# Generated by VeilNet Conflux, restored on exit\n")
+	for _, server := range c.opts.DNS {
+		b.WriteString("nameserver " + server + "\n")
+	}
+	if len(c.opts.DNSSearch) > 0 {
+		b.WriteString("search " + strings.Join(c.opts.DNSSearch, " ") + "\n")
+	}
+	return b.String()
+}
+
+// applyDNS applies the DNS settings with the chosen method
+func (c *conflux) applyDNS() error {
+	switch c.dnsMethod {
+	case DNSMethodSystemdResolved:
+
+		// Set the DNS search domains
+		if len(c.opts.DNSSearch) > 0 {
+			args := append([]string{"domain", c.opts.Interface}, c.opts.DNSSearch...)
+			c.dnsApplied = true
+			if _, err := runCommand("resolvectl", args...); err != nil {
+				veilnet.Logger.Sugar().Errorf("failed to set DNS search domains: %v", err)
+				return err
+			}
+			veilnet.Logger.Sugar().Infof("Set VeilNet TUN DNS search domains to %s", strings.Join(c.opts.DNSSearch, ", "))
+		}
+
+		// Set the tunnel resolvers, systemd-resolved moves on to the next one when a server stops answering
+		if c.opts.DNSMode != DNSModeDoT {
+			args := append([]string{"dns", c.opts.Interface}, c.opts.DNS...)
+			c.dnsApplied = true
+			if _, err := runCommand("resolvectl", args...); err != nil {
+				veilnet.Logger.Sugar().Errorf("failed to set VeilNet TUN DNS: %v", err)
+				return err
+			}
+			veilnet.Logger.Sugar().Infof("Set VeilNet TUN DNS to %s", strings.Join(c.opts.DNS, ", "))
+		}
+
+		// Use DNS over TLS for the tunnel resolver
+		if c.opts.DNSMode == DNSModeDoT {
+			c.dnsApplied = true
+			if _, err := runCommand("resolvectl", "dns", c.opts.Interface, tunnelDNS+"#"+tunnelDNSName); err != nil {
+				veilnet.Logger.Sugar().Errorf("failed to set VeilNet TUN DNS: %v", err)
+				return err
+			}
+			if _, err := runCommand("resolvectl", "dnsovertls", c.opts.Interface, "yes"); err != nil {
+				veilnet.Logger.Sugar().Errorf("failed to enable DNS over TLS: %v", err)
+				return err
+			}
+			veilnet.Logger.Sugar().Infof("Set VeilNet TUN DNS to %s over TLS", tunnelDNS)
+		}
+
+	case DNSMethodResolvconf:
+
+		// Register the tunnel resolver with resolvconf under the interface name
+		c.dnsApplied = true
+		if _, err := runCommandInput(c.resolvConf(), "resolvconf", "-a", c.opts.Interface); err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to register DNS with resolvconf: %v", err)
+			return err
+		}
+		veilnet.Logger.Sugar().Infof("Registered VeilNet TUN DNS with resolvconf")
+
+	case DNSMethodDirectFile:
+
+		// Keep the host resolv.conf, a backup left by a crashed run is the original and is kept
+		backup := c.resolvConfBackup()
+		if _, err := os.Lstat(backup); err == nil {
+			veilnet.Logger.Sugar().Warnf("Found %s from a previous run, keeping it as the backup", backup)
+		} else if err := os.Rename(resolvConfPath, backup); err != nil && !os.IsNotExist(err) {
+			veilnet.Logger.Sugar().Errorf("failed to back up %s: %v", resolvConfPath, err)
+			return err
+		}
+		c.dnsApplied = true
+
+		// Write the tunnel resolver
+		if err := os.WriteFile(resolvConfPath, []byte(c.resolvConf()), 0644); err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to write %s: %v", resolvConfPath, err)
+			return err
+		}
+		veilnet.Logger.Sugar().Infof("Wrote VeilNet TUN DNS to %s, the original is kept at %s", resolvConfPath, backup)
+	}
+	return nil
+}
+
+// revertDNS undoes the DNS settings applied by applyDNS
+func (c *conflux) revertDNS() error {
+	if !c.dnsApplied {
+		return nil
+	}
+	var errs cleanupErrors
+	switch c.dnsMethod {
+	case DNSMethodSystemdResolved:
+		if _, err := runCommand("resolvectl", "revert", c.opts.Interface); err != nil {
+			errs.add("revert DNS settings", err)
+			break
+		}
+		veilnet.Logger.Sugar().Infof("Reverted VeilNet TUN DNS settings")
+
+	case DNSMethodResolvconf:
+		if _, err := runCommand("resolvconf", "-d", c.opts.Interface); err != nil {
+			errs.add("remove DNS from resolvconf", err)
+			break
+		}
+		veilnet.Logger.Sugar().Infof("Removed VeilNet TUN DNS from resolvconf")
+
+	case DNSMethodDirectFile:
+		backup := c.resolvConfBackup()
+		if _, err := os.Lstat(backup); err != nil {
+			veilnet.Logger.Sugar().Warnf("No backup of %s to restore, leaving it as is", resolvConfPath)
+			break
+		}
+		if err := os.Rename(backup, resolvConfPath); err != nil {
+			errs.add("restore "+resolvConfPath+" from "+backup, err)
+			break
+		}
+		veilnet.Logger.Sugar().Infof("Restored %s", resolvConfPath)
+	}
+	c.dnsApplied = false
+	return errs.err()
+}
@@ -0,0 +1,89 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+import (
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// drainPollInterval is how often the remaining forwarded flows are counted while draining
+const drainPollInterval = time.Second
+
+// drainRule is the FORWARD rule that drops new flows from the tunnel while draining
+func (c *conflux) drainRule() []string {
+	return []string{"-i", c.opts.Interface, "-m", "conntrack", "--ctstate", "NEW", "-m", "comment", "--comment", c.ruleComment(), "-j", "DROP"}
+}
+
+// drain stops new portal flows and waits up to the drain timeout for the established ones to finish
+// It is best effort, without conntrack the full timeout is waited and idle flows are never seen as done
+func (c *conflux) drain() {
+	if !c.portal || !c.forwardApplied || c.opts.Drain <= 0 {
+		return
+	}
+
+	// Drop new flows from the tunnel ahead of the FORWARD accept rules
+	args := append([]string{"-I", "FORWARD", "1"}, c.drainRule()...)
+	if _, err := runCommand("iptables", args...); err != nil {
+		veilnet.Logger.Sugar().Warnf("failed to stop new portal flows, skipping drain: %v", err)
+		return
+	}
+	c.drainApplied = true
+	veilnet.Logger.Sugar().Infof("Draining portal flows for up to %s", c.opts.Drain)
+
+	// Wait for the established flows to finish or the timeout
+	deadline := time.Now().Add(c.opts.Drain)
+	for time.Now().Before(deadline) {
+		n, ok := c.forwardedFlows()
+		if ok && n == 0 {
+			veilnet.Logger.Sugar().Infof("All portal flows drained")
+			return
+		}
+		time.Sleep(drainPollInterval)
+	}
+	if n, ok := c.forwardedFlows(); ok {
+		veilnet.Logger.Sugar().Warnf("Drain timeout reached with %d portal flows remaining", n)
+		return
+	}
+	veilnet.Logger.Sugar().Infof("Drain timeout reached")
+}
+
+// forwardedFlows counts the established TCP flows from the tunnel CIDR, false if conntrack is unavailable
+func (c *conflux) forwardedFlows() (int, bool) {
+	if _, err := exec.LookPath("conntrack"); err != nil {
+		return 0, false
+	}
+	_, network, err := net.ParseCIDR(c.cidr)
+	if err != nil {
+		return 0, false
+	}
+	out, err := runCommand("conntrack", "-L", "-p", "tcp", "--state", "ESTABLISHED", "-s", network.String())
+	if err != nil {
+		return 0, false
+	}
+	n := 0
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "tcp") {
+			n++
+		}
+	}
+	return n, true
+}
+
+// removeDrainRule removes the rule added by drain
+func (c *conflux) removeDrainRule() error {
+	if !c.drainApplied {
+		return nil
+	}
+	args := append([]string{"-D", "FORWARD"}, c.drainRule()...)
+	if _, err := runCommand("iptables", args...); err != nil {
+		return err
+	}
+	c.drainApplied = false
+	return nil
+}
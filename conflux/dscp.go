@@ -0,0 +1,32 @@
+package conflux
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseDSCP parses a DSCP given as a number from 0 to 63 or as a class name such as EF, AF41 or CS1
+// An empty string means no marking and returns -1
+func parseDSCP(raw string) (int, error) {
+	if raw == "" {
+		return -1, nil
+	}
+	if value, err := strconv.Atoi(raw); err == nil {
+		if value < 0 || value > 63 {
+			return 0, fmt.Errorf("invalid DSCP %s, it must be between 0 and 63", raw)
+		}
+		return value, nil
+	}
+
+	class := strings.ToUpper(raw)
+	switch {
+	case class == "EF":
+		return 46, nil
+	case len(class) == 3 && strings.HasPrefix(class, "CS") && class[2] >= '0' && class[2] <= '7':
+		return int(class[2]-'0') * 8, nil
+	case len(class) == 4 && strings.HasPrefix(class, "AF") && class[2] >= '1' && class[2] <= '4' && class[3] >= '1' && class[3] <= '3':
+		return int(class[2]-'0')*8 + int(class[3]-'0')*2, nil
+	}
+	return 0, fmt.Errorf("invalid DSCP %s, expected 0-63 or a class name such as EF, AF41 or CS1", raw)
+}
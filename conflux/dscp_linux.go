@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+import (
+	"strconv"
+
+	"github.com/veil-net/veilnet"
+)
+
+// forwardDSCPRule returns the mangle rule that marks the packets forwarded out of the tunnel with the DSCP
+func (c *conflux) forwardDSCPRule(action string, dscp int) []string {
+	return []string{"-t", "mangle", action, "FORWARD", "-i", c.opts.Interface, "-m", "comment", "--comment", c.ruleComment(), "-j", "DSCP", "--set-dscp", strconv.Itoa(dscp)}
+}
+
+// applyForwardDSCP marks the packets the portal forwards from the tunnel with the DSCP, if one is set
+func (c *conflux) applyForwardDSCP() error {
+	dscp, err := parseDSCP(c.opts.DSCP)
+	if err != nil || dscp < 0 {
+		return err
+	}
+	if _, err := runCommand("iptables", c.forwardDSCPRule("-A", dscp)...); err != nil {
+		return err
+	}
+	c.dscpApplied = true
+	veilnet.Logger.Sugar().Infof("Marking forwarded packets from VeilNet TUN with DSCP %d", dscp)
+	return nil
+}
+
+// removeForwardDSCP removes the rule added by applyForwardDSCP
+func (c *conflux) removeForwardDSCP() error {
+	if !c.dscpApplied {
+		return nil
+	}
+	dscp, _ := parseDSCP(c.opts.DSCP)
+	if _, err := runCommand("iptables", c.forwardDSCPRule("-D", dscp)...); err != nil {
+		return err
+	}
+	c.dscpApplied = false
+	veilnet.Logger.Sugar().Infof("Removed DSCP marking rule")
+	return nil
+}
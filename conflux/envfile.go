@@ -0,0 +1,114 @@
+package conflux
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/veil-net/veilnet"
+)
+
+// envKeyPattern matches the variable names allowed in an env file
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// LoadEnvFiles loads the KEY=VALUE pairs of the files given with --env-file, or VEILNET_ENV_FILE, into the
+// environment, so the flags pick them up when kong resolves them
+// Variables already in the environment are kept, later files override earlier ones, and flags given on the command
+// line take precedence over both. Only the names of the loaded variables are logged, never their values
+func LoadEnvFiles(args []string) error {
+	paths := envFileArgs(args)
+	if len(paths) == 0 {
+		for _, path := range strings.Split(os.Getenv("VEILNET_ENV_FILE"), ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	// Merge the files in order, then keep what the environment already sets
+	vars := make(map[string]string)
+	for _, path := range paths {
+		err := readEnvFile(path, vars)
+		if err != nil {
+			return err
+		}
+	}
+	var loaded []string
+	for key, value := range vars {
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		err := os.Setenv(key, value)
+		if err != nil {
+			return fmt.Errorf("failed to set %s from the env file: %v", key, err)
+		}
+		loaded = append(loaded, key)
+	}
+	if len(loaded) > 0 {
+		slices.Sort(loaded)
+		veilnet.Logger.Sugar().Infof("Loaded %s from %s", strings.Join(loaded, ", "), strings.Join(paths, ", "))
+	}
+	return nil
+}
+
+// envFileArgs returns the values of the --env-file flags on the command line, before any "--"
+func envFileArgs(args []string) []string {
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if path, ok := strings.CutPrefix(arg, "--env-file="); ok {
+			paths = append(paths, path)
+		} else if arg == "--env-file" && i+1 < len(args) {
+			paths = append(paths, args[i+1])
+			i++
+		}
+	}
+	return paths
+}
+
+// readEnvFile reads the KEY=VALUE pairs of an env file into vars
+// Blank lines and lines starting with # are skipped, an export prefix is allowed and matching quotes around the
+// value are removed
+func readEnvFile(path string, vars map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open env file: %v", err)
+	}
+	defer f.Close()
+
+	// The file usually holds the token, it should only be readable by its owner
+	info, err := f.Stat()
+	if err == nil && runtime.GOOS != "windows" && info.Mode().Perm()&0o077 != 0 {
+		veilnet.Logger.Sugar().Warnf("The env file %s is readable by other users, restrict it with chmod 600", path)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !envKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid env file %s at line %d, expected KEY=VALUE", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read env file %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+package conflux
+
+// Firewall backends for the portal FORWARD and NAT rules
+const (
+	FirewallBackendAuto      = "auto"
+	FirewallBackendIptables  = "iptables"
+	FirewallBackendFirewalld = "firewalld"
+)
@@ -0,0 +1,175 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+import (
+	"strings"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+const (
+	// firewallCheckInterval is how often the portal firewall rules are checked for having been removed, e.g. by a
+	// firewalld reload or a Docker restart
+	firewallCheckInterval = 10 * time.Second
+
+	// dockerUserChain is the chain Docker leaves to the user for FORWARD rules, evaluated before its own
+	dockerUserChain = "DOCKER-USER"
+)
+
+// firewallRule is a rule of the conflux in an iptables table and chain
+type firewallRule struct {
+	name  string
+	table string
+	chain string
+	args  []string
+}
+
+// firewalldRunning reports whether firewalld is installed and running
+func firewalldRunning() bool {
+	if _, err := lookPath("firewall-cmd"); err != nil {
+		return false
+	}
+	out, err := runCommand("firewall-cmd", "--state")
+	return err == nil && strings.TrimSpace(out) == "running"
+}
+
+// dockerChainExists reports whether Docker set up its DOCKER-USER chain
+func dockerChainExists() bool {
+	_, err := runCommand("iptables", "-n", "-L", dockerUserChain)
+	return err == nil
+}
+
+// detectFirewall picks the firewall backend, and with Docker the chain the FORWARD rules go in
+func (c *conflux) detectFirewall() {
+	running := firewalldRunning()
+	c.firewallBackend = c.opts.FirewallBackend
+	if c.firewallBackend == "" || c.firewallBackend == FirewallBackendAuto {
+		c.firewallBackend = FirewallBackendIptables
+		if running {
+			c.firewallBackend = FirewallBackendFirewalld
+		}
+	}
+	if c.firewallBackend == FirewallBackendIptables && running {
+		veilnet.Logger.Sugar().Warnf("firewalld is running, a reload drops the iptables rules of the conflux until they are added back, use --firewall-backend firewalld to add them as firewalld direct rules")
+	}
+
+	// Docker sets the FORWARD policy to drop and reorders the FORWARD chain, its DOCKER-USER chain is kept first
+	c.forwardChain = "FORWARD"
+	if c.firewallBackend == FirewallBackendIptables && dockerChainExists() {
+		c.forwardChain = dockerUserChain
+		veilnet.Logger.Sugar().Infof("Docker detected, adding the FORWARD rules to the %s chain", dockerUserChain)
+	}
+	veilnet.Logger.Sugar().Infof("Using the %s firewall backend", c.firewallBackend)
+}
+
+// forwardRule accepts the traffic forwarded in (-i) or out (-o) of the TUN
+func (c *conflux) forwardRule(dir string) firewallRule {
+	name := "inbound FORWARD rule"
+	if dir == "-o" {
+		name = "outbound FORWARD rule"
+	}
+	return firewallRule{
+		name:  name,
+		table: "filter",
+		chain: c.forwardChain,
+		args:  []string{dir, c.opts.Interface, "-m", "comment", "--comment", c.ruleComment(), "-j", "ACCEPT"},
+	}
+}
+
+// natRule masquerades the traffic leaving through the host interface
+func (c *conflux) natRule() firewallRule {
+	return firewallRule{
+		name:  "NAT rule",
+		table: "nat",
+		chain: "POSTROUTING",
+		args:  []string{"-o", c.iface, "-m", "comment", "--comment", c.ruleComment(), "-j", "MASQUERADE"},
+	}
+}
+
+// firewallCommand returns the command that adds (add), removes (remove) or checks (query) the rule on the backend
+func (c *conflux) firewallCommand(op string, r firewallRule) (string, []string) {
+	if c.firewallBackend == FirewallBackendFirewalld {
+		return "firewall-cmd", append([]string{"--direct", "--" + op + "-rule", "ipv4", r.table, r.chain, "0"}, r.args...)
+	}
+	var args []string
+	switch {
+	case op == "remove":
+		args = []string{"-D", r.chain}
+	case op == "query":
+		args = []string{"-C", r.chain}
+	case r.chain == dockerUserChain:
+		args = []string{"-I", r.chain}
+	default:
+		args = []string{"-A", r.chain}
+	}
+	return "iptables", append(append([]string{"-t", r.table}, args...), r.args...)
+}
+
+// addFirewallRule adds the rule with the firewall backend
+func (c *conflux) addFirewallRule(r firewallRule) error {
+	name, args := c.firewallCommand("add", r)
+	_, err := runCommand(name, args...)
+	return err
+}
+
+// removeFirewallRule removes the rule with the firewall backend
+func (c *conflux) removeFirewallRule(r firewallRule) error {
+	name, args := c.firewallCommand("remove", r)
+	_, err := runCommand(name, args...)
+	return err
+}
+
+// hasFirewallRule reports whether the rule is still in place
+func (c *conflux) hasFirewallRule(r firewallRule) bool {
+	name, args := c.firewallCommand("query", r)
+	_, err := runCommand(name, args...)
+	return err == nil
+}
+
+// appliedFirewallRules returns the portal firewall rules the conflux added
+func (c *conflux) appliedFirewallRules() []firewallRule {
+	var rules []firewallRule
+	if c.forwardApplied {
+		rules = append(rules, c.forwardRule("-i"), c.forwardRule("-o"))
+	}
+	if c.natApplied {
+		rules = append(rules, c.natRule())
+	}
+	return rules
+}
+
+// checkFirewall adds back the portal firewall rules that were removed behind the conflux's back
+func (c *conflux) checkFirewall() {
+	for _, r := range c.appliedFirewallRules() {
+		if c.hasFirewallRule(r) {
+			continue
+		}
+		firewallRestoresTotal.WithLabelValues(c.opts.Interface).Inc()
+		veilnet.Logger.Sugar().Warnf("The %s of %s was removed, e.g. by a firewall reload, adding it back", r.name, c.opts.Interface)
+		if err := c.addFirewallRule(r); err != nil {
+			veilnet.Logger.Sugar().Warnf("Failed to add back the %s of %s: %v", r.name, c.opts.Interface, err)
+		}
+	}
+}
+
+// watchFirewall checks the portal firewall rules every firewallCheckInterval while the conflux runs
+func (c *conflux) watchFirewall() {
+	if !c.portal {
+		return
+	}
+	ticker := time.NewTicker(firewallCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.anchor.Context().Done():
+			return
+		case <-ticker.C:
+			if c.ready.Load() {
+				c.checkFirewall()
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+import (
+	"strings"
+
+	"github.com/veil-net/veilnet"
+)
+
+// sysctlValue is a sysctl changed by the conflux and the value to restore
+type sysctlValue struct {
+	key  string
+	prev string
+}
+
+// confSysctl returns the IPv4 sysctl name for a device, in the slash form if the device name has dots, e.g. VLANs
+func confSysctl(dev, name string) string {
+	if strings.Contains(dev, ".") {
+		return "net/ipv4/conf/" + dev + "/" + name
+	}
+	return "net.ipv4.conf." + dev + "." + name
+}
+
+// forwardingSysctls returns the sysctls that let a portal forward between the tunnel and the host interface cleanly
+// Reverse path filtering is made loose, since replies can come back on another interface, and ICMP redirects are
+// turned off, since the portal is the only way to the plane
+func (c *conflux) forwardingSysctls() [][2]string {
+	sysctls := [][2]string{{confSysctl("all", "rp_filter"), "2"}}
+	for _, dev := range []string{"all", c.opts.Interface, c.iface} {
+		sysctls = append(sysctls, [2]string{confSysctl(dev, "send_redirects"), "0"}, [2]string{confSysctl(dev, "accept_redirects"), "0"})
+	}
+	return sysctls
+}
+
+// tuneForwarding applies the forwarding sysctls, keeping the previous values to restore on cleanup
+// A sysctl that cannot be set is warned about, forwarding works without it on most hosts
+func (c *conflux) tuneForwarding() {
+	for _, sysctl := range c.forwardingSysctls() {
+		key, value := sysctl[0], sysctl[1]
+		prev, err := runCommand("sysctl", "-n", key)
+		if err != nil {
+			veilnet.Logger.Sugar().Warnf("failed to read %s, leaving it alone: %v", key, err)
+			continue
+		}
+		if prev == value {
+			continue
+		}
+		if _, err := runCommand("sysctl", "-w", key+"="+value); err != nil {
+			veilnet.Logger.Sugar().Warnf("failed to set %s to %s: %v", key, value, err)
+			continue
+		}
+		c.tunedSysctls = append(c.tunedSysctls, sysctlValue{key: key, prev: prev})
+		veilnet.Logger.Sugar().Infof("Set %s to %s, was %s", key, value, prev)
+	}
+}
+
+// restoreForwarding restores the sysctls changed by tuneForwarding, in reverse order
+func (c *conflux) restoreForwarding() error {
+	var errs cleanupErrors
+	var left []sysctlValue
+	for i := len(c.tunedSysctls) - 1; i >= 0; i-- {
+		sysctl := c.tunedSysctls[i]
+		if _, err := runCommand("sysctl", "-w", sysctl.key+"="+sysctl.prev); err != nil {
+			errs.add("restore "+sysctl.key, err)
+			left = append(left, sysctl)
+			continue
+		}
+		veilnet.Logger.Sugar().Infof("Restored %s to %s", sysctl.key, sysctl.prev)
+	}
+	c.tunedSysctls = left
+	return errs.err()
+}
@@ -0,0 +1,91 @@
+package conflux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+const (
+	// gatewayAttempts is how many times the host gateway is looked up while the host has no default route
+	gatewayAttempts = 5
+
+	// gatewayRetryDelay is the wait between the lookups of the host gateway
+	gatewayRetryDelay = time.Second
+
+	// gatewayOutputLimit caps the command output quoted in a parse error
+	gatewayOutputLimit = 300
+)
+
+// errNoDefaultRoute is returned when the host has no default route to find the gateway from
+var errNoDefaultRoute = errors.New("the host has no default route")
+
+// waitGateway detects the host gateway, waiting up to WaitForNetwork for a default route to appear, ctx aborts the wait
+func (c *conflux) waitGateway(ctx context.Context) error {
+	if c.opts.WaitForNetwork > 0 {
+		return pollGateway(ctx, c.opts.WaitForNetwork, c.detectHostGateway)
+	}
+	return retryGateway(c.detectHostGateway)
+}
+
+// retryGateway runs detect until it finds the host gateway, retrying while the host has no default route, which is
+// usually momentary, e.g. during a DHCP renewal. Other errors are returned at once, a parse failure will not go away
+func retryGateway(detect func() error) error {
+	var err error
+	for attempt := 1; attempt <= gatewayAttempts; attempt++ {
+		err = detect()
+		if !errors.Is(err, errNoDefaultRoute) {
+			break
+		}
+		if attempt < gatewayAttempts {
+			veilnet.Logger.Sugar().Warnf("The host has no default route yet, retrying in %s (%d/%d)", gatewayRetryDelay, attempt, gatewayAttempts)
+			time.Sleep(gatewayRetryDelay)
+		}
+	}
+	if err != nil {
+		veilnet.Logger.Sugar().Errorf("Failed to detect the host default gateway: %v", err)
+	}
+	return err
+}
+
+// pollGateway runs detect every gatewayRetryDelay until it finds the host gateway or wait has passed, for a host whose
+// network comes up after the conflux starts, e.g. early in boot before DHCP. Other errors are returned at once
+func pollGateway(ctx context.Context, wait time.Duration, detect func() error) error {
+	deadline := time.Now().Add(wait)
+	logged := false
+	err := detect()
+	for errors.Is(err, errNoDefaultRoute) && time.Now().Before(deadline) {
+		if !logged {
+			veilnet.Logger.Sugar().Warnf("The host has no default route yet, waiting up to %s for the network", wait)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for the network aborted: %w", ctx.Err())
+		case <-time.After(gatewayRetryDelay):
+		}
+		err = detect()
+	}
+	if errors.Is(err, errNoDefaultRoute) {
+		err = fmt.Errorf("%w after waiting %s for the network", err, wait)
+	}
+	if err == nil && logged {
+		veilnet.Logger.Sugar().Infof("The network is up")
+	}
+	if err != nil {
+		veilnet.Logger.Sugar().Errorf("Failed to detect the host default gateway: %v", err)
+	}
+	return err
+}
+
+// gatewayParseError reports command output the gateway could not be parsed from, logging the full output at debug level
+func gatewayParseError(command, reason, out string) error {
+	veilnet.Logger.Sugar().Debugf("Output of %s:\n%s", command, out)
+	if len(out) > gatewayOutputLimit {
+		out = out[:gatewayOutputLimit] + "..."
+	}
+	return fmt.Errorf("failed to parse the output of %s, %s: %q", command, reason, out)
+}
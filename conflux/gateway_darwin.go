@@ -0,0 +1,84 @@
+//go:build darwin
+// +build darwin
+
+package conflux
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/veil-net/veilnet"
+)
+
+// virtualIfacePrefixes name the interfaces of VPNs and tunnels, which the bypass routes must not be pinned through
+var virtualIfacePrefixes = []string{"utun", "ipsec", "ppp", "tun", "tap", "gif", "stf"}
+
+// isVirtualIface reports whether the interface belongs to a VPN or tunnel rather than a physical network
+func isVirtualIface(name string) bool {
+	for _, prefix := range virtualIfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// chooseGateway picks the default route VeilNet is reached through, from the one route -n get default reported and
+// the others in the routing table: the one on GatewayIface if set, otherwise a physical interface over another VPN
+func (c *conflux) chooseGateway(reported defaultRoute) (defaultRoute, error) {
+	routes, err := defaultRoutes()
+	if err != nil {
+		if c.opts.GatewayIface != "" && c.opts.GatewayIface != reported.netif {
+			return defaultRoute{}, fmt.Errorf("failed to list the default routes to find %s: %v", c.opts.GatewayIface, err)
+		}
+		veilnet.Logger.Sugar().Warnf("Failed to list the default routes, using %s: %v", reported.netif, err)
+		return reported, nil
+	}
+
+	// One candidate per interface with a gateway address, the reported route first
+	var candidates []defaultRoute
+	for _, route := range append([]defaultRoute{reported}, routes...) {
+		known := slices.ContainsFunc(candidates, func(other defaultRoute) bool { return other.netif == route.netif })
+		if known || route.netif == c.opts.Interface || net.ParseIP(route.gateway) == nil {
+			continue
+		}
+		candidates = append(candidates, route)
+	}
+
+	chosen := reported
+	switch {
+	case c.opts.GatewayIface != "":
+		i := slices.IndexFunc(candidates, func(route defaultRoute) bool { return route.netif == c.opts.GatewayIface })
+		if i < 0 {
+			return defaultRoute{}, fmt.Errorf("no default route with a gateway on %s, found: %s", c.opts.GatewayIface, describeDefaultRoutes(candidates))
+		}
+		chosen = candidates[i]
+	case isVirtualIface(reported.netif) || net.ParseIP(reported.gateway) == nil:
+		i := slices.IndexFunc(candidates, func(route defaultRoute) bool { return !isVirtualIface(route.netif) })
+		if i >= 0 {
+			veilnet.Logger.Sugar().Warnf("The default route goes through %s, which looks like another VPN, using %s instead", reported.netif, candidates[i].netif)
+			chosen = candidates[i]
+		}
+	}
+
+	// Log the other default routes so the choice can be overridden
+	others := slices.DeleteFunc(candidates, func(route defaultRoute) bool { return route.netif == chosen.netif })
+	if len(others) > 0 {
+		veilnet.Logger.Sugar().Infof("Other default routes: %s, pick one with --gateway-iface", describeDefaultRoutes(others))
+	}
+	return chosen, nil
+}
+
+// describeDefaultRoutes lists default routes for the logs
+func describeDefaultRoutes(routes []defaultRoute) string {
+	if len(routes) == 0 {
+		return "none"
+	}
+	described := make([]string, len(routes))
+	for i, route := range routes {
+		described[i] = fmt.Sprintf("%s via %s", route.netif, route.gateway)
+	}
+	return strings.Join(described, ", ")
+}
@@ -0,0 +1,51 @@
+package conflux
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// authURL is the authentication server used to log in to VeilNet
+const authURL = "https://supabase.veilnet.org"
+
+// normalizeURL checks a server URL and returns it in the form the requests are built from
+// A missing scheme defaults to https, plain http is only accepted if insecure is set, and a trailing slash is dropped
+func normalizeURL(name, raw string, insecure bool) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", fmt.Errorf("%s url is not set", name)
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s url %q: %v", name, raw, err)
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !insecure {
+			return "", fmt.Errorf("%s url %s is not https, use --insecure to allow it", name, u.Redacted())
+		}
+	default:
+		return "", fmt.Errorf("invalid %s url %s, the scheme must be https", name, u.Redacted())
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("invalid %s url %s, the host is missing", name, u.Redacted())
+	}
+	if strings.ContainsAny(u.Hostname(), " _") {
+		return "", fmt.Errorf("invalid %s url %s, %q is not a valid host", name, u.Redacted(), u.Hostname())
+	}
+	if port := u.Port(); port == "" && strings.HasSuffix(u.Host, ":") {
+		return "", fmt.Errorf("invalid %s url %s, the port is missing", name, u.Redacted())
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid %s url %s, credentials, query and fragment are not allowed", name, u.Redacted())
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
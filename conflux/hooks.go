@@ -0,0 +1,59 @@
+package conflux
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/veil-net/veilnet"
+)
+
+// runUpScript runs the user supplied up script once the host is configured
+func (c *conflux) runUpScript() {
+	c.runScript("up", c.opts.UpScript)
+}
+
+// runDownScript runs the user supplied down script before the host configuration is cleaned
+func (c *conflux) runDownScript() {
+	c.runScript("down", c.opts.DownScript)
+}
+
+// runScript executes the script through the platform shell, passing the tunnel details as environment variables
+// The output and exit code are logged, a failing script never aborts the conflux
+func (c *conflux) runScript(name, script string) {
+	if script == "" {
+		return
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", script)
+	} else {
+		cmd = exec.Command("sh", "-c", script)
+	}
+	cmd.Env = append(os.Environ(),
+		"VEILNET_IFACE="+c.opts.Interface,
+		"VEILNET_CIDR="+c.cidr,
+		"VEILNET_GATEWAY="+c.gateway,
+		"VEILNET_HOST_IFACE="+c.iface,
+	)
+
+	veilnet.Logger.Sugar().Infof("Running %s script: %s", name, script)
+	out, err := cmd.CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if output != "" {
+		veilnet.Logger.Sugar().Infof("%s script output: %s", name, output)
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		veilnet.Logger.Sugar().Warnf("%s script exited with code %d", name, exitErr.ExitCode())
+	case err != nil:
+		veilnet.Logger.Sugar().Warnf("failed to run %s script: %v", name, err)
+	default:
+		veilnet.Logger.Sugar().Infof("%s script exited with code 0", name)
+	}
+}
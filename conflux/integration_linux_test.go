@@ -0,0 +1,204 @@
+//go:build linux && integration
+// +build linux,integration
+
+package conflux
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The integration tests configure a real TUN in a network namespace of their own, so the routes and firewall rules of
+// the host are never touched. They need root, run them with
+//
+//	sudo go test -tags integration -run Integration ./conflux/
+
+const (
+	// integrationNetns is the network namespace the tests run in
+	integrationNetns = "veilnet-integration"
+
+	// integrationNetnsEnv is set for the test binary running inside the namespace
+	integrationNetnsEnv = "VEILNET_INTEGRATION_NETNS"
+
+	// integrationGateway is the gateway of the uplink the namespace gets as its host interface
+	integrationGateway = "192.0.2.1"
+
+	// integrationVeilHost is the Veil Master the mock anchor reports, which gets a bypass route
+	integrationVeilHost = "203.0.113.7"
+)
+
+// inNetns reports whether the test runs inside the test namespace
+// Outside it, it creates the namespace, runs the test again in it and reports false, the caller then returns
+func inNetns(t *testing.T) bool {
+	t.Helper()
+	if os.Getenv(integrationNetnsEnv) != "" {
+		return true
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("the integration tests need root to create a network namespace")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("the integration tests need ip")
+	}
+
+	if _, err := runCommand("ip", "netns", "add", integrationNetns); err != nil {
+		t.Fatalf("failed to create the test namespace: %v", err)
+	}
+	defer runCommand("ip", "netns", "del", integrationNetns)
+
+	cmd := exec.Command("ip", "netns", "exec", integrationNetns, os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), integrationNetnsEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	t.Logf("%s", out)
+	if err != nil {
+		t.Fatalf("test failed in the namespace: %v", err)
+	}
+	return false
+}
+
+// setupUplink gives the namespace a host interface and default route, a veth pair stands in for the uplink
+func setupUplink(t *testing.T) {
+	t.Helper()
+	for _, args := range [][]string{
+		{"link", "set", "lo", "up"},
+		{"link", "add", "uplink0", "type", "veth", "peer", "name", "uplink1"},
+		{"addr", "add", "192.0.2.2/24", "dev", "uplink0"},
+		{"link", "set", "uplink0", "up"},
+		{"link", "set", "uplink1", "up"},
+		{"route", "add", "default", "via", integrationGateway, "dev", "uplink0"},
+	} {
+		if _, err := runCommand("ip", args...); err != nil {
+			t.Fatalf("failed to set up the uplink: ip %s: %v", strings.Join(args, " "), err)
+		}
+	}
+}
+
+// startIntegrationConflux creates the TUN of a conflux and configures the namespace for it as ConfigHost does on a host
+func startIntegrationConflux(t *testing.T, portal bool) *conflux {
+	t.Helper()
+	setupUplink(t)
+
+	c := newConflux(Options{
+		Interface:          "veilnet-it",
+		InterfaceUpTimeout: 5 * time.Second,
+		FirewallBackend:    FirewallBackendIptables,
+		Priority:           PriorityHigh,
+	})
+	anchor := newMockAnchor()
+	anchor.veilHost = integrationVeilHost
+	c.anchor = anchor
+	c.portal = portal
+
+	if err := c.CreateTUN(); err != nil {
+		t.Fatalf("CreateTUN: %v", err)
+	}
+	t.Cleanup(func() { c.CloseTUN() })
+	if err := c.DetectHostGateway(); err != nil {
+		t.Fatalf("DetectHostGateway: %v", err)
+	}
+	if c.gateway != integrationGateway || c.iface != "uplink0" {
+		t.Fatalf("detected gateway %s on %s, want %s on uplink0", c.gateway, c.iface, integrationGateway)
+	}
+	if err := c.ConfigHost("10.128.0.5", "16"); err != nil {
+		t.Fatalf("ConfigHost: %v", err)
+	}
+	return c
+}
+
+// hostState runs a host command that reads the state of the namespace
+func hostState(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	out, err := runCommand(name, args...)
+	if err != nil {
+		t.Fatalf("%s %s: %v", name, strings.Join(args, " "), err)
+	}
+	return out
+}
+
+// assertContains fails the test if what does not hold want
+func assertContains(t *testing.T, what, got, want string) {
+	t.Helper()
+	if !strings.Contains(got, want) {
+		t.Errorf("%s is %q, want it to hold %q", what, got, want)
+	}
+}
+
+// assertNotContains fails the test if what holds unwanted
+func assertNotContains(t *testing.T, what, got, unwanted string) {
+	t.Helper()
+	if strings.Contains(got, unwanted) {
+		t.Errorf("%s is %q, want it without %q", what, got, unwanted)
+	}
+}
+
+// assertNoLeftovers fails the test if the cleanup verification finds routes or rules of the conflux
+func assertNoLeftovers(t *testing.T, c *conflux) {
+	t.Helper()
+	leftovers, err := c.cleanupLeftovers(nil)
+	if err != nil {
+		t.Fatalf("failed to verify the cleanup: %v", err)
+	}
+	for _, leftover := range leftovers {
+		t.Errorf("left after cleanup: %s", leftover)
+	}
+}
+
+func TestIntegrationRift(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+	c := startIntegrationConflux(t, false)
+
+	assertContains(t, "the TUN addresses", hostState(t, "ip", "-4", "addr", "show", "dev", "veilnet-it"), "inet 10.128.0.5/16")
+	defaults := hostState(t, "ip", "-4", "route", "show", "default")
+	assertContains(t, "the default routes", defaults, "dev veilnet-it proto 86")
+	assertNotContains(t, "the default routes", defaults, "via "+integrationGateway)
+	bypass := hostState(t, "ip", "-4", "route", "show", integrationVeilHost)
+	assertContains(t, "the Veil Master route", bypass, "via "+integrationGateway+" dev uplink0 proto 86")
+
+	if err := c.CleanHostConfiguraions(); err != nil {
+		t.Fatalf("CleanHostConfiguraions: %v", err)
+	}
+
+	defaults = hostState(t, "ip", "-4", "route", "show", "default")
+	assertContains(t, "the default routes", defaults, "default via "+integrationGateway+" dev uplink0")
+	assertNotContains(t, "the default routes", defaults, "veilnet-it")
+	if bypass := hostState(t, "ip", "-4", "route", "show", integrationVeilHost); bypass != "" {
+		t.Errorf("the Veil Master route %q is left", bypass)
+	}
+	assertNoLeftovers(t, c)
+}
+
+func TestIntegrationPortal(t *testing.T) {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		t.Skip("the portal integration test needs iptables")
+	}
+	if !inNetns(t) {
+		return
+	}
+	forward := hostState(t, "sysctl", "-n", "net.ipv4.ip_forward")
+	c := startIntegrationConflux(t, true)
+
+	rules := hostState(t, "iptables-save")
+	comment := `--comment "` + c.ruleComment() + `"`
+	assertContains(t, "the firewall rules", rules, "-A FORWARD -i veilnet-it -m comment "+comment+" -j ACCEPT")
+	assertContains(t, "the firewall rules", rules, "-A FORWARD -o veilnet-it -m comment "+comment+" -j ACCEPT")
+	assertContains(t, "the firewall rules", rules, "-A POSTROUTING -o uplink0 -m comment "+comment+" -j MASQUERADE")
+	if got := hostState(t, "sysctl", "-n", "net.ipv4.ip_forward"); got != "1" {
+		t.Errorf("IP forwarding is %s, want it enabled", got)
+	}
+	assertContains(t, "the default routes", hostState(t, "ip", "-4", "route", "show", "default"), "default via "+integrationGateway+" dev uplink0")
+
+	if err := c.CleanHostConfiguraions(); err != nil {
+		t.Fatalf("CleanHostConfiguraions: %v", err)
+	}
+
+	assertNotContains(t, "the firewall rules", hostState(t, "iptables-save"), comment)
+	if got := hostState(t, "sysctl", "-n", "net.ipv4.ip_forward"); got != forward {
+		t.Errorf("IP forwarding is %s after the cleanup, want it back at %s", got, forward)
+	}
+	assertNoLeftovers(t, c)
+}
@@ -0,0 +1,58 @@
+package conflux
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/veil-net/veilnet"
+)
+
+// writeIPFile writes the tunnel address to IPFile, if set, as shell variables other processes can read or source
+// The file is replaced in one rename so a reader never sees it half written
+func (c *conflux) writeIPFile() {
+	if c.opts.IPFile == "" {
+		return
+	}
+	ip, _, err := net.ParseCIDR(c.cidr)
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("Failed to write the IP file %s: invalid CIDR format: %s", c.opts.IPFile, c.cidr)
+		return
+	}
+	content := fmt.Sprintf("VEILNET_IFACE=%s\nVEILNET_IP=%s\nVEILNET_CIDR=%s\n", c.opts.Interface, ip, c.cidr)
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.opts.IPFile), filepath.Base(c.opts.IPFile)+".*")
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("Failed to write the IP file %s: %v", c.opts.IPFile, err)
+		return
+	}
+	_, err = tmp.WriteString(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.opts.IPFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		veilnet.Logger.Sugar().Warnf("Failed to write the IP file %s: %v", c.opts.IPFile, err)
+		return
+	}
+	veilnet.Logger.Sugar().Infof("Wrote the tunnel address %s to %s", c.cidr, c.opts.IPFile)
+}
+
+// removeIPFile removes the file written by writeIPFile, if any
+func (c *conflux) removeIPFile() {
+	if c.opts.IPFile == "" {
+		return
+	}
+	err := os.Remove(c.opts.IPFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		veilnet.Logger.Sugar().Warnf("Failed to remove the IP file %s: %v", c.opts.IPFile, err)
+	}
+}
@@ -0,0 +1,31 @@
+package conflux
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// linkPollInterval is how often the interface state is checked while waiting for it to come up
+const linkPollInterval = 100 * time.Millisecond
+
+// waitInterfaceUp waits until the interface is up and running, failing after timeout
+func waitInterfaceUp(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		iface, err := net.InterfaceByName(name)
+		if err == nil && iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagRunning != 0 {
+			veilnet.Logger.Sugar().Infof("Interface %s is up", name)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("interface %s did not come up within %s: %v", name, timeout, err)
+			}
+			return fmt.Errorf("interface %s did not come up within %s, flags: %s", name, timeout, iface.Flags)
+		}
+		time.Sleep(linkPollInterval)
+	}
+}
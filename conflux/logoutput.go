@@ -0,0 +1,68 @@
+package conflux
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/veil-net/veilnet"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Log outputs the logger can be sent to
+const (
+	LogOutputStderr   = "stderr"
+	LogOutputSyslog   = "syslog"
+	LogOutputJournald = "journald"
+	LogOutputFile     = "file"
+)
+
+// logIdentifier tags the conflux logs in syslog and the journal
+const logIdentifier = "veilnet-conflux"
+
+// SetLogOutput sends the logs to the chosen output, file appends them to path
+// The logs keep the JSON encoding and info level of the default logger, system logs also get the severity of each entry
+func SetLogOutput(output, path string) error {
+	config := zap.NewProductionConfig()
+	encoder := zapcore.NewJSONEncoder(config.EncoderConfig)
+	var core zapcore.Core
+	switch output {
+	case LogOutputStderr, "":
+		return nil
+
+	case LogOutputFile:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		core = zapcore.NewCore(encoder, zapcore.AddSync(f), config.Level)
+
+	case LogOutputSyslog, LogOutputJournald:
+		writer, err := systemLog(output)
+		if err != nil {
+			return err
+		}
+		if writer == nil {
+			return nil
+		}
+
+		// Route each level to the writer of its severity, everything above error counts as an error
+		var cores []zapcore.Core
+		for _, level := range []zapcore.Level{zapcore.DebugLevel, zapcore.InfoLevel, zapcore.WarnLevel, zapcore.ErrorLevel} {
+			enabled := zap.LevelEnablerFunc(func(l zapcore.Level) bool {
+				return config.Level.Enabled(l) && (l == level || (level == zapcore.ErrorLevel && l > level))
+			})
+			cores = append(cores, zapcore.NewCore(encoder.Clone(), zapcore.AddSync(writer(level)), enabled))
+		}
+		core = zapcore.NewTee(cores...)
+
+	default:
+		return fmt.Errorf("invalid log output %s, must be stderr, syslog, journald or file", output)
+	}
+	veilnet.Logger = zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
+	return nil
+}
+
+// levelWriter returns the writer for the entries of a level
+type levelWriter func(level zapcore.Level) io.Writer
@@ -0,0 +1,14 @@
+//go:build darwin
+// +build darwin
+
+package conflux
+
+import "github.com/veil-net/veilnet"
+
+// systemLog opens the syslog writers, macOS has no journald and its syslog feeds the unified log
+func systemLog(output string) (levelWriter, error) {
+	if output == LogOutputJournald {
+		veilnet.Logger.Sugar().Warnf("journald is only available on Linux, logging to syslog instead")
+	}
+	return syslogWriter()
+}
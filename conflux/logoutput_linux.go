@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// journalSocket is where journald takes entries in its native protocol
+const journalSocket = "/run/systemd/journal/socket"
+
+// systemLog opens the syslog or journald writers
+func systemLog(output string) (levelWriter, error) {
+	if output == LogOutputJournald {
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to journald, is it running? %v", err)
+		}
+		return func(level zapcore.Level) io.Writer {
+			return &journalWriter{conn: conn, priority: journalPriority(level)}
+		}, nil
+	}
+	return syslogWriter()
+}
+
+// journalWriter writes each log line as a journal entry with a fixed priority
+type journalWriter struct {
+	conn     *net.UnixConn
+	priority int
+}
+
+func (w *journalWriter) Write(p []byte) (int, error) {
+	var b strings.Builder
+	b.WriteString("PRIORITY=" + strconv.Itoa(w.priority) + "\n")
+	b.WriteString("SYSLOG_IDENTIFIER=" + logIdentifier + "\n")
+	b.WriteString("MESSAGE=" + strings.TrimRight(string(p), "\n") + "\n")
+	if _, err := w.conn.Write([]byte(b.String())); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// journalPriority maps a log level to its syslog priority
+func journalPriority(level zapcore.Level) int {
+	switch level {
+	case zapcore.DebugLevel:
+		return 7
+	case zapcore.InfoLevel:
+		return 6
+	case zapcore.WarnLevel:
+		return 4
+	default:
+		return 3
+	}
+}
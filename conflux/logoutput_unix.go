@@ -0,0 +1,50 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package conflux
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// syslogWriter connects to the local syslog daemon
+func syslogWriter() (levelWriter, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, logIdentifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+	}
+	return syslogLevels(w), nil
+}
+
+// syslogLevels writes each level to syslog with its severity
+func syslogLevels(w *syslog.Writer) levelWriter {
+	return func(level zapcore.Level) io.Writer {
+		return syslogFunc(func(m string) error {
+			switch level {
+			case zapcore.DebugLevel:
+				return w.Debug(m)
+			case zapcore.InfoLevel:
+				return w.Info(m)
+			case zapcore.WarnLevel:
+				return w.Warning(m)
+			default:
+				return w.Err(m)
+			}
+		})
+	}
+}
+
+// syslogFunc adapts a syslog severity method to an io.Writer
+type syslogFunc func(m string) error
+
+func (f syslogFunc) Write(p []byte) (int, error) {
+	if err := f(strings.TrimRight(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package conflux
+
+import "github.com/veil-net/veilnet"
+
+// systemLog keeps the logs on stderr, Windows has neither syslog nor journald
+func systemLog(output string) (levelWriter, error) {
+	veilnet.Logger.Sugar().Warnf("%s is not available on Windows, logging to stderr, use --log-output file to keep the logs", output)
+	return nil, nil
+}
@@ -0,0 +1,78 @@
+package conflux
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// logSampling is the interval over which the repeats of a hot path log line are coalesced, zero logs every one
+var logSampling atomic.Int64
+
+// SetLogSampling sets the interval over which the repeats of an error logged from a packet loop are coalesced into one
+// line, zero logs every occurrence
+func SetLogSampling(interval time.Duration) {
+	logSampling.Store(int64(interval))
+}
+
+// sampledLog coalesces the repeats of an error logged from a hot path: the first is logged at once, the identical ones
+// in the sampling interval after it are counted and reported together once it is over
+type sampledLog struct {
+	mu      sync.Mutex
+	msg     string
+	since   time.Time
+	repeats int
+	timer   *time.Timer
+}
+
+// errorf logs the error unless it repeats the one logged last within the sampling interval
+func (s *sampledLog) errorf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	interval := time.Duration(logSampling.Load())
+	if interval <= 0 {
+		veilnet.Logger.Sugar().Error(msg)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if msg == s.msg && now.Sub(s.since) < interval {
+		s.repeats++
+		if s.timer == nil {
+			s.timer = time.AfterFunc(interval-now.Sub(s.since), s.report)
+		}
+		return
+	}
+
+	// A different error ends the interval of the last one early
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.flush(now)
+	veilnet.Logger.Sugar().Error(msg)
+	s.msg = msg
+	s.since = now
+}
+
+// report logs the repeats counted in the interval that just ended
+func (s *sampledLog) report() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timer = nil
+	s.flush(time.Now())
+	s.msg = ""
+}
+
+// flush logs the repeats of the last error counted so far, if any
+func (s *sampledLog) flush(now time.Time) {
+	if s.repeats == 0 {
+		return
+	}
+	veilnet.Logger.Sugar().Errorf("%s (%d more occurrences in the last %s)", s.msg, s.repeats, now.Sub(s.since).Round(time.Second))
+	s.repeats = 0
+}
@@ -0,0 +1,263 @@
+package conflux
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/veil-net/veilnet"
+)
+
+const (
+	// singleBatchWarnCount is the number of consecutive single packet batches before warning
+	singleBatchWarnCount = 10000
+
+	// singleBatchWarnWindow is the time in which the single packet batches must arrive to count as sustained load
+	singleBatchWarnWindow = 10 * time.Second
+
+	// oversizedLogEvery is the number of oversized packets dropped between log lines
+	oversizedLogEvery = 1000
+
+	// writeLogEvery is the number of failed or partial TUN writes between log lines
+	writeLogEvery = 1000
+)
+
+var (
+	batchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "veilnet_conflux_batches_total",
+		Help: "The number of packet batches processed by the conflux",
+	}, []string{"direction"})
+
+	packetsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "veilnet_conflux_packets_total",
+		Help: "The number of packets processed by the conflux",
+	}, []string{"direction"})
+
+	bytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "veilnet_conflux_bytes_total",
+		Help: "The number of bytes processed by the conflux",
+	}, []string{"direction"})
+
+	batchSizeAverage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "veilnet_conflux_batch_size_average",
+		Help: "The average number of packets per batch",
+	}, []string{"direction"})
+
+	oversizedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "veilnet_conflux_oversized_packets_total",
+		Help: "The number of packets dropped for being larger than the TUN MTU",
+	}, []string{"direction"})
+
+	unreadyTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "veilnet_conflux_unready_packets_total",
+		Help: "The number of packets dropped because the TUN was not configured yet or was being torn down",
+	}, []string{"direction"})
+
+	writeErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "veilnet_conflux_tun_write_errors_total",
+		Help: "The number of batch writes to the TUN that failed, the rest of the batch is dropped",
+	}, []string{"direction"})
+
+	partialWritesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "veilnet_conflux_tun_partial_writes_total",
+		Help: "The number of batch writes to the TUN that took only part of the batch",
+	}, []string{"direction"})
+
+	writeDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "veilnet_conflux_tun_write_dropped_packets_total",
+		Help: "The number of packets the TUN still did not take after the partial writes were retried",
+	}, []string{"direction"})
+
+	rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "veilnet_conflux_packet_rate_limited_total",
+		Help: "The number of times a packet loop was held at the --max-packet-rate cap",
+	}, []string{"direction"})
+
+	queueDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "veilnet_conflux_queue_dropped_packets_total",
+		Help: "The number of packets dropped because the --queue-depth queue was full",
+	}, []string{"direction"})
+
+	queueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "veilnet_conflux_queue_length",
+		Help: "The number of batches waiting in the --queue-depth queue",
+	}, []string{"direction"})
+
+	mtuResetsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "veilnet_conflux_mtu_resets_total",
+		Help: "The number of times the MTU of the TUN was found reset and set back",
+	}, []string{"interface"})
+
+	firewallRestoresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "veilnet_conflux_firewall_restores_total",
+		Help: "The number of portal firewall rules found removed, e.g. by a firewall reload, and added back",
+	}, []string{"interface"})
+
+	connectDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "veilnet_conflux_connect_duration_seconds",
+		Help: "How long the last startup took, from the gateway detection until the host was configured",
+	}, []string{"interface"})
+
+	connectPhaseDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "veilnet_conflux_connect_phase_duration_seconds",
+		Help: "How long each phase of the last startup took: detect, anchor, cidr or config",
+	}, []string{"interface", "phase"})
+)
+
+// ServeMetrics serves the Prometheus metrics on the given address
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		veilnet.Logger.Sugar().Infof("Serving metrics on %s/metrics", addr)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			veilnet.Logger.Sugar().Errorf("failed to serve metrics: %v", err)
+		}
+	}()
+}
+
+// batchStats tracks the batch sizes seen by a packet loop, it is not safe for concurrent use
+type batchStats struct {
+	direction string
+	batches   uint64
+	packets   uint64
+	singles   int
+	since     time.Time
+	warned    bool
+	oversized uint64
+	unready   uint64
+	failed    uint64
+	partial   uint64
+	shortfall uint64
+}
+
+func newBatchStats(direction string) *batchStats {
+	return &batchStats{direction: direction}
+}
+
+// observe records a batch of n packets read from a source that can deliver up to batchSize packets
+func (s *batchStats) observe(n, batchSize int) {
+	if n <= 0 {
+		return
+	}
+
+	s.batches++
+	s.packets += uint64(n)
+	batchesTotal.WithLabelValues(s.direction).Inc()
+	packetsTotal.WithLabelValues(s.direction).Add(float64(n))
+	batchSizeAverage.WithLabelValues(s.direction).Set(float64(s.packets) / float64(s.batches))
+
+	// Only warn once, and only if the source is able to batch at all
+	if s.warned || batchSize <= 1 {
+		return
+	}
+	if n != 1 {
+		s.singles = 0
+		return
+	}
+	if s.singles == 0 {
+		s.since = time.Now()
+	}
+	s.singles++
+	if s.singles >= singleBatchWarnCount {
+		if time.Since(s.since) <= singleBatchWarnWindow {
+			veilnet.Logger.Sugar().Warnf("%s batches are consistently a single packet under load, throughput may be degraded", s.direction)
+			s.warned = true
+		}
+		s.singles = 0
+	}
+}
+
+// observeBytes records the bytes of the packets passed on
+func (s *batchStats) observeBytes(bytes int) {
+	if bytes > 0 {
+		bytesTotal.WithLabelValues(s.direction).Add(float64(bytes))
+	}
+}
+
+// dropOversized removes the packets in bufs[:n] larger than mtu, returning the number of packets kept
+func (s *batchStats) dropOversized(bufs [][]byte, n, mtu int) int {
+	kept := 0
+	for i := 0; i < n; i++ {
+		if len(bufs[i]) <= mtu {
+			bufs[kept] = bufs[i]
+			kept++
+			continue
+		}
+
+		oversizedTotal.WithLabelValues(s.direction).Inc()
+		if s.oversized%oversizedLogEvery == 0 {
+			veilnet.Logger.Sugar().Warnf("Dropped %s packet of %d bytes, larger than the TUN MTU of %d, check the MTU on both ends (%d dropped so far)", s.direction, len(bufs[i]), mtu, s.oversized+1)
+		}
+		s.oversized++
+	}
+	return kept
+}
+
+// dropUnready records n packets dropped because the TUN is not ready for them
+func (s *batchStats) dropUnready(n int) {
+	unreadyTotal.WithLabelValues(s.direction).Add(float64(n))
+	if s.unready == 0 {
+		veilnet.Logger.Sugar().Infof("Dropping %s packets while the TUN is not configured", s.direction)
+	}
+	s.unready += uint64(n)
+}
+
+// writeFailed records a batch write of n packets to the TUN that failed with err
+func (s *batchStats) writeFailed(n int, err error) {
+	writeErrorsTotal.WithLabelValues(s.direction).Inc()
+	if s.failed%writeLogEvery == 0 {
+		veilnet.Logger.Sugar().Warnf("Failed to write a batch of %d %s packets to the TUN, dropping it (%d failed so far): %v", n, s.direction, s.failed+1, err)
+	}
+	s.failed++
+}
+
+// partialWrite records a batch write to the TUN that took only part of the batch
+func (s *batchStats) partialWrite() {
+	partialWritesTotal.WithLabelValues(s.direction).Inc()
+	s.partial++
+}
+
+// writeDropped records n packets the TUN did not take after the retries
+func (s *batchStats) writeDropped(n int) {
+	writeDroppedTotal.WithLabelValues(s.direction).Add(float64(n))
+	if s.shortfall%writeLogEvery == 0 {
+		veilnet.Logger.Sugar().Warnf("Dropped %d %s packets the TUN did not take after %d retries (%d partial writes so far)", n, s.direction, maxWriteRetries, s.partial)
+	}
+	s.shortfall++
+}
+
+var (
+	sessionUptimeDesc = prometheus.NewDesc("veilnet_conflux_session_uptime_seconds",
+		"The time the anchor has been connected in the current session", []string{"interface"}, nil)
+	totalUptimeDesc = prometheus.NewDesc("veilnet_conflux_uptime_seconds_total",
+		"The total time the anchor has been connected", []string{"interface"}, nil)
+)
+
+// sessionCollector exposes the session of a conflux as metrics
+type sessionCollector struct {
+	iface   string
+	session *session
+}
+
+func (s *sessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionUptimeDesc
+	ch <- totalUptimeDesc
+}
+
+func (s *sessionCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := s.session.stats()
+	ch <- prometheus.MustNewConstMetric(sessionUptimeDesc, prometheus.GaugeValue, stats.SessionUptime.Seconds(), s.iface)
+	ch <- prometheus.MustNewConstMetric(totalUptimeDesc, prometheus.CounterValue, stats.TotalUptime.Seconds(), s.iface)
+}
+
+// registerSession exposes the session of the conflux on the given interface as metrics
+func registerSession(iface string, s *session) {
+	err := prometheus.Register(&sessionCollector{iface: iface, session: s})
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("failed to register session metrics for %s: %v", iface, err)
+	}
+}
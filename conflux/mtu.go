@@ -0,0 +1,58 @@
+package conflux
+
+import (
+	"net"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+const (
+	// tunMTU is the MTU of the TUN interface
+	tunMTU = 1500
+
+	// mtuCheckInterval is how often the MTU of the TUN is checked for having been reset, e.g. by an adapter flap
+	mtuCheckInterval = 10 * time.Second
+)
+
+// checkMTU sets the MTU of the TUN back to tunMTU if it differs, counting it as a reset unless it is the initial check
+// An inherited TUN is left to its parent
+func (c *conflux) checkMTU(initial bool) {
+	if c.opts.TUNFd != 0 {
+		return
+	}
+	iface, err := net.InterfaceByName(c.opts.Interface)
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("Failed to read the MTU of %s: %v", c.opts.Interface, err)
+		return
+	}
+	if iface.MTU == tunMTU {
+		return
+	}
+	if !initial {
+		mtuResetsTotal.WithLabelValues(c.opts.Interface).Inc()
+		veilnet.Logger.Sugar().Warnf("The MTU of %s was reset to %d, setting it back to %d", c.opts.Interface, iface.MTU, tunMTU)
+	}
+	err = c.setMTU(tunMTU)
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("Failed to set the MTU of %s to %d: %v", c.opts.Interface, tunMTU, err)
+		return
+	}
+	veilnet.Logger.Sugar().Infof("Set the MTU of %s to %d", c.opts.Interface, tunMTU)
+}
+
+// watchMTU checks the MTU of the TUN every mtuCheckInterval while the conflux runs
+func (c *conflux) watchMTU() {
+	ticker := time.NewTicker(mtuCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.anchor.Context().Done():
+			return
+		case <-ticker.C:
+			if c.ready.Load() {
+				c.checkMTU(false)
+			}
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build darwin
+// +build darwin
+
+package conflux
+
+import (
+	"strconv"
+)
+
+// setMTU sets the MTU of the utun interface
+func (c *conflux) setMTU(mtu int) error {
+	_, err := runCommand("ifconfig", c.opts.Interface, "mtu", strconv.Itoa(mtu))
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+import (
+	"strconv"
+)
+
+// setMTU sets the MTU of the TUN interface
+func (c *conflux) setMTU(mtu int) error {
+	_, err := runCommand("ip", "link", "set", "dev", c.opts.Interface, "mtu", strconv.Itoa(mtu))
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package conflux
+
+import (
+	"strconv"
+)
+
+// setMTU sets the IPv4 MTU of the wintun adapter, for the running session only since the adapter is recreated at startup
+func (c *conflux) setMTU(mtu int) error {
+	_, err := runNetCommand("netsh", "interface", "ipv4", "set", "subinterface", c.opts.Interface, "mtu="+strconv.Itoa(mtu), "store=active")
+	return err
+}
@@ -0,0 +1,8 @@
+package conflux
+
+// TUN offload modes
+const (
+	OffloadAuto = "auto"
+	OffloadOn   = "on"
+	OffloadOff  = "off"
+)
@@ -0,0 +1,100 @@
+package conflux
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// benchPacketSize is the size of the packets the offload benchmarks move, a full packet at the default MTU
+const benchPacketSize = 1400
+
+// benchAnchor is an anchor that always has packets to read and stops once it has been written count packets
+type benchAnchor struct {
+	*mockAnchor
+	packet []byte
+	left   atomic.Int64
+}
+
+func (a *benchAnchor) Read(bufs [][]byte, batchSize int) int {
+	for i := range batchSize {
+		bufs[i] = a.packet
+	}
+	return batchSize
+}
+
+func (a *benchAnchor) Write(bufs [][]byte, sizes []int) int {
+	a.done(len(bufs))
+	return len(bufs)
+}
+
+// done records n packets passed on, stopping the anchor once the benchmark moved enough
+func (a *benchAnchor) done(n int) {
+	if a.left.Add(-int64(n)) <= 0 {
+		a.cancel()
+	}
+}
+
+// benchDevice is a TUN that always has packets to read and takes every write, reporting them to anchor
+type benchDevice struct {
+	batchSize int
+	packet    []byte
+	anchor    *benchAnchor
+}
+
+func (d *benchDevice) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	for i := range d.batchSize {
+		sizes[i] = copy(bufs[i][offset:], d.packet)
+	}
+	return d.batchSize, nil
+}
+
+func (d *benchDevice) Write(bufs [][]byte, offset int) (int, error) {
+	d.anchor.done(len(bufs))
+	return len(bufs), nil
+}
+
+func (d *benchDevice) BatchSize() int {
+	return d.batchSize
+}
+
+func (d *benchDevice) MTU() (int, error) {
+	return 1500, nil
+}
+
+// BenchmarkOffload compares the packet loops with the TUN offloads on, where the device batches and needs room for the
+// virtio header, and off, where it moves one plain packet per call
+// It measures the cost on the conflux side only, the kernel segmentation and coalescing are not part of it
+func BenchmarkOffload(b *testing.B) {
+	modes := []struct {
+		offload   string
+		batchSize int
+		offset    int
+	}{
+		{OffloadOn, conn.IdealBatchSize, virtioNetHdrLen},
+		{OffloadOff, 1, 0},
+	}
+	for _, mode := range modes {
+		for _, direction := range []string{"ingress", "egress"} {
+			b.Run(fmt.Sprintf("%s/%s", mode.offload, direction), func(b *testing.B) {
+				packet := make([]byte, benchPacketSize)
+				packet[0] = 0x45
+				anchor := &benchAnchor{mockAnchor: newMockAnchor(), packet: packet}
+				anchor.left.Store(int64(b.N))
+				device := &benchDevice{batchSize: mode.batchSize, packet: packet, anchor: anchor}
+				p := newPump(device, anchor, mode.offset)
+
+				b.SetBytes(benchPacketSize)
+				b.ReportAllocs()
+				b.ResetTimer()
+				if direction == "ingress" {
+					p.ingress()
+				} else {
+					p.egress()
+				}
+			})
+		}
+	}
+}
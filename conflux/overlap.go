@@ -0,0 +1,75 @@
+package conflux
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/veil-net/veilnet"
+)
+
+// checkOverlaps reports when the assigned CIDR overlaps the host subnet, the host gateway or a bypass host
+// Overlaps are logged as warnings, and fail the startup if Strict is set
+func (c *conflux) checkOverlaps(cidr string) error {
+	_, veilNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR format: %s", cidr)
+	}
+
+	var conflicts []string
+	for _, subnet := range hostSubnets(c.iface) {
+		if veilNet.Contains(subnet.IP) || subnet.Contains(veilNet.IP) {
+			conflicts = append(conflicts, fmt.Sprintf("host subnet %s on %s", subnet, c.iface))
+		}
+	}
+	if gateway := net.ParseIP(c.gateway); gateway != nil && veilNet.Contains(gateway) {
+		conflicts = append(conflicts, fmt.Sprintf("host gateway %s", c.gateway))
+	}
+	c.bypassRoutes.Range(func(key, value interface{}) bool {
+		if ip := net.ParseIP(key.(string)); ip != nil && veilNet.Contains(ip) {
+			conflicts = append(conflicts, fmt.Sprintf("bypass host %s (%s)", value, key))
+		}
+		return true
+	})
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("assigned CIDR %s overlaps %s, traffic may be routed to the wrong place", cidr, strings.Join(conflicts, ", "))
+	if c.opts.Strict {
+		return fmt.Errorf("%s", msg)
+	}
+	veilnet.Logger.Sugar().Warnf("%s", msg)
+	return nil
+}
+
+// hostSubnets returns the IPv4 subnets of the host interface, identified by name or by one of its addresses
+func hostSubnets(iface string) []*net.IPNet {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	for _, i := range ifaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		var subnets []*net.IPNet
+		match := i.Name == iface
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			if ipNet.IP.String() == iface {
+				match = true
+			}
+			subnets = append(subnets, &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask})
+		}
+		if match {
+			return subnets
+		}
+	}
+	return nil
+}
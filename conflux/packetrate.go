@@ -0,0 +1,56 @@
+package conflux
+
+import (
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// packetRateLogEvery is the minimum time between log lines about a packet loop being held at its rate cap
+const packetRateLogEvery = 10 * time.Second
+
+// packetLimiter caps the packets a loop processes per second with a token bucket holding one second of packets
+// A nil limiter does not limit
+type packetLimiter struct {
+	direction string
+	rate      float64
+	tokens    float64
+	last      time.Time
+	limited   uint64
+	logged    time.Time
+}
+
+// newPacketLimiter creates a limiter for rate packets per second, nil if rate is not positive
+func newPacketLimiter(direction string, rate int) *packetLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &packetLimiter{direction: direction, rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take accounts for n packets, sleeping until the bucket has refilled if they exceed the rate
+func (l *packetLimiter) take(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	// Refill the bucket for the time since the last call, up to one second of packets
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return
+	}
+
+	// Hold the loop until the deficit is paid back
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	rateLimitedTotal.WithLabelValues(l.direction).Inc()
+	l.limited++
+	if now.Sub(l.logged) >= packetRateLogEvery {
+		veilnet.Logger.Sugar().Warnf("The %s loop hit the packet rate cap of %.0f/s and was held %d times, a peer may be flooding it or the loop may be spinning", l.direction, l.rate, l.limited)
+		l.logged = now
+		l.limited = 0
+	}
+	time.Sleep(delay)
+}
@@ -0,0 +1,222 @@
+package conflux
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// plane is a conflux run by up-multi together with its control interface
+type plane struct {
+	instance     MultiInstance
+	conflux      Conflux
+	closeControl func()
+}
+
+// planes are the confluxes run by up-multi, planes can join and leave over the control interface while it runs
+type planes struct {
+	cmd      *UpMulti
+	ctx      context.Context
+	stopChan chan chan error
+
+	// ops serializes joins, leaves and the shutdown, mu guards running
+	ops     sync.Mutex
+	mu      sync.Mutex
+	running map[string]*plane
+	order   []string
+	closed  bool
+}
+
+// newPlanes creates an empty set of planes, ctx aborts the startup of joining planes
+func newPlanes(cmd *UpMulti, ctx context.Context, stopChan chan chan error) *planes {
+	return &planes{cmd: cmd, ctx: ctx, stopChan: stopChan, running: make(map[string]*plane)}
+}
+
+// start starts the conflux of an instance already checked against the running planes and serves its control interface
+func (p *planes) start(instance MultiInstance) error {
+	// Instances run with the up defaults, up-multi does not take the settings of up
+	c := NewConflux(Options{
+		Interface:          instance.Iface,
+		TUNGUID:            instance.TUNGUID,
+		SystemWintun:       p.cmd.SystemWintun,
+		WaitForNetwork:     p.cmd.WaitForNetwork,
+		Fallback:           true,
+		ExitOnAnchorLoss:   true,
+		TuneForwarding:     true,
+		DNSMode:            DNSModeUDP,
+		DisableIPv6:        true,
+		AnchorTimeout:      30 * time.Second,
+		InterfaceUpTimeout: 10 * time.Second,
+	})
+
+	veilnet.Logger.Sugar().Infof("Starting conflux on %s", instance.Iface)
+	err := c.Start(p.ctx, instance.Guardian, instance.Token, instance.Portal)
+	if err != nil {
+		return err
+	}
+	pl := &plane{instance: instance, conflux: c, closeControl: func() {}}
+
+	// Serve the control interface of the instance
+	closeControl, err := ServeControl(instance.Iface, p.controlHandler(c))
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("Control interface for %s unavailable: %v", instance.Iface, err)
+	} else {
+		pl.closeControl = closeControl
+	}
+
+	p.mu.Lock()
+	p.running[instance.Iface] = pl
+	p.order = append(p.order, instance.Iface)
+	p.mu.Unlock()
+	return nil
+}
+
+// startAll starts the instances of the config file one at a time, stopping at the first that fails
+func (p *planes) startAll(instances []MultiInstance) error {
+	p.ops.Lock()
+	defer p.ops.Unlock()
+	for _, instance := range instances {
+		err := p.start(instance)
+		if err != nil {
+			return fmt.Errorf("failed to start conflux on %s: %v", instance.Iface, err)
+		}
+	}
+	return nil
+}
+
+// join checks an instance against the running planes and starts it
+func (p *planes) join(instance MultiInstance) error {
+	p.ops.Lock()
+	defer p.ops.Unlock()
+	if p.closed {
+		return fmt.Errorf("up-multi is shutting down")
+	}
+
+	var others []MultiInstance
+	for _, pl := range p.list() {
+		others = append(others, pl.instance)
+	}
+	err := p.cmd.checkInstance(&instance, others)
+	if err != nil {
+		return err
+	}
+	err = p.start(instance)
+	if err != nil {
+		return fmt.Errorf("failed to start conflux on %s: %v", instance.Iface, err)
+	}
+	veilnet.Logger.Sugar().Infof("Plane on %s joined", instance.Iface)
+	return nil
+}
+
+// leave stops the plane on iface, the last plane cannot leave since up-multi could then no longer be reached
+func (p *planes) leave(iface string) error {
+	p.ops.Lock()
+	defer p.ops.Unlock()
+	if p.closed {
+		return fmt.Errorf("up-multi is shutting down")
+	}
+
+	p.mu.Lock()
+	pl, ok := p.running[iface]
+	last := len(p.running) == 1
+	p.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no plane is running on %s", iface)
+	}
+	if last {
+		return fmt.Errorf("%s is the last plane, stop it with down instead", iface)
+	}
+
+	veilnet.Logger.Sugar().Infof("Stopping conflux on %s", iface)
+	err := stopAll([]Conflux{pl.conflux})
+
+	p.mu.Lock()
+	delete(p.running, iface)
+	for i, name := range p.order {
+		if name == iface {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	// The request may have come in over the control interface being closed, let it answer first
+	go pl.closeControl()
+	if err != nil {
+		return err
+	}
+	veilnet.Logger.Sugar().Infof("Plane on %s left", iface)
+	return nil
+}
+
+// stop stops every plane and closes their control interfaces, no plane can join or leave afterwards
+func (p *planes) stop() error {
+	p.ops.Lock()
+	defer p.ops.Unlock()
+	p.closed = true
+
+	var confluxes []Conflux
+	for _, pl := range p.list() {
+		confluxes = append(confluxes, pl.conflux)
+	}
+	err := stopAll(confluxes)
+	for _, pl := range p.list() {
+		pl.closeControl()
+	}
+	return err
+}
+
+// list returns the running planes in the order they were started
+func (p *planes) list() []*plane {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]*plane, 0, len(p.order))
+	for _, iface := range p.order {
+		list = append(list, p.running[iface])
+	}
+	return list
+}
+
+// interfaces returns the interfaces of the running planes, sorted
+func (p *planes) interfaces() []string {
+	var ifaces []string
+	for _, pl := range p.list() {
+		ifaces = append(ifaces, pl.instance.Iface)
+	}
+	sort.Strings(ifaces)
+	return ifaces
+}
+
+// controlHandler extends the handler of a single conflux with joining and leaving planes, and lists them in the status
+func (p *planes) controlHandler(c Conflux) ControlHandler {
+	handler := controlHandler(func() Conflux { return c }, p.stopChan)
+	return func(req ControlRequest) ControlResponse {
+		switch req.Command {
+		case ControlStatus:
+			resp := handler(req)
+			if resp.Status != nil {
+				resp.Status.Planes = p.interfaces()
+			}
+			return resp
+		case ControlJoin:
+			if req.Instance == nil {
+				return ControlResponse{Error: "join needs an instance"}
+			}
+			if err := p.join(*req.Instance); err != nil {
+				return ControlResponse{Error: err.Error()}
+			}
+			return ControlResponse{OK: true}
+		case ControlLeave:
+			if err := p.leave(req.Iface); err != nil {
+				return ControlResponse{Error: err.Error()}
+			}
+			return ControlResponse{OK: true}
+		default:
+			return handler(req)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package conflux
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/veil-net/veilnet"
+)
+
+// Route priorities accepted by --priority, besides metric:N
+const (
+	PriorityHigh = "high"
+	PriorityLow  = "low"
+)
+
+// parsePriority validates a priority, returning the metric of metric:N or -1 for high and low
+func parsePriority(priority string) (int, error) {
+	switch priority {
+	case PriorityHigh, PriorityLow:
+		return -1, nil
+	}
+	value, ok := strings.CutPrefix(priority, "metric:")
+	if !ok {
+		return 0, fmt.Errorf("invalid priority %q, must be high, low or metric:N", priority)
+	}
+	metric, err := strconv.Atoi(value)
+	if err != nil || metric < 0 || metric > 9999 {
+		return 0, fmt.Errorf("invalid priority %q, the metric must be between 0 and 9999", priority)
+	}
+	return metric, nil
+}
+
+// priorityMetric picks the metric of the TUN default route, so it sorts before (high) or after (low) the default
+// routes of other tunnels, given their metrics. base is the metric used when it need not move, floor the lowest allowed
+func priorityMetric(priority string, others []int, base, floor int) (int, error) {
+	metric, err := parsePriority(priority)
+	if err != nil {
+		return 0, err
+	}
+	if metric >= 0 {
+		return max(metric, floor), nil
+	}
+	if len(others) == 0 {
+		return base, nil
+	}
+
+	lowest, highest := others[0], others[0]
+	for _, other := range others {
+		lowest = min(lowest, other)
+		highest = max(highest, other)
+	}
+	if priority == PriorityLow {
+		metric = max(base, highest+1)
+		veilnet.Logger.Sugar().Infof("Placing the VeilNet default route after %d other default routes, with metric %d", len(others), metric)
+		return metric, nil
+	}
+	metric = min(base, lowest-1)
+	if metric < floor {
+		veilnet.Logger.Sugar().Warnf("Another default route already has metric %d, the VeilNet default route ties with it", lowest)
+		metric = floor
+	}
+	veilnet.Logger.Sugar().Infof("Placing the VeilNet default route before %d other default routes, with metric %d", len(others), metric)
+	return metric, nil
+}
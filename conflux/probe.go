@@ -0,0 +1,97 @@
+package conflux
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// probeTimeout bounds the Guardian probe when the anchor timeout is disabled
+const probeTimeout = 10 * time.Second
+
+// probeGuardian checks the Guardian is reachable one step at a time, so a failure names the step that broke:
+// DNS resolution, the TCP connection, the TLS handshake or the HTTP request
+func probeGuardian(guardian string, timeout time.Duration) error {
+	u, err := url.Parse(guardian)
+	if err != nil {
+		return fmt.Errorf("invalid guardian url %q: %v", guardian, err)
+	}
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	if timeout <= 0 {
+		timeout = probeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Resolve the Guardian host
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return fmt.Errorf("guardian probe failed at DNS, %s could not be resolved, check the DNS servers of the host: %v", host, err)
+	}
+	veilnet.Logger.Sugar().Infof("Guardian probe: %s resolved to %s", host, strings.Join(addrs, ", "))
+
+	// Connect to the first address that accepts
+	var conn net.Conn
+	var dialErrs []string
+	var dialer net.Dialer
+	for _, addr := range addrs {
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+		if err == nil {
+			break
+		}
+		dialErrs = append(dialErrs, err.Error())
+	}
+	if conn == nil {
+		return fmt.Errorf("guardian probe failed at TCP, no address of %s accepted a connection on port %s, check the firewall and the host routes: %s", host, port, strings.Join(dialErrs, "; "))
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	veilnet.Logger.Sugar().Infof("Guardian probe: connected to %s", conn.RemoteAddr())
+
+	// Complete the TLS handshake
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return fmt.Errorf("guardian probe failed at TLS, the handshake with %s failed, check the system clock and for a proxy intercepting TLS: %v", host, err)
+		}
+		conn = tlsConn
+		veilnet.Logger.Sugar().Infof("Guardian probe: TLS handshake with %s completed using %s", host, tls.VersionName(tlsConn.ConnectionState().Version))
+	}
+
+	// Send a HEAD request, any answer but a server error means the Guardian is up
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, guardian, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create guardian probe request: %v", err)
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("guardian probe failed at HTTP, the request to %s could not be sent: %v", host, err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("guardian probe failed at HTTP, %s did not answer: %v", host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("guardian probe failed at HTTP, %s answered %s", host, resp.Status)
+	}
+	veilnet.Logger.Sugar().Infof("Guardian probe: %s answered %s", host, resp.Status)
+	return nil
+}
@@ -0,0 +1,345 @@
+package conflux
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// maxWriteRetries is how many times the rest of a partially written batch is offered to the TUN again
+const maxWriteRetries = 3
+
+// tunReadErrors coalesces the errors of the TUN reads, which a broken device returns on every read
+var tunReadErrors sampledLog
+
+// packetDevice is the TUN side of the packet pump
+type packetDevice interface {
+	Read(bufs [][]byte, sizes []int, offset int) (int, error)
+	Write(bufs [][]byte, offset int) (int, error)
+	BatchSize() int
+	MTU() (int, error)
+}
+
+// pump moves packets between a TUN device and an anchor until the anchor stops
+type pump struct {
+	device packetDevice
+	anchor Anchor
+	mtu    int
+	offset int
+
+	// progress is set to the time of each completed TUN read, for the egress watchdog
+	progress *atomic.Int64
+
+	// delivered is set to the time of each packet written to the TUN, for the egress watchdog
+	delivered *atomic.Int64
+
+	// ready gates the writes to the TUN, packets from the anchor are dropped while it is false
+	ready *atomic.Bool
+
+	// limiter caps the packets processed per second, nil does not limit
+	limiter *packetLimiter
+
+	// queue decouples the reads from the writes, nil writes each batch as soon as it is read
+	queue *packetQueue
+}
+
+// newPump creates a pump, offset is the headroom the device needs in front of each packet
+func newPump(device packetDevice, anchor Anchor, offset int) *pump {
+	mtu, err := device.MTU()
+	if err != nil {
+		veilnet.Logger.Sugar().Errorf("failed to get TUN MTU: %v", err)
+		// Use default MTU if we can't get the actual one
+		mtu = 1500
+	}
+	return &pump{device: device, anchor: anchor, mtu: mtu, offset: offset}
+}
+
+// batched reports whether the TUN device moves more than one packet per call
+func (p *pump) batched() bool {
+	return p.device.BatchSize() > 1
+}
+
+// ingress moves packets from the anchor to the TUN device
+func (p *pump) ingress() {
+	writes := newBatchStats("ingress")
+	p.startQueue(func(batch packetBatch) bool {
+		return p.write(batch.packets, writes)
+	})
+	if !p.batched() {
+		p.ingressSingle()
+		return
+	}
+	batchSize := p.device.BatchSize()
+	bufs := make([][]byte, batchSize)
+	stats := newBatchStats("ingress")
+	var backoff idleBackoff
+	for {
+		select {
+		case <-p.anchor.Context().Done():
+			veilnet.Logger.Sugar().Info("Portal ingress stopped")
+			return
+		default:
+			n := p.anchor.Read(bufs, batchSize)
+			backoff.wait(n)
+			if n <= 0 {
+				continue
+			}
+			p.limiter.take(n)
+			stats.observe(n, batchSize)
+			if !p.isReady() {
+				stats.dropUnready(n)
+				continue
+			}
+			n = stats.dropOversized(bufs, n, p.mtu)
+			bytes := 0
+			for i := 0; i < n; i++ {
+				bytes += len(bufs[i])
+				newBuf := make([]byte, p.offset+len(bufs[i]))
+				copy(newBuf[p.offset:], bufs[i])
+				bufs[i] = newBuf
+			}
+			stats.observeBytes(bytes)
+			if n > 0 && !p.deliver(bufs[:n], stats) {
+				veilnet.Logger.Sugar().Info("TUN device closed, portal ingress stopped")
+				return
+			}
+		}
+	}
+}
+
+// ingressSingle moves packets from the anchor to a TUN device that does not batch, reusing one buffer
+func (p *pump) ingressSingle() {
+	in := make([][]byte, 1)
+	out := make([]byte, p.offset+p.mtu)
+	stats := newBatchStats("ingress")
+	var backoff idleBackoff
+	for {
+		select {
+		case <-p.anchor.Context().Done():
+			veilnet.Logger.Sugar().Info("Portal ingress stopped")
+			return
+		default:
+			n := p.anchor.Read(in, 1)
+			backoff.wait(n)
+			if n <= 0 {
+				continue
+			}
+			p.limiter.take(n)
+			stats.observe(n, 1)
+			if !p.isReady() {
+				stats.dropUnready(n)
+				continue
+			}
+			if stats.dropOversized(in, n, p.mtu) == 0 {
+				continue
+			}
+			size := copy(out[p.offset:], in[0])
+			stats.observeBytes(size)
+			if !p.deliver([][]byte{out[:p.offset+size]}, stats) {
+				veilnet.Logger.Sugar().Info("TUN device closed, portal ingress stopped")
+				return
+			}
+		}
+	}
+}
+
+// deliver hands packets from the anchor to the TUN device, through the queue if there is one, reporting false once
+// the device is closed
+func (p *pump) deliver(bufs [][]byte, stats *batchStats) bool {
+	if p.queue == nil {
+		return p.write(bufs, stats)
+	}
+	return p.queue.push(bufs, nil)
+}
+
+// write writes bufs to the TUN device, reporting false once the device is closed
+// The rest of a partial write is offered again up to maxWriteRetries times and then dropped, a failed write drops the
+// batch, since the device may have written part of it and the packets must not be sent twice
+func (p *pump) write(bufs [][]byte, stats *batchStats) bool {
+	for attempt := 0; ; attempt++ {
+		n, err := p.device.Write(bufs, p.offset)
+		if errors.Is(err, os.ErrClosed) {
+			return false
+		}
+		if err != nil {
+			stats.writeFailed(len(bufs), err)
+			return true
+		}
+		if n > 0 {
+			p.writeDone()
+		}
+		if n >= len(bufs) {
+			return true
+		}
+		stats.partialWrite()
+		bufs = bufs[max(n, 0):]
+		if attempt == maxWriteRetries {
+			stats.writeDropped(len(bufs))
+			return true
+		}
+	}
+}
+
+// egress moves packets from the TUN device to the anchor
+func (p *pump) egress() {
+	p.startQueue(func(batch packetBatch) bool {
+		p.anchor.Write(batch.packets, batch.sizes)
+		return true
+	})
+	if !p.batched() {
+		p.egressSingle()
+		return
+	}
+	batchSize := p.device.BatchSize()
+	bufs := make([][]byte, batchSize)
+	sizes := make([]int, batchSize)
+	stats := newBatchStats("egress")
+	var backoff idleBackoff
+
+	// Pre-allocate buffers, the anchor is handed the packets past the device headroom
+	packets := make([][]byte, batchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, p.offset+p.mtu)
+		packets[i] = bufs[i][p.offset:]
+	}
+
+	for {
+		select {
+		case <-p.anchor.Context().Done():
+			veilnet.Logger.Sugar().Info("Portal egress stopped")
+			return
+		default:
+			n, err := p.device.Read(bufs, sizes, p.offset)
+			p.readDone()
+			if err != nil {
+				tunReadErrors.errorf("failed to read from TUN device: %v", err)
+				backoff.wait(0)
+				continue
+			}
+			backoff.wait(n)
+			if n <= 0 {
+				continue
+			}
+			p.limiter.take(n)
+			stats.observe(n, batchSize)
+			bytes := 0
+			for _, size := range sizes[:n] {
+				bytes += size
+			}
+			stats.observeBytes(bytes)
+			p.send(packets[:n], sizes[:n])
+		}
+	}
+}
+
+// egressSingle moves packets from a TUN device that does not batch to the anchor, reusing one buffer
+func (p *pump) egressSingle() {
+	bufs := [][]byte{make([]byte, p.offset+p.mtu)}
+	packets := [][]byte{bufs[0][p.offset:]}
+	sizes := make([]int, 1)
+	stats := newBatchStats("egress")
+	var backoff idleBackoff
+	for {
+		select {
+		case <-p.anchor.Context().Done():
+			veilnet.Logger.Sugar().Info("Portal egress stopped")
+			return
+		default:
+			n, err := p.device.Read(bufs, sizes, p.offset)
+			p.readDone()
+			if err != nil {
+				tunReadErrors.errorf("failed to read from TUN device: %v", err)
+				backoff.wait(0)
+				continue
+			}
+			backoff.wait(n)
+			if n <= 0 {
+				continue
+			}
+			p.limiter.take(n)
+			stats.observe(n, 1)
+			stats.observeBytes(sizes[0])
+			p.send(packets, sizes)
+		}
+	}
+}
+
+// send hands packets from the TUN device to the anchor, through the queue if there is one
+func (p *pump) send(packets [][]byte, sizes []int) {
+	if p.queue == nil {
+		p.anchor.Write(packets, sizes)
+		return
+	}
+	p.queue.push(packets, sizes)
+}
+
+// startQueue starts handing the queued batches to write, if the pump has a queue
+func (p *pump) startQueue(write func(batch packetBatch) bool) {
+	if p.queue != nil {
+		go p.queue.run(p.anchor.Context(), write)
+	}
+}
+
+// tunOffset is the headroom the device needs in front of each packet, an override below the device
+// minimum is raised to it since the device would reject every write
+func (c *conflux) tunOffset() int {
+	minimum := 0
+	if !c.opts.Userspace {
+		minimum = c.minTUNOffset()
+	}
+	if c.opts.TUNOffset > minimum {
+		return c.opts.TUNOffset
+	}
+	return minimum
+}
+
+// isReady reports whether the TUN is configured to take packets, a pump without a gate always is
+func (p *pump) isReady() bool {
+	return p.ready == nil || p.ready.Load()
+}
+
+// readDone records a completed TUN read
+func (p *pump) readDone() {
+	if p.progress != nil {
+		p.progress.Store(time.Now().UnixNano())
+	}
+}
+
+// writeDone records a packet written to the TUN
+func (p *pump) writeDone() {
+	if p.delivered != nil {
+		p.delivered.Store(time.Now().UnixNano())
+	}
+}
+
+// ingress runs the ingress loop of the conflux on the calling goroutine
+func (c *conflux) ingress() {
+	c.pinLoop("ingress", 0)
+	p := newPump(c.device, c.anchor, c.tunOffset())
+	p.ready = &c.ready
+	p.delivered = &c.lastIngress
+	p.limiter = newPacketLimiter("ingress", c.opts.MaxPacketRate)
+	p.queue = newPacketQueue("ingress", c.opts.QueueDepth)
+	if p.batched() {
+		veilnet.Logger.Sugar().Infof("Using batched packet I/O, batch size %d", p.device.BatchSize())
+	} else {
+		veilnet.Logger.Sugar().Infof("TUN device does not batch, using single packet I/O")
+	}
+	if c.opts.TUNOffset > 0 && c.opts.TUNOffset != p.offset {
+		veilnet.Logger.Sugar().Warnf("TUN offset %d is below the %d bytes the device needs, using %d", c.opts.TUNOffset, p.offset, p.offset)
+	}
+	p.ingress()
+}
+
+// egress runs the egress loop of the conflux on the calling goroutine
+func (c *conflux) egress() {
+	c.pinLoop("egress", 1)
+	p := newPump(c.device, c.anchor, c.tunOffset())
+	p.progress = &c.lastEgress
+	p.limiter = newPacketLimiter("egress", c.opts.MaxPacketRate)
+	p.queue = newPacketQueue("egress", c.opts.QueueDepth)
+	p.egress()
+}
@@ -0,0 +1,407 @@
+package conflux
+
+import (
+	"bytes"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testOffset is the headroom the pump tests leave in front of each packet, as wireguard-go devices need
+const testOffset = 16
+
+// fakeDevice is an in-memory TUN that hands out the packets sent to in and captures the buffers written to it on out,
+// headroom included
+type fakeDevice struct {
+	batchSize int
+	mtu       int
+
+	in  chan []byte
+	out chan []byte
+
+	// accept caps the packets each write takes, zero takes the whole batch
+	accept int
+
+	mu     sync.Mutex
+	writes []int
+	closed bool
+}
+
+func newFakeDevice(batchSize int) *fakeDevice {
+	return &fakeDevice{
+		batchSize: batchSize,
+		mtu:       1420,
+		in:        make(chan []byte, 64),
+		out:       make(chan []byte, 64),
+	}
+}
+
+func (d *fakeDevice) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n := 0
+	for n < len(bufs) && n < d.batchSize {
+		select {
+		case pkt := <-d.in:
+			sizes[n] = copy(bufs[n][offset:], pkt)
+			n++
+		default:
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+func (d *fakeDevice) Write(bufs [][]byte, offset int) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return 0, os.ErrClosed
+	}
+	d.writes = append(d.writes, len(bufs))
+	if d.accept > 0 && len(bufs) > d.accept {
+		bufs = bufs[:d.accept]
+	}
+	for _, buf := range bufs {
+		d.out <- slices.Clone(buf)
+	}
+	return len(bufs), nil
+}
+
+func (d *fakeDevice) BatchSize() int {
+	return d.batchSize
+}
+
+func (d *fakeDevice) MTU() (int, error) {
+	return d.mtu, nil
+}
+
+// Close makes every later write fail with os.ErrClosed, as a closed TUN does
+func (d *fakeDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	return nil
+}
+
+// written returns the number of packets in each write so far
+func (d *fakeDevice) written() []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.writes)
+}
+
+// receive waits for the next packet on ch
+func receive(t *testing.T, ch <-chan []byte) []byte {
+	t.Helper()
+	select {
+	case pkt := <-ch:
+		return pkt
+	case <-time.After(time.Second):
+		t.Fatal("no packet received")
+		return nil
+	}
+}
+
+// runPump runs loop until the test ends, stopping the anchor and waiting for the loop to return
+func runPump(t *testing.T, anchor *mockAnchor, loop func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		loop()
+	}()
+	t.Cleanup(func() {
+		anchor.Stop()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("packet loop did not stop with the anchor")
+		}
+	})
+}
+
+func TestIngressOffset(t *testing.T) {
+	for _, batchSize := range []int{1, 4} {
+		anchor := newMockAnchor()
+		device := newFakeDevice(batchSize)
+		p := newPump(device, anchor, testOffset)
+		runPump(t, anchor, p.ingress)
+
+		pkt := []byte{0x45, 0x00, 0x00, 0x14, 1, 2, 3, 4}
+		anchor.in <- pkt
+		buf := receive(t, device.out)
+		if len(buf) != testOffset+len(pkt) {
+			t.Fatalf("batch size %d: wrote %d bytes, want %d", batchSize, len(buf), testOffset+len(pkt))
+		}
+		if !bytes.Equal(buf[testOffset:], pkt) {
+			t.Errorf("batch size %d: wrote packet %x after the headroom, want %x", batchSize, buf[testOffset:], pkt)
+		}
+	}
+}
+
+func TestEgressOffset(t *testing.T) {
+	for _, batchSize := range []int{1, 4} {
+		anchor := newMockAnchor()
+		device := newFakeDevice(batchSize)
+		p := newPump(device, anchor, testOffset)
+		runPump(t, anchor, p.egress)
+
+		pkt := []byte{0x45, 0x00, 0x00, 0x14, 5, 6, 7, 8}
+		device.in <- pkt
+		got := receive(t, anchor.out)
+		if !bytes.Equal(got, pkt) {
+			t.Errorf("batch size %d: anchor got %x, want %x without the headroom", batchSize, got, pkt)
+		}
+	}
+}
+
+func TestIngressBatches(t *testing.T) {
+	anchor := newMockAnchor()
+	device := newFakeDevice(4)
+	pkts := [][]byte{{0x45, 1}, {0x45, 2}, {0x45, 3}}
+	for _, pkt := range pkts {
+		anchor.in <- pkt
+	}
+	p := newPump(device, anchor, testOffset)
+	runPump(t, anchor, p.ingress)
+
+	for _, pkt := range pkts {
+		if buf := receive(t, device.out); !bytes.Equal(buf[testOffset:], pkt) {
+			t.Errorf("wrote packet %x, want %x", buf[testOffset:], pkt)
+		}
+	}
+	if got, want := device.written(), []int{len(pkts)}; !slices.Equal(got, want) {
+		t.Errorf("writes of %v packets, want %v", got, want)
+	}
+}
+
+func TestEgressBatches(t *testing.T) {
+	anchor := newMockAnchor()
+	device := newFakeDevice(4)
+	pkts := [][]byte{{0x45, 1}, {0x45, 2}, {0x45, 3}}
+	for _, pkt := range pkts {
+		device.in <- pkt
+	}
+	p := newPump(device, anchor, testOffset)
+	runPump(t, anchor, p.egress)
+
+	for _, pkt := range pkts {
+		if got := receive(t, anchor.out); !bytes.Equal(got, pkt) {
+			t.Errorf("anchor got %x, want %x", got, pkt)
+		}
+	}
+	if got, want := anchor.written(), []int{len(pkts)}; !slices.Equal(got, want) {
+		t.Errorf("anchor writes of %v packets, want %v", got, want)
+	}
+}
+
+func TestIngressStopsOnClosedDevice(t *testing.T) {
+	for _, batchSize := range []int{1, 4} {
+		anchor := newMockAnchor()
+		device := newFakeDevice(batchSize)
+		device.Close()
+		p := newPump(device, anchor, testOffset)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p.ingress()
+		}()
+		anchor.in <- []byte{0x45, 1}
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			anchor.Stop()
+			t.Fatalf("batch size %d: ingress kept running on a closed device", batchSize)
+		}
+		anchor.Stop()
+	}
+}
+
+func TestIdleBackoff(t *testing.T) {
+	var b idleBackoff
+	for i := 1; i < idleSpinReads; i++ {
+		b.wait(0)
+	}
+	if b.delay != 0 {
+		t.Fatalf("slept after %d empty reads, want a spin", idleSpinReads-1)
+	}
+
+	want := idleMinDelay
+	for want < idleMaxDelay {
+		b.wait(0)
+		if b.delay != want {
+			t.Fatalf("delay %v, want %v", b.delay, want)
+		}
+		want *= 2
+	}
+	b.wait(0)
+	if b.delay != idleMaxDelay {
+		t.Fatalf("delay %v, want it capped at %v", b.delay, idleMaxDelay)
+	}
+
+	b.wait(1)
+	if b.idle != 0 || b.delay != 0 {
+		t.Errorf("a read left %d idle reads and a %v delay, want the backoff reset", b.idle, b.delay)
+	}
+}
+
+func TestIngressWaitsForReady(t *testing.T) {
+	for _, batchSize := range []int{1, 4} {
+		anchor := newMockAnchor()
+		device := newFakeDevice(batchSize)
+		p := newPump(device, anchor, testOffset)
+		p.ready = &atomic.Bool{}
+		anchor.in <- []byte{0x45, 1}
+		runPump(t, anchor, p.ingress)
+
+		// The packet read while the TUN is not configured is dropped
+		deadline := time.Now().Add(time.Second)
+		for len(anchor.in) > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		select {
+		case buf := <-device.out:
+			t.Fatalf("batch size %d: wrote %x before the TUN was ready", batchSize, buf)
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		p.ready.Store(true)
+		pkt := []byte{0x45, 2}
+		anchor.in <- pkt
+		if buf := receive(t, device.out); !bytes.Equal(buf[testOffset:], pkt) {
+			t.Errorf("batch size %d: wrote packet %x, want %x", batchSize, buf[testOffset:], pkt)
+		}
+	}
+}
+
+func TestIngressDropsOversized(t *testing.T) {
+	for _, batchSize := range []int{1, 4} {
+		anchor := newMockAnchor()
+		device := newFakeDevice(batchSize)
+		device.mtu = 8
+		p := newPump(device, anchor, testOffset)
+		anchor.in <- make([]byte, device.mtu+1)
+		pkt := []byte{0x45, 1}
+		anchor.in <- pkt
+		runPump(t, anchor, p.ingress)
+
+		if buf := receive(t, device.out); !bytes.Equal(buf[testOffset:], pkt) {
+			t.Errorf("batch size %d: wrote packet %x, want the oversized one dropped", batchSize, buf[testOffset:])
+		}
+	}
+}
+
+func TestPumpQueue(t *testing.T) {
+	for _, batchSize := range []int{1, 4} {
+		anchor := newMockAnchor()
+		device := newFakeDevice(batchSize)
+		in := newPump(device, anchor, testOffset)
+		in.queue = newPacketQueue("ingress", 4)
+		out := newPump(device, anchor, testOffset)
+		out.queue = newPacketQueue("egress", 4)
+		runPump(t, anchor, in.ingress)
+		runPump(t, anchor, out.egress)
+
+		pkt := []byte{0x45, 1}
+		anchor.in <- pkt
+		if buf := receive(t, device.out); !bytes.Equal(buf[testOffset:], pkt) {
+			t.Errorf("batch size %d: wrote packet %x through the queue, want %x", batchSize, buf[testOffset:], pkt)
+		}
+		device.in <- pkt
+		if got := receive(t, anchor.out); !bytes.Equal(got, pkt) {
+			t.Errorf("batch size %d: anchor got %x through the queue, want %x", batchSize, got, pkt)
+		}
+	}
+}
+
+func TestEgressRecordsProgress(t *testing.T) {
+	anchor := newMockAnchor()
+	device := newFakeDevice(1)
+	p := newPump(device, anchor, testOffset)
+	p.progress = &atomic.Int64{}
+	runPump(t, anchor, p.egress)
+
+	deadline := time.Now().Add(time.Second)
+	for p.progress.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("egress did not record a completed read")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriteRetriesPartialWrites(t *testing.T) {
+	device := newFakeDevice(8)
+	device.accept = 2
+	p := newPump(device, newMockAnchor(), testOffset)
+
+	bufs := [][]byte{{1}, {2}, {3}, {4}, {5}}
+	if !p.write(bufs, newBatchStats("ingress")) {
+		t.Fatal("write reported the device closed")
+	}
+	if got, want := device.written(), []int{5, 3, 1}; !slices.Equal(got, want) {
+		t.Errorf("writes of %v packets, want the rest offered again as %v", got, want)
+	}
+	for _, want := range bufs {
+		if got := receive(t, device.out); !bytes.Equal(got, want) {
+			t.Errorf("wrote %x, want %x", got, want)
+		}
+	}
+}
+
+func TestWriteDropsAfterRetries(t *testing.T) {
+	device := newFakeDevice(16)
+	device.accept = 1
+	p := newPump(device, newMockAnchor(), testOffset)
+
+	bufs := make([][]byte, 10)
+	for i := range bufs {
+		bufs[i] = []byte{byte(i)}
+	}
+	if !p.write(bufs, newBatchStats("ingress")) {
+		t.Fatal("write reported the device closed")
+	}
+
+	// The first write and maxWriteRetries retries take one packet each, the rest is dropped
+	want := make([]int, 0, maxWriteRetries+1)
+	for i := 0; i <= maxWriteRetries; i++ {
+		want = append(want, len(bufs)-i)
+	}
+	if got := device.written(); !slices.Equal(got, want) {
+		t.Errorf("writes of %v packets, want %v", got, want)
+	}
+	if got := len(device.out); got != maxWriteRetries+1 {
+		t.Errorf("device took %d packets, want %d", got, maxWriteRetries+1)
+	}
+}
+
+func TestWriteClosedDevice(t *testing.T) {
+	device := newFakeDevice(4)
+	device.Close()
+	p := newPump(device, newMockAnchor(), testOffset)
+	if p.write([][]byte{{1}}, newBatchStats("ingress")) {
+		t.Error("write on a closed device did not report it closed")
+	}
+}
+
+func TestWriteRecordsDelivery(t *testing.T) {
+	device := newFakeDevice(4)
+	p := newPump(device, newMockAnchor(), testOffset)
+	p.delivered = &atomic.Int64{}
+	if !p.write([][]byte{{1}}, newBatchStats("ingress")) {
+		t.Fatal("write reported the device closed")
+	}
+	if p.delivered.Load() == 0 {
+		t.Error("write did not record the delivered packet")
+	}
+
+	p.delivered.Store(0)
+	device.Close()
+	p.write([][]byte{{2}}, newBatchStats("ingress"))
+	if p.delivered.Load() != 0 {
+		t.Error("write on a closed device recorded a delivered packet")
+	}
+}
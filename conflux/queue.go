@@ -0,0 +1,83 @@
+package conflux
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/veil-net/veilnet"
+)
+
+// queueLogEvery is the number of batches dropped on a full queue between log lines
+const queueLogEvery = 1000
+
+// packetBatch is a batch of packets waiting in a packetQueue, sizes is only set for the packets read from the TUN
+type packetBatch struct {
+	packets [][]byte
+	sizes   []int
+}
+
+// packetQueue holds up to depth batches between the side a packet loop reads from and the side it writes to, so a
+// burst the writes cannot keep up with waits instead of holding up the reads
+// The batches arriving while it is full are dropped and counted. It has a single reader and a single writer
+type packetQueue struct {
+	direction string
+	batches   chan packetBatch
+	closed    atomic.Bool
+	dropped   uint64
+}
+
+// newPacketQueue creates a queue of depth batches, nil if depth is not positive
+func newPacketQueue(direction string, depth int) *packetQueue {
+	if depth <= 0 {
+		return nil
+	}
+	return &packetQueue{direction: direction, batches: make(chan packetBatch, depth)}
+}
+
+// push queues a copy of the packets, since the loop reuses its buffers, or drops them if the queue is full
+// It reports false once the writer stopped
+func (q *packetQueue) push(packets [][]byte, sizes []int) bool {
+	if q.closed.Load() {
+		return false
+	}
+
+	// Only the writer takes batches out, so a queue that is not full now takes this one without blocking
+	if len(q.batches) == cap(q.batches) {
+		queueDroppedTotal.WithLabelValues(q.direction).Add(float64(len(packets)))
+		if q.dropped%queueLogEvery == 0 {
+			veilnet.Logger.Sugar().Warnf("The %s queue is full, dropping a batch of %d packets (%d batches dropped so far)", q.direction, len(packets), q.dropped+1)
+		}
+		q.dropped++
+		return true
+	}
+
+	batch := packetBatch{packets: make([][]byte, len(packets))}
+	for i, packet := range packets {
+		if sizes != nil {
+			packet = packet[:sizes[i]]
+		}
+		batch.packets[i] = append([]byte(nil), packet...)
+	}
+	if sizes != nil {
+		batch.sizes = append([]int(nil), sizes...)
+	}
+	q.batches <- batch
+	queueLength.WithLabelValues(q.direction).Set(float64(len(q.batches)))
+	return true
+}
+
+// run hands the queued batches to write until ctx is done or write reports the other side closed
+func (q *packetQueue) run(ctx context.Context, write func(batch packetBatch) bool) {
+	defer q.closed.Store(true)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case batch := <-q.batches:
+			queueLength.WithLabelValues(q.direction).Set(float64(len(q.batches)))
+			if !write(batch) {
+				return
+			}
+		}
+	}
+}
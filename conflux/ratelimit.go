@@ -0,0 +1,31 @@
+package conflux
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// rateRegexp matches a rate such as 50, 50mbit or 1.5gbit
+var rateRegexp = regexp.MustCompile(`^([0-9]+(\.[0-9]+)?)(kbit|mbit|gbit)?$`)
+
+// parseRate validates a rate limit and returns it in tc notation, a bare number is in mbit/s
+func parseRate(rate string) (string, error) {
+	if rate == "" {
+		return "", nil
+	}
+
+	match := rateRegexp.FindStringSubmatch(strings.ToLower(rate))
+	if match == nil {
+		return "", fmt.Errorf("invalid rate limit %s, expected a number with an optional kbit, mbit or gbit unit", rate)
+	}
+	if strings.Trim(match[1], "0.") == "" {
+		return "", fmt.Errorf("invalid rate limit %s, must be greater than zero", rate)
+	}
+
+	unit := match[3]
+	if unit == "" {
+		unit = "mbit"
+	}
+	return match[1] + unit, nil
+}
@@ -0,0 +1,100 @@
+package conflux
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// resolveCacheStaleAge is the age after which cached addresses are reported as stale
+const resolveCacheStaleAge = 24 * time.Hour
+
+// resolveCacheEntry is the last successful resolution of a host
+type resolveCacheEntry struct {
+	IPs      []string  `json:"ips"`
+	Resolved time.Time `json:"resolved"`
+}
+
+// resolveCachePath returns the path of the file the resolved bypass hosts are cached in
+func resolveCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "veilnet", "resolve.json"), nil
+}
+
+// loadResolveCache loads the cached resolutions, returning an empty cache if there is none
+func loadResolveCache() map[string]resolveCacheEntry {
+	cache := make(map[string]resolveCacheEntry)
+	path, err := resolveCachePath()
+	if err != nil {
+		return cache
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+	err = json.Unmarshal(data, &cache)
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("Ignoring invalid resolve cache %s: %v", path, err)
+		return make(map[string]resolveCacheEntry)
+	}
+	return cache
+}
+
+// saveResolveCache writes the cached resolutions
+func saveResolveCache(cache map[string]resolveCacheEntry) {
+	path, err := resolveCachePath()
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("failed to locate resolve cache: %v", err)
+		return
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("failed to marshal resolve cache: %v", err)
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("failed to write resolve cache %s: %v", path, err)
+	}
+}
+
+// resolveBypassHost resolves host and records the result in cache
+// If resolution fails the addresses from the last successful resolution are returned instead
+func resolveBypassHost(host string, cache map[string]resolveCacheEntry) ([]net.IP, error) {
+	ips, err := net.LookupIP(host)
+	if err == nil {
+		entry := resolveCacheEntry{Resolved: time.Now()}
+		for _, ip := range ips {
+			entry.IPs = append(entry.IPs, ip.String())
+		}
+		cache[host] = entry
+		return ips, nil
+	}
+
+	entry, ok := cache[host]
+	if !ok || len(entry.IPs) == 0 {
+		return nil, err
+	}
+
+	age := time.Since(entry.Resolved).Round(time.Second)
+	veilnet.Logger.Sugar().Warnf("Failed to resolve %s: %v, using addresses cached %s ago", host, err, age)
+	if age > resolveCacheStaleAge {
+		veilnet.Logger.Sugar().Warnf("Cached addresses for %s are stale and may no longer be valid", host)
+	}
+	for _, cached := range entry.IPs {
+		if ip := net.ParseIP(cached); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,55 @@
+//go:build windows
+// +build windows
+
+package conflux
+
+import (
+	"strings"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+const (
+	// netRetryAttempts is how many times a transiently failing netsh or route command is run
+	netRetryAttempts = 5
+
+	// netRetryBackoff is the wait before the first retry, doubled after each attempt
+	netRetryBackoff = 200 * time.Millisecond
+)
+
+// transientNetErrors are the netsh and route messages seen while a freshly created adapter is not ready yet
+var transientNetErrors = []string{
+	"element not found",
+	"the system cannot find the file specified",
+	"the interface is unknown",
+	"the device is not ready",
+	"the filename, directory name, or volume label syntax is incorrect",
+	"an unexpected network error occurred",
+}
+
+// isTransientNetError reports whether a netsh or route failure is worth retrying
+func isTransientNetError(out string) bool {
+	out = strings.ToLower(out)
+	for _, msg := range transientNetErrors {
+		if strings.Contains(out, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// runNetCommand runs a netsh or route command, retrying with backoff while it fails transiently
+// Genuine configuration errors, e.g. an invalid address or a route that already exists, are returned at once
+func runNetCommand(name string, args ...string) (string, error) {
+	backoff := netRetryBackoff
+	for attempt := 1; ; attempt++ {
+		out, err := runCommand(name, args...)
+		if err == nil || attempt == netRetryAttempts || !isTransientNetError(out) {
+			return out, err
+		}
+		veilnet.Logger.Sugar().Warnf("%s %s failed (attempt %d of %d), retrying in %s: %v", name, strings.Join(args, " "), attempt, netRetryAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,69 @@
+package conflux
+
+import (
+	"sort"
+)
+
+// Kinds of route the conflux manages
+const (
+	routeKindBypass      = "bypass"
+	routeKindVeilMaster  = "veil-master"
+	routeKindDefault     = "default"
+	routeKindHostDefault = "host-default"
+)
+
+// Changes the conflux made to a route
+const (
+	routeAdded    = "added"
+	routeRemoved  = "removed"
+	routeFallback = "fallback"
+)
+
+// ManagedRoute is a route the conflux added to, or changed in, the host routing table
+type ManagedRoute struct {
+	Kind        string `json:"kind"`
+	Destination string `json:"destination"`
+	Host        string `json:"host,omitempty"`
+	Gateway     string `json:"gateway,omitempty"`
+	Interface   string `json:"interface,omitempty"`
+	Metric      int    `json:"metric,omitempty"`
+	Change      string `json:"change"`
+}
+
+// Routes lists the routes the conflux manages while it runs: the bypass routes with their hosts, the Veil Master pin
+// and the changes to the default routes, none in userspace mode
+func (c *conflux) Routes() []ManagedRoute {
+	if c.opts.Userspace || c.life.get() != stateRunning {
+		return nil
+	}
+
+	var routes []ManagedRoute
+	c.bypassRoutes.Range(func(dest, host any) bool {
+		routes = append(routes, ManagedRoute{
+			Kind:        routeKindBypass,
+			Destination: dest.(string) + "/32",
+			Host:        host.(string),
+			Gateway:     c.gateway,
+			Interface:   c.iface,
+			Change:      routeAdded,
+		})
+		return true
+	})
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Host != routes[j].Host {
+			return routes[i].Host < routes[j].Host
+		}
+		return routes[i].Destination < routes[j].Destination
+	})
+
+	if veilHost := c.anchor.GetVeilHost(); veilHost != "" {
+		routes = append(routes, ManagedRoute{
+			Kind:        routeKindVeilMaster,
+			Destination: veilHost + "/32",
+			Gateway:     c.gateway,
+			Interface:   c.iface,
+			Change:      routeAdded,
+		})
+	}
+	return append(routes, c.defaultChanges...)
+}
@@ -0,0 +1,17 @@
+package conflux
+
+import "fmt"
+
+// DefaultRouteTable is the routing table used for policy routing unless --route-table is set, "VV" in ASCII
+const DefaultRouteTable = 8686
+
+// checkRouteTableNumber rejects the routing tables reserved by the kernel
+func checkRouteTableNumber(table int) error {
+	switch {
+	case table <= 0 || int64(table) > 0xFFFFFFFF:
+		return fmt.Errorf("invalid routing table %d, must be between 1 and 4294967295", table)
+	case table == 253 || table == 254 || table == 255:
+		return fmt.Errorf("routing table %d is reserved for the default, main and local tables", table)
+	}
+	return nil
+}
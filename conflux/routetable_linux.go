@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/veil-net/veilnet"
+)
+
+// rtTablesFiles are the iproute2 routing table name files, the /etc ones override the shipped defaults
+var rtTablesFiles = []string{"/usr/share/iproute2/rt_tables", "/etc/iproute2/rt_tables"}
+
+// rtTablesDirs hold drop-in routing table name files
+var rtTablesDirs = []string{"/usr/share/iproute2/rt_tables.d", "/etc/iproute2/rt_tables.d"}
+
+// routeTable is the routing table used for policy routing, as passed to ip
+func (c *conflux) routeTable() string {
+	return strconv.Itoa(c.opts.RouteTable)
+}
+
+// checkRouteTable warns, or fails in strict mode, when the routing table is named for something else or already in use
+func (c *conflux) checkRouteTable() error {
+	table := c.routeTable()
+
+	// Another VPN or the admin may have claimed the number
+	if name, ok := rtTableName(c.opts.RouteTable); ok && name != "veilnet" {
+		msg := fmt.Sprintf("routing table %s is named %s in rt_tables, pick another with --route-table", table, name)
+		if c.opts.Strict {
+			return fmt.Errorf("%s", msg)
+		}
+		veilnet.Logger.Sugar().Warnf("%s", msg)
+	}
+
+	// Routes left in the table that were not installed by the conflux belong to someone else
+	out, err := runCommand("ip", "route", "show", "table", table)
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("failed to list routing table %s: %v", table, err)
+		return nil
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" || strings.Contains(line, "proto "+routeProto) {
+			continue
+		}
+		msg := fmt.Sprintf("routing table %s already has routes (%s), pick another with --route-table", table, line)
+		if c.opts.Strict {
+			return fmt.Errorf("%s", msg)
+		}
+		veilnet.Logger.Sugar().Warnf("%s", msg)
+		break
+	}
+	return nil
+}
+
+// rtTableName looks up the name of a routing table number in the iproute2 configuration
+func rtTableName(table int) (string, bool) {
+	files := append([]string{}, rtTablesFiles...)
+	for _, dir := range rtTablesDirs {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.conf"))
+		files = append(files, matches...)
+	}
+	name, found := "", false
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			if n, err := strconv.Atoi(fields[0]); err == nil && n == table {
+				name, found = fields[1], true
+			}
+		}
+		f.Close()
+	}
+	return name, found
+}
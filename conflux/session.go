@@ -0,0 +1,53 @@
+package conflux
+
+import (
+	"sync"
+	"time"
+)
+
+// session tracks the anchor connection history of a conflux
+type session struct {
+	mu          sync.Mutex
+	connectedAt time.Time
+	uptime      time.Duration
+}
+
+// sessionStats is a snapshot of a session
+type sessionStats struct {
+	SessionUptime time.Duration
+	TotalUptime   time.Duration
+}
+
+// connected records the anchor connecting
+func (s *session) connected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.connectedAt.IsZero() {
+		return
+	}
+	s.connectedAt = time.Now()
+}
+
+// disconnected records the anchor disconnecting
+func (s *session) disconnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connectedAt.IsZero() {
+		return
+	}
+	s.uptime += time.Since(s.connectedAt)
+	s.connectedAt = time.Time{}
+}
+
+func (s *session) stats() sessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := sessionStats{
+		TotalUptime: s.uptime,
+	}
+	if !s.connectedAt.IsZero() {
+		stats.SessionUptime = time.Since(s.connectedAt)
+		stats.TotalUptime += stats.SessionUptime
+	}
+	return stats
+}
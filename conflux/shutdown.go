@@ -0,0 +1,57 @@
+package conflux
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// shutdownFilePoll is how often the shutdown file is checked for
+const shutdownFilePoll = time.Second
+
+// watchShutdown sends SIGTERM to sigChan once stdin reaches EOF, if stdinEOF is set, or the shutdown file appears, if
+// path is set, for hosts where signals are not reliably delivered
+func watchShutdown(sigChan chan<- os.Signal, stdinEOF bool, path string) {
+
+	// Stop once whatever feeds stdin goes away, a read error counts the same as EOF
+	if stdinEOF {
+		go func() {
+			io.Copy(io.Discard, os.Stdin)
+			veilnet.Logger.Sugar().Info("Stdin closed")
+			sigChan <- syscall.SIGTERM
+		}()
+	}
+
+	// Stop once the shutdown file is created, removing it so the next start is not stopped by it too
+	if path != "" {
+		removeShutdownFile(path, "stale ")
+		go func() {
+			for {
+				time.Sleep(shutdownFilePoll)
+				if _, err := os.Stat(path); err == nil {
+					veilnet.Logger.Sugar().Infof("Shutdown file %s created", path)
+					removeShutdownFile(path, "")
+					sigChan <- syscall.SIGTERM
+					return
+				}
+			}
+		}()
+	}
+}
+
+// removeShutdownFile removes the shutdown file if it exists, kind qualifies it in the log
+func removeShutdownFile(path, kind string) {
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("Failed to remove %sshutdown file %s: %v", kind, path, err)
+		return
+	}
+	veilnet.Logger.Sugar().Infof("Removed %sshutdown file %s", kind, path)
+}
@@ -0,0 +1,159 @@
+package conflux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// SOCKS5 protocol values, see RFC 1928
+const (
+	socksVersion        = 0x05
+	socksNoAuth         = 0x00
+	socksNoAcceptable   = 0xFF
+	socksCmdConnect     = 0x01
+	socksAddrIPv4       = 0x01
+	socksAddrDomain     = 0x03
+	socksAddrIPv6       = 0x04
+	socksSucceeded      = 0x00
+	socksHostUnreach    = 0x04
+	socksCmdUnsupported = 0x07
+	socksAddrUnsupport  = 0x08
+)
+
+// socksHandshakeTimeout bounds the SOCKS5 negotiation of a client
+const socksHandshakeTimeout = 10 * time.Second
+
+// socksDialer dials the destinations requested by SOCKS5 clients
+type socksDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// serveSOCKS serves SOCKS5 CONNECT requests on listener, dialing through dialer, until the listener is closed
+func serveSOCKS(listener net.Listener, dialer socksDialer) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				veilnet.Logger.Sugar().Errorf("failed to accept SOCKS5 connection: %v", err)
+			}
+			return
+		}
+		go handleSOCKS(conn, dialer)
+	}
+}
+
+// handleSOCKS negotiates a single SOCKS5 connection and relays it to the requested destination
+func handleSOCKS(conn net.Conn, dialer socksDialer) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	// Negotiate the authentication method, only no authentication is offered
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != socksVersion {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	conn.Write([]byte{socksVersion, method})
+	if method == socksNoAcceptable {
+		return
+	}
+
+	// Read the request
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil || request[0] != socksVersion {
+		return
+	}
+	address, err := readSOCKSAddress(conn, request[3])
+	if err != nil {
+		socksReply(conn, socksAddrUnsupport)
+		return
+	}
+	if request[1] != socksCmdConnect {
+		socksReply(conn, socksCmdUnsupported)
+		return
+	}
+
+	// Dial the destination through VeilNet
+	ctx, cancel := context.WithTimeout(context.Background(), socksHandshakeTimeout)
+	remote, err := dialer.DialContext(ctx, "tcp", address)
+	cancel()
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("failed to dial %s for SOCKS5 client: %v", address, err)
+		socksReply(conn, socksHostUnreach)
+		return
+	}
+	defer remote.Close()
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Relay until either side closes
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// readSOCKSAddress reads the destination address of a request, returning it as host:port
+func readSOCKSAddress(r io.Reader, addrType byte) (string, error) {
+	var host string
+	switch addrType {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if addrType == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unsupported SOCKS5 address type %d", addrType)
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply sends a reply with the given status and an empty bound address
+func socksReply(w io.Writer, status byte) error {
+	_, err := w.Write([]byte{socksVersion, status, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,128 @@
+package conflux
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// confluxState is a step in the lifecycle of a conflux, which only moves forward
+type confluxState int
+
+const (
+	stateIdle confluxState = iota
+	stateStarting
+	stateRunning
+	stateStopping
+	stateStopped
+)
+
+func (s confluxState) String() string {
+	switch s {
+	case stateIdle:
+		return "idle"
+	case stateStarting:
+		return "starting"
+	case stateRunning:
+		return "running"
+	case stateStopping:
+		return "stopping"
+	case stateStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// lifecycle guards the state of a conflux so Start and Stop cannot race each other or run twice
+type lifecycle struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	state   confluxState
+
+	// cleaning is set once a running conflux began its cleanup, a Start that failed rolled back on its own
+	cleaning bool
+}
+
+// get returns the current state
+func (l *lifecycle) get() confluxState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
+
+// set moves to state and wakes the callers waiting for a change
+func (l *lifecycle) set(state confluxState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.state = state
+	if l.changed != nil {
+		l.changed.Broadcast()
+	}
+}
+
+// beginStart moves an idle conflux to starting, a conflux can only be started once
+func (l *lifecycle) beginStart() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.state != stateIdle {
+		return fmt.Errorf("cannot start the conflux, it is %s", l.state)
+	}
+	l.state = stateStarting
+	return nil
+}
+
+// beginStop moves a running conflux to stopping, reporting whether the caller runs the cleanup and whether one was
+// run at all, by this or an earlier Stop
+// A Start in progress is waited for first, an idle conflux goes straight to stopped with nothing to clean
+func (l *lifecycle) beginStop() (run, cleaned bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.changed == nil {
+		l.changed = sync.NewCond(&l.mu)
+	}
+	for l.state == stateStarting {
+		l.changed.Wait()
+	}
+	switch l.state {
+	case stateIdle:
+		l.state = stateStopped
+	case stateRunning:
+		l.state = stateStopping
+		l.cleaning = true
+		return true, true
+	}
+	return false, l.cleaning
+}
+
+// Start starts the conflux, cancelling the context aborts the startup and rolls back the host changes
+// A conflux can only be started once, a failed or stopped one is replaced by a new one
+func (c *conflux) Start(ctx context.Context, apiBaseURL, anchorToken string, portal bool) error {
+	err := c.life.beginStart()
+	if err != nil {
+		return err
+	}
+	err = c.start(ctx, apiBaseURL, anchorToken, portal)
+	if err != nil {
+		c.life.set(stateStopped)
+		return err
+	}
+	c.life.set(stateRunning)
+	c.writeIPFile()
+	return nil
+}
+
+// Stop stops the conflux, waiting for a Start in progress to finish first
+// Calling it again, or while another Stop runs, returns the result of the first cleanup once it is done
+func (c *conflux) Stop() error {
+	run, cleaned := c.life.beginStop()
+	if run {
+		c.removeIPFile()
+		err := c.stop()
+		c.life.set(stateStopped)
+		return err
+	}
+	if cleaned {
+		return c.stop()
+	}
+	return nil
+}
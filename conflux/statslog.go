@@ -0,0 +1,86 @@
+package conflux
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/veil-net/veilnet"
+)
+
+// trafficTotals is a snapshot of the packet and byte counters of both directions
+type trafficTotals struct {
+	packetsIn, packetsOut float64
+	bytesIn, bytesOut     float64
+}
+
+// readTrafficTotals reads the traffic counters from the Prometheus registry, so the log summary matches /metrics
+func readTrafficTotals() trafficTotals {
+	var t trafficTotals
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("failed to gather metrics: %v", err)
+		return t
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			ingress := false
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "direction" && label.GetValue() == "ingress" {
+					ingress = true
+				}
+			}
+			value := metric.GetCounter().GetValue()
+			switch {
+			case family.GetName() == "veilnet_conflux_packets_total" && ingress:
+				t.packetsIn += value
+			case family.GetName() == "veilnet_conflux_packets_total":
+				t.packetsOut += value
+			case family.GetName() == "veilnet_conflux_bytes_total" && ingress:
+				t.bytesIn += value
+			case family.GetName() == "veilnet_conflux_bytes_total":
+				t.bytesOut += value
+			}
+		}
+	}
+	return t
+}
+
+// logStats logs a traffic and health summary every interval until the anchor stops
+func (c *conflux) logStats(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := readTrafficTotals()
+	for {
+		select {
+		case <-c.anchor.Context().Done():
+			return
+		case <-ticker.C:
+			now := readTrafficTotals()
+			seconds := interval.Seconds()
+			stats := c.session.stats()
+			veilnet.Logger.Sugar().Infof("Stats: in %d pkts %s (%s/s), out %d pkts %s (%s/s), anchor alive, uptime %s",
+				int64(now.packetsIn), formatBytes(now.bytesIn), formatBytes((now.bytesIn-last.bytesIn)/seconds),
+				int64(now.packetsOut), formatBytes(now.bytesOut), formatBytes((now.bytesOut-last.bytesOut)/seconds),
+				stats.SessionUptime.Truncate(time.Second))
+			last = now
+		}
+	}
+}
+
+// formatBytes formats a byte count with a binary unit
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for bytes >= 1024 && i < len(units)-1 {
+		bytes /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", bytes, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", bytes, units[i])
+}
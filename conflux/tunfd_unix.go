@@ -0,0 +1,40 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package conflux
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/veil-net/veilnet"
+	tun "golang.zx2c4.com/wireguard/tun"
+)
+
+// createTUNFromFd wraps a TUN file descriptor inherited from the parent process
+func (c *conflux) createTUNFromFd(mtu int) error {
+	file := os.NewFile(uintptr(c.opts.TUNFd), "tun")
+	if file == nil {
+		return fmt.Errorf("invalid TUN file descriptor %d", c.opts.TUNFd)
+	}
+	device, err := tun.CreateTUNFromFile(file, mtu)
+	if err != nil {
+		veilnet.Logger.Sugar().Errorf("failed to use TUN file descriptor %d: %v", c.opts.TUNFd, err)
+		return err
+	}
+	c.device = device
+
+	// The parent picked the interface name, use it for the host configuration
+	name, err := device.Name()
+	if err != nil {
+		device.Close()
+		c.device = nil
+		return fmt.Errorf("failed to get the name of the inherited TUN: %v", err)
+	}
+	if name != c.opts.Interface {
+		veilnet.Logger.Sugar().Infof("Inherited TUN is named %s, using it instead of %s", name, c.opts.Interface)
+		c.opts.Interface = name
+	}
+	veilnet.Logger.Sugar().Infof("Using inherited TUN file descriptor %d", c.opts.TUNFd)
+	return nil
+}
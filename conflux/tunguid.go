@@ -0,0 +1,56 @@
+package conflux
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// defaultInterfaceDescription is the description of the wintun adapter unless one is given
+const defaultInterfaceDescription = "veilnet"
+
+// maxInterfaceDescription is the longest adapter description wintun accepts, MAX_ADAPTER_NAME less the terminator
+const maxInterfaceDescription = 127
+
+// checkInterfaceDescription validates the description of the wintun adapter
+func checkInterfaceDescription(description string) error {
+	if strings.TrimSpace(description) == "" {
+		return fmt.Errorf("the interface description must not be empty")
+	}
+	if len([]rune(description)) > maxInterfaceDescription {
+		return fmt.Errorf("the interface description must be at most %d characters", maxInterfaceDescription)
+	}
+	return nil
+}
+
+// legacyTUNGUID is the wintun GUID used before it was derived from the interface name, kept for the default interface
+const legacyTUNGUID = "{564E4554-564E-4554-5645-494C4E455400}"
+
+// checkTUNGUID validates a wintun GUID, with or without braces, and returns it in the braced upper case form
+func checkTUNGUID(guid string) (string, error) {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(guid, "{"), "}")
+	parts := strings.Split(trimmed, "-")
+	lengths := []int{8, 4, 4, 4, 12}
+	if len(parts) != len(lengths) {
+		return "", fmt.Errorf("invalid TUN GUID %q, expected the form {xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx}", guid)
+	}
+	for i, part := range parts {
+		if _, err := hex.DecodeString(part); err != nil || len(part) != lengths[i] {
+			return "", fmt.Errorf("invalid TUN GUID %q, expected the form {xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx}", guid)
+		}
+	}
+	return "{" + strings.ToUpper(trimmed) + "}", nil
+}
+
+// deriveTUNGUID returns a stable wintun GUID for the interface, a name based UUID so distinct names never share an adapter
+func deriveTUNGUID(iface string) string {
+	if iface == "veilnet" {
+		return legacyTUNGUID
+	}
+	sum := sha1.Sum([]byte("veilnet-conflux/" + iface))
+	sum[6] = sum[6]&0x0F | 0x50
+	sum[8] = sum[8]&0x3F | 0x80
+	h := strings.ToUpper(hex.EncodeToString(sum[:16]))
+	return fmt.Sprintf("{%s-%s-%s-%s-%s}", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32])
+}
@@ -0,0 +1,115 @@
+package conflux
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/veil-net/veilnet"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// startUserspace starts the conflux on a userspace network stack, serving a SOCKS5 proxy instead of
+// creating a TUN, so no privileges are needed and the host routes and DNS are left untouched
+func (c *conflux) startUserspace(ctx context.Context, apiBaseURL, anchorToken string, portal bool) error {
+	if portal {
+		return fmt.Errorf("portal is not supported in userspace mode")
+	}
+
+	// Time the startup phases, there is no gateway to detect
+	timer := newStartTimer()
+
+	// Create the anchor
+	c.anchor = newAnchor()
+
+	// Start the anchor
+	err := c.StartAnchor(ctx, apiBaseURL, anchorToken, portal)
+	if err != nil {
+		c.rollback()
+		return err
+	}
+	c.session.connected()
+	timer.phase("anchor")
+
+	// Get the CIDR
+	cidr, err := c.anchor.GetCIDR()
+	if err != nil {
+		c.rollback()
+		return err
+	}
+	cidr, err = normalizeCIDR(cidr)
+	if err != nil {
+		c.rollback()
+		return err
+	}
+	c.cidr = cidr
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		c.rollback()
+		return fmt.Errorf("invalid CIDR format: %s", cidr)
+	}
+
+	timer.phase("cidr")
+
+	// Create the userspace network stack in place of the TUN
+	dns := make([]netip.Addr, len(c.opts.DNS))
+	for i, server := range c.opts.DNS {
+		dns[i], err = netip.ParseAddr(server)
+		if err != nil {
+			c.rollback()
+			return fmt.Errorf("invalid DNS server %q: %v", server, err)
+		}
+	}
+	device, stack, err := netstack.CreateNetTUN([]netip.Addr{prefix.Addr()}, dns, 1500)
+	if err != nil {
+		c.rollback()
+		return fmt.Errorf("failed to create userspace network stack: %v", err)
+	}
+	c.device = device
+	veilnet.Logger.Sugar().Infof("Created userspace network stack with address %s", prefix.Addr())
+
+	// Serve the SOCKS5 proxy applications connect through
+	listener, err := net.Listen("tcp", c.opts.SOCKSAddress)
+	if err != nil {
+		c.rollback()
+		return fmt.Errorf("failed to listen for SOCKS5 on %s: %v", c.opts.SOCKSAddress, err)
+	}
+	c.socksListener = listener
+	go serveSOCKS(listener, stack)
+	veilnet.Logger.Sugar().Infof("Serving SOCKS5 proxy on %s", listener.Addr())
+
+	// Let the packet loops write to the TUN and start them
+	c.ready.Store(true)
+	go c.ingress()
+	go c.egress()
+
+	// Log a periodic traffic summary
+	go c.logStats(c.opts.StatsInterval)
+
+	// Watch the anchor and handle it going down
+	go c.watchAnchor()
+
+	// Restart the conflux if the egress loop wedges
+	go c.watchEgress(c.opts.EgressStallTimeout)
+
+	// Log how long the startup took
+	timer.phase("config")
+	timer.report(c.opts.Interface)
+
+	return nil
+}
+
+// stopUserspace stops a conflux started by startUserspace
+func (c *conflux) stopUserspace() {
+	if c.socksListener != nil {
+		c.socksListener.Close()
+	}
+	if c.anchor != nil {
+		c.anchor.Stop()
+	}
+	c.session.disconnected()
+	if c.device != nil {
+		c.device.Close()
+	}
+}
@@ -0,0 +1,61 @@
+package conflux
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/veil-net/veilnet"
+)
+
+// cleanupHosts lists the host routes the cleanup removes, read before it runs since removing a bypass route forgets it
+func (c *conflux) cleanupHosts() []string {
+	var hosts []string
+	c.bypassRoutes.Range(func(key, value interface{}) bool {
+		hosts = append(hosts, key.(string))
+		return true
+	})
+	if c.anchor != nil {
+		if veilHost := c.anchor.GetVeilHost(); veilHost != "" && !slices.Contains(hosts, veilHost) {
+			hosts = append(hosts, veilHost)
+		}
+	}
+	return hosts
+}
+
+// verifyCleanup re-reads the routing table and firewall after the cleanup if VerifyCleanup or StrictCleanup is set,
+// hosts are the host routes that were removed
+// What is left is logged, with StrictCleanup it also fails the cleanup
+func (c *conflux) verifyCleanup(hosts []string) error {
+	if !c.opts.VerifyCleanup && !c.opts.StrictCleanup {
+		return nil
+	}
+	var errs cleanupErrors
+	leftovers, err := c.cleanupLeftovers(hosts)
+	if err != nil {
+		veilnet.Logger.Sugar().Warnf("Failed to verify the cleanup: %v", err)
+		if c.opts.StrictCleanup {
+			errs.add("verify cleanup", err)
+		}
+	}
+	for _, leftover := range leftovers {
+		veilnet.Logger.Sugar().Warnf("Left after cleanup: %s", leftover)
+		if c.opts.StrictCleanup {
+			errs = append(errs, fmt.Errorf("verify cleanup: %s is left", leftover))
+		}
+	}
+	if err == nil && len(leftovers) == 0 {
+		veilnet.Logger.Sugar().Infof("Verified the cleanup, no routes or firewall rules of the conflux are left")
+	}
+	return errs.err()
+}
+
+// leftoverHostRoutes lists the hosts that still have a host route
+func (c *conflux) leftoverHostRoutes(hosts []string) []string {
+	var leftovers []string
+	for _, host := range hosts {
+		if c.hasHostRoute(host) {
+			leftovers = append(leftovers, "host route to "+host)
+		}
+	}
+	return leftovers
+}
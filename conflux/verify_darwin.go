@@ -0,0 +1,22 @@
+//go:build darwin
+// +build darwin
+
+package conflux
+
+// cleanupLeftovers lists the routes of the conflux still on the host, and reports a host left without a default route
+func (c *conflux) cleanupLeftovers(hosts []string) ([]string, error) {
+	leftovers := c.leftoverHostRoutes(hosts)
+	routes, err := defaultRoutes()
+	if err != nil {
+		return leftovers, err
+	}
+	for _, route := range routes {
+		if route.netif == c.opts.Interface {
+			leftovers = append(leftovers, "default route through "+c.opts.Interface)
+		}
+	}
+	if len(routes) == 0 {
+		leftovers = append(leftovers, "missing host default route via "+c.gateway)
+	}
+	return leftovers, nil
+}
@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+import (
+	"slices"
+	"strings"
+)
+
+// cleanupLeftovers lists the routes and iptables rules of the conflux still on the host
+// The routes are found by their proto tag and the rules by their comment, a tagged route only counts if it goes through
+// the interface of the conflux or to one of its bypass hosts, since other confluxes tag their routes the same way
+func (c *conflux) cleanupLeftovers(hosts []string) ([]string, error) {
+	var leftovers []string
+
+	// Routes tagged by the conflux, in any table
+	out, err := runCommand("ip", "-4", "route", "show", "table", "all", "proto", routeProto)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" && c.ownsRoute(line, hosts) {
+			leftovers = append(leftovers, "route "+line)
+		}
+	}
+
+	// The host default route the conflux replaced
+	if c.defaultRemoved {
+		out, err := runCommand("ip", "-4", "route", "show", "default")
+		if err != nil {
+			return leftovers, err
+		}
+		if !c.hasHostDefault(out) {
+			leftovers = append(leftovers, "missing host default route "+c.hostDefaultString())
+		}
+	}
+
+	// Firewall rules tagged by the conflux
+	if c.portal {
+		out, err := runCommand("iptables-save")
+		if err != nil {
+			return leftovers, err
+		}
+		for _, line := range strings.Split(out, "\n") {
+			if hasRuleComment(line, c.ruleComment()) {
+				leftovers = append(leftovers, "iptables rule "+strings.TrimSpace(line))
+			}
+		}
+	}
+	return leftovers, nil
+}
+
+// ownsRoute reports whether a route listed by ip route goes through the interface of the conflux or to one of hosts
+func (c *conflux) ownsRoute(route string, hosts []string) bool {
+	fields := strings.Fields(route)
+	if len(fields) == 0 {
+		return false
+	}
+	if slices.Contains(hosts, strings.TrimSuffix(fields[0], "/32")) {
+		return true
+	}
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "dev" && fields[i+1] == c.opts.Interface {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHostDefault reports whether the default routes listed by ip route go via the host gateway again
+func (c *conflux) hasHostDefault(out string) bool {
+	if len(c.nexthops) == 0 {
+		return strings.Contains(out, "via "+c.gateway+" dev "+c.iface)
+	}
+	for _, hop := range c.nexthops {
+		if !strings.Contains(out, "via "+hop.via+" dev "+hop.dev) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+//go:build linux
+// +build linux
+
+package conflux
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+const (
+	showTagged   = "ip -4 route show table all proto 86"
+	showDefaults = "ip -4 route show default"
+)
+
+// verifiedConflux returns a portal conflux on veilnet that replaced the host default route via 192.168.1.1 on eth0
+func verifiedConflux(opts Options) *conflux {
+	opts.Interface = "veilnet"
+	c := newConflux(opts)
+	c.portal = true
+	c.gateway = "192.168.1.1"
+	c.iface = "eth0"
+	c.defaultRemoved = true
+	return c
+}
+
+func TestCleanupLeftovers(t *testing.T) {
+	tests := []struct {
+		name     string
+		hosts    []string
+		setup    func(c *conflux, f *fakeCommands)
+		want     []string
+		wantErr  bool
+		wantRuns []string
+	}{
+		{
+			name: "clean",
+			setup: func(c *conflux, f *fakeCommands) {
+				f.set(showDefaults, "default via 192.168.1.1 dev eth0 proto dhcp metric 100", nil)
+			},
+		},
+		{
+			name:  "tagged routes left",
+			hosts: []string{"203.0.113.7"},
+			setup: func(c *conflux, f *fakeCommands) {
+				f.set(showTagged, "203.0.113.7 via 192.168.1.1 dev eth0 proto 86\n\n10.128.0.0/16 dev veilnet proto 86", nil)
+				f.set(showDefaults, "default via 192.168.1.1 dev eth0 proto dhcp metric 100", nil)
+			},
+			want: []string{
+				"route 203.0.113.7 via 192.168.1.1 dev eth0 proto 86",
+				"route 10.128.0.0/16 dev veilnet proto 86",
+			},
+		},
+		{
+			name:  "tagged routes of another conflux",
+			hosts: []string{"203.0.113.7"},
+			setup: func(c *conflux, f *fakeCommands) {
+				f.set(showTagged, "198.51.100.9 via 192.168.1.1 dev eth0 proto 86\n10.129.0.0/16 dev veilnet2 proto 86\ndefault dev veilnet2 table 8686 proto 86", nil)
+				f.set(showDefaults, "default via 192.168.1.1 dev eth0 proto dhcp metric 100", nil)
+			},
+		},
+		{
+			name: "host default missing",
+			setup: func(c *conflux, f *fakeCommands) {
+				f.set(showDefaults, "default dev veilnet proto 86", nil)
+			},
+			want: []string{"missing host default route via 192.168.1.1 on eth0"},
+		},
+		{
+			name: "multipath default partly restored",
+			setup: func(c *conflux, f *fakeCommands) {
+				c.nexthops = []nexthop{{via: "192.168.1.1", dev: "eth0"}, {via: "10.0.0.1", dev: "wlan0"}}
+				f.set(showDefaults, "default\n\tnexthop via 192.168.1.1 dev eth0 weight 1", nil)
+			},
+			want: []string{"missing host default route via 192.168.1.1 on eth0, 10.0.0.1 on wlan0"},
+		},
+		{
+			name: "firewall rules left",
+			setup: func(c *conflux, f *fakeCommands) {
+				f.set(showDefaults, "default via 192.168.1.1 dev eth0", nil)
+				f.set("iptables-save", "*nat\n-A POSTROUTING -s 10.128.0.0/16 -o eth0 -m comment --comment \"veilnet:veilnet\" -j MASQUERADE\n-A POSTROUTING -s 10.129.0.0/16 -o eth0 -m comment --comment \"veilnet:veilnet2\" -j MASQUERADE\n-A POSTROUTING -o docker0 -j MASQUERADE\nCOMMIT", nil)
+			},
+			want: []string{`iptables rule -A POSTROUTING -s 10.128.0.0/16 -o eth0 -m comment --comment "veilnet:veilnet" -j MASQUERADE`},
+		},
+		{
+			name: "default route not replaced",
+			setup: func(c *conflux, f *fakeCommands) {
+				c.defaultRemoved = false
+				c.portal = false
+			},
+			wantRuns: []string{showTagged},
+		},
+		{
+			name: "routes unreadable",
+			setup: func(c *conflux, f *fakeCommands) {
+				f.fail(showTagged, "Error: ipv4: FIB table does not exist.")
+			},
+			wantErr:  true,
+			wantRuns: []string{showTagged},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakeCommands(t)
+			c := verifiedConflux(Options{})
+			tt.setup(c, f)
+
+			got, err := c.cleanupLeftovers(tt.hosts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("cleanupLeftovers returned error %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("cleanupLeftovers = %q, want %q", got, tt.want)
+			}
+			if tt.wantRuns != nil && !slices.Equal(f.ran(), tt.wantRuns) {
+				t.Errorf("ran %q, want %q", f.ran(), tt.wantRuns)
+			}
+		})
+	}
+}
+
+func TestVerifyCleanup(t *testing.T) {
+	leftover := func(f *fakeCommands) {
+		f.set(showTagged, "10.128.0.0/16 dev veilnet proto 86", nil)
+		f.set(showDefaults, "default via 192.168.1.1 dev eth0", nil)
+	}
+	tests := []struct {
+		name    string
+		opts    Options
+		setup   func(f *fakeCommands)
+		wantErr bool
+		noRuns  bool
+	}{
+		{name: "disabled", setup: leftover, noRuns: true},
+		{name: "verify logs leftovers", opts: Options{VerifyCleanup: true}, setup: leftover},
+		{name: "strict fails on leftovers", opts: Options{StrictCleanup: true}, setup: leftover, wantErr: true},
+		{
+			name: "strict passes a clean host",
+			opts: Options{StrictCleanup: true},
+			setup: func(f *fakeCommands) {
+				f.set(showDefaults, "default via 192.168.1.1 dev eth0", nil)
+			},
+		},
+		{
+			name:    "strict fails when the host cannot be read",
+			opts:    Options{StrictCleanup: true},
+			setup:   func(f *fakeCommands) { f.fail(showTagged, "Operation not permitted") },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakeCommands(t)
+			tt.setup(f)
+			c := verifiedConflux(tt.opts)
+
+			err := c.verifyCleanup(nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyCleanup returned %v, want error %v", err, tt.wantErr)
+			}
+			var cleanup *CleanupError
+			if err != nil && !errors.As(err, &cleanup) {
+				t.Errorf("verifyCleanup returned %T, want a CleanupError", err)
+			}
+			if tt.noRuns && len(f.ran()) > 0 {
+				t.Errorf("ran %q with the verification disabled", f.ran())
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package conflux
+
+import (
+	"strings"
+)
+
+// cleanupLeftovers lists the routes of the conflux still on the host, and a host default route that was not put back
+func (c *conflux) cleanupLeftovers(hosts []string) ([]string, error) {
+	leftovers := c.leftoverHostRoutes(hosts)
+	out, err := runCommand("route", "print", "0.0.0.0")
+	if err != nil {
+		return leftovers, err
+	}
+	restored := false
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != "0.0.0.0" || fields[1] != "0.0.0.0" {
+			continue
+		}
+		if fields[2] == c.gateway && fields[3] == c.iface {
+			restored = true
+		}
+	}
+	if !restored {
+		leftovers = append(leftovers, "missing host default route via "+c.gateway)
+	}
+	return leftovers, nil
+}
@@ -0,0 +1,52 @@
+package conflux
+
+import (
+	"time"
+
+	"github.com/veil-net/veilnet"
+)
+
+// watchEgress closes Stalled if the egress loop completes no TUN read for timeout while the anchor is alive and the
+// ingress loop is still writing packets to the TUN
+// A wedged TUN blocks the read forever, which the anchor liveness check cannot see. An idle host reads nothing either,
+// but then nothing reaches it from the plane that it would answer, so only a stall with ingress traffic counts
+func (c *conflux) watchEgress(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	c.lastEgress.Store(time.Now().UnixNano())
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.anchor.Context().Done():
+			return
+		case now := <-ticker.C:
+			if !c.anchor.IsAlive() {
+				continue
+			}
+			if !egressStalled(c.lastEgress.Load(), c.lastIngress.Load(), timeout, now) {
+				continue
+			}
+			stalled := now.Sub(time.Unix(0, c.lastEgress.Load()))
+			veilnet.Logger.Sugar().Errorf("Egress stalled, no TUN read completed for %s while packets kept being written to it, restarting the conflux", stalled.Truncate(time.Second))
+			close(c.stalled)
+			return
+		}
+	}
+}
+
+// egressStalled reports whether the last TUN read is at least timeout old while a packet was written to the TUN after
+// it and within the last timeout, lastRead and lastWrite are in Unix nanoseconds
+func egressStalled(lastRead, lastWrite int64, timeout time.Duration, now time.Time) bool {
+	if now.Sub(time.Unix(0, lastRead)) < timeout {
+		return false
+	}
+	return lastWrite > lastRead && now.Sub(time.Unix(0, lastWrite)) < timeout
+}
+
+// Stalled returns a channel closed when the egress watchdog found the TUN wedged, the conflux keeps its host
+// configuration and should be stopped and started again
+func (c *conflux) Stalled() <-chan struct{} {
+	return c.stalled
+}
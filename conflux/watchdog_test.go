@@ -0,0 +1,64 @@
+package conflux
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEgressStalled(t *testing.T) {
+	now := time.Now()
+	at := func(ago time.Duration) int64 { return now.Add(-ago).UnixNano() }
+	for _, tc := range []struct {
+		name      string
+		lastRead  int64
+		lastWrite int64
+		want      bool
+	}{
+		{"recent read", at(time.Second), at(0), false},
+		{"idle host", at(time.Minute), 0, false},
+		{"nothing written since the last read", at(time.Minute), at(2 * time.Minute), false},
+		{"written since the last read but not lately", at(3 * time.Minute), at(2 * time.Minute), false},
+		{"written lately with no read", at(time.Minute), at(time.Second), true},
+	} {
+		if got := egressStalled(tc.lastRead, tc.lastWrite, 30*time.Second, now); got != tc.want {
+			t.Errorf("%s: stalled is %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWatchEgressIdleHost(t *testing.T) {
+	c := newConflux(Options{})
+	anchor := newMockAnchor()
+	c.anchor = anchor
+	defer anchor.Stop()
+	go c.watchEgress(20 * time.Millisecond)
+
+	select {
+	case <-c.Stalled():
+		t.Fatal("an idle host was taken for a stalled TUN")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWatchEgressStall(t *testing.T) {
+	c := newConflux(Options{})
+	anchor := newMockAnchor()
+	c.anchor = anchor
+	defer anchor.Stop()
+	go c.watchEgress(20 * time.Millisecond)
+
+	// Keep writing to the TUN while nothing is read from it
+	ticker := time.NewTicker(2 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case <-c.Stalled():
+			return
+		case <-ticker.C:
+			c.lastIngress.Store(time.Now().UnixNano())
+		case <-deadline:
+			t.Fatal("the stall was not detected while packets were written to the TUN")
+		}
+	}
+}
@@ -0,0 +1,67 @@
+//go:build windows
+// +build windows
+
+package conflux
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/veil-net/veilnet"
+	"golang.org/x/sys/windows"
+)
+
+//go:embed wintun.dll
+var wintunDLL []byte
+
+// wintunSearchFlags are the places wireguard-go loads wintun.dll from: the directory of the executable and System32
+const wintunSearchFlags = windows.LOAD_LIBRARY_SEARCH_APPLICATION_DIR | windows.LOAD_LIBRARY_SEARCH_SYSTEM32
+
+// loadWintun makes wintun.dll available to wireguard-go, extracting the embedded copy next to the executable unless
+// SystemWintun is set, in which case an installed copy must already be loadable
+func (c *conflux) loadWintun() error {
+	if c.opts.SystemWintun {
+		return checkSystemWintun()
+	}
+	return extractWintun()
+}
+
+// extractWintun writes the embedded wintun.dll next to the executable, keeping a copy already there
+func extractWintun() error {
+	executablePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	dllPath := filepath.Join(filepath.Dir(executablePath), "wintun.dll")
+
+	// Check if the file already exists
+	if _, err := os.Stat(dllPath); os.IsNotExist(err) {
+		// File does not exist, so write it
+		if err := os.WriteFile(dllPath, wintunDLL, 0644); err != nil {
+			return err
+		}
+	} else if err != nil {
+		// An error occurred while checking the file
+		return err
+	}
+	return nil
+}
+
+// checkSystemWintun checks an installed wintun.dll can be loaded from where wireguard-go looks for it
+func checkSystemWintun() error {
+	dll, err := windows.LoadLibraryEx("wintun.dll", 0, wintunSearchFlags)
+	if err != nil {
+		return fmt.Errorf("failed to load the installed wintun.dll, install it next to the executable or in System32, or drop --system-wintun to use the embedded copy: %v", err)
+	}
+	defer windows.FreeLibrary(dll)
+
+	path := "wintun.dll"
+	buf := make([]uint16, windows.MAX_PATH)
+	if n, err := windows.GetModuleFileName(dll, &buf[0], uint32(len(buf))); err == nil {
+		path = windows.UTF16ToString(buf[:n])
+	}
+	veilnet.Logger.Sugar().Infof("Using the installed %s", path)
+	return nil
+}
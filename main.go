@@ -11,10 +11,17 @@ import (
 var version = "1.0.5"
 
 func main() {
+	// Load the env files so the flags can be resolved from them
+	err := conflux.LoadEnvFiles(os.Args[1:])
+	if err != nil {
+		veilnet.Logger.Sugar().Errorf("%v", err)
+		os.Exit(1)
+	}
+
 	// Parse the CLI arguments
 	var cli conflux.CLI
 	ctx := kong.Parse(&cli, kong.Vars{"version": version})
-	err := ctx.Run()
+	err = ctx.Run()
 	if err != nil {
 		veilnet.Logger.Sugar().Errorf("%v", err)
 		os.Exit(1)